@@ -0,0 +1,79 @@
+// +build linux,cgo
+
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package afpacket_sniffer
+
+/*
+#cgo LDFLAGS: -lpcap
+#include <stdlib.h>
+#include <pcap.h>
+*/
+import "C"
+
+import (
+	"errors"
+	"syscall"
+	"unsafe"
+
+	"github.com/google/gopacket/layers"
+)
+
+// linkTypeDLT returns the DLT_* value pcap_open_dead takes for the link
+// type. LINKTYPE_* values are those of DLT_* except for raw IP, whose
+// DLT_RAW differs between platforms.
+func linkTypeDLT(linkType layers.LinkType) C.int {
+	if linkType == layers.LinkTypeRaw {
+		return C.DLT_RAW
+	}
+	return C.int(linkType)
+}
+
+// compileBPFFilter compiles the filter expression for frames of the
+// given link type truncated to snaplen bytes, in the form attached to
+// sockets. The vendored pcap package cannot compile without a capture
+// handle, hence libpcap is used directly.
+func compileBPFFilter(linkType layers.LinkType, snaplen int, expr string) ([]syscall.SockFilter, error) {
+	cptr := C.pcap_open_dead(linkTypeDLT(linkType), C.int(snaplen))
+	if cptr == nil {
+		return nil, errors.New("pcap_open_dead failed")
+	}
+	defer C.pcap_close(cptr)
+
+	var program C.struct_bpf_program
+	cexpr := C.CString(expr)
+	defer C.free(unsafe.Pointer(cexpr))
+	if C.pcap_compile(cptr, &program, cexpr, 1, C.PCAP_NETMASK_UNKNOWN) != 0 {
+		return nil, errors.New(C.GoString(C.pcap_geterr(cptr)))
+	}
+	defer C.pcap_freecode(&program)
+
+	instructions := (*[1 << 16]C.struct_bpf_insn)(unsafe.Pointer(program.bf_insns))[:program.bf_len:program.bf_len]
+	filter := make([]syscall.SockFilter, len(instructions))
+	for i, instruction := range instructions {
+		filter[i] = syscall.SockFilter{
+			Code: uint16(instruction.code),
+			Jt:   uint8(instruction.jt),
+			Jf:   uint8(instruction.jf),
+			K:    uint32(instruction.k),
+		}
+	}
+	return filter, nil
+}
@@ -1,4 +1,4 @@
-// +build !linux
+// +build !linux !cgo
 
 /*
  *    HoneyBadger core library for detecting TCP injection attacks
@@ -22,18 +22,35 @@
 package afpacket_sniffer
 
 import (
+	"errors"
+
 	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/david415/HoneyBadger/types"
 )
 
 type AfpacketHandle struct {
 }
 
-func NewAfpacketHandle(netDevice string) (*AfpacketHandle, error) {
+func NewAfpacketHandle(netDevice string, options AfpacketOptions) (*AfpacketHandle, error) {
 	return &AfpacketHandle{}, nil
 }
 
+func NewAfpacketFanoutHandles(netDevice string, options AfpacketOptions, workers int, fanoutID uint16) ([]*AfpacketHandle, error) {
+	return nil, errors.New("AF_PACKET fanout is only supported by Linux builds with cgo")
+}
+
 func (a *AfpacketHandle) ReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error) {
-	panic("AF_PACKET not supported by non-Linux systems")
+	panic("AF_PACKET is only supported by Linux builds with cgo")
+}
+
+func (a *AfpacketHandle) LinkType() layers.LinkType {
+	return layers.LinkTypeEthernet
+}
+
+func (a *AfpacketHandle) CaptureStats() (types.CaptureStats, error) {
+	return types.CaptureStats{}, errors.New("AF_PACKET is only supported by Linux builds with cgo")
 }
 
 func (a *AfpacketHandle) Close() {
@@ -1,4 +1,4 @@
-// +build linux
+// +build linux,cgo
 
 /*
  *    HoneyBadger core library for detecting TCP injection attacks
@@ -22,25 +22,259 @@
 package afpacket_sniffer
 
 import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/afpacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+// ARPHRD_* hardware types as reported by /sys/class/net/<interface>/type
+const (
+	arphrdTunnel  = 768
+	arphrdTunnel6 = 769
+	arphrdSit     = 776
+	arphrdIPGRE   = 778
+	arphrdNone    = 65534
 )
 
+// readAhead is the number of packets an AfpacketHandle reads ahead of
+// its caller
+const readAhead = 64
+
+// AfpacketHandle reads the packets of an AF_PACKET socket. The socket
+// is read by a goroutine of its own so that reads can time out, which
+// the afpacket package does not support, and so that Close does not
+// unmap the ring while it is being read: a pending read closes the
+// socket once it returns.
 type AfpacketHandle struct {
 	afpacketHandle *afpacket.TPacket
+	linkType       layers.LinkType
+	pollTimeout    time.Duration
+	reads          chan afpacketRead
+	closing        chan bool
+	closeOnce      sync.Once
+	// socketMutex guards the socket's descriptor, which is -1 once the
+	// socket is closed, and the statistics accumulated from it
+	socketMutex sync.Mutex
+	fd          int
+	stats       types.CaptureStats
+}
+
+type afpacketRead struct {
+	data []byte
+	ci   gopacket.CaptureInfo
+	err  error
 }
 
-func NewAfpacketHandle(netDevice string) (*AfpacketHandle, error) {
-	afpacketHandle, err := afpacket.NewTPacket(afpacket.OptInterface(netDevice))
-	return &AfpacketHandle{
-		afpacketHandle: afpacketHandle,
-	}, err
+func NewAfpacketHandle(netDevice string, options AfpacketOptions) (*AfpacketHandle, error) {
+	return newAfpacketHandle(netDevice, interfaceLinkType(netDevice), options)
 }
 
+// newAfpacketHandle opens an AF_PACKET socket on the interface with the
+// ring and BPF filter selected by the options
+func newAfpacketHandle(netDevice string, linkType layers.LinkType, options AfpacketOptions) (*AfpacketHandle, error) {
+	opts := []interface{}{afpacket.OptInterface(netDevice)}
+	if options.FrameSize > 0 {
+		opts = append(opts, afpacket.OptFrameSize(options.FrameSize))
+	}
+	if options.BlockSize > 0 {
+		opts = append(opts, afpacket.OptBlockSize(options.BlockSize))
+	}
+	if options.NumBlocks > 0 {
+		opts = append(opts, afpacket.OptNumBlocks(options.NumBlocks))
+	}
+	tpacket, err := afpacket.NewTPacket(opts...)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := socketDescriptor(tpacket)
+	if err != nil {
+		tpacket.Close()
+		return nil, err
+	}
+	if options.Filter != "" || options.Snaplen > 0 {
+		snaplen := options.Snaplen
+		if snaplen <= 0 {
+			snaplen = 65535
+		}
+		filter, err := compileBPFFilter(linkType, snaplen, options.Filter)
+		if err != nil {
+			tpacket.Close()
+			return nil, fmt.Errorf("BPF filter %q: %s", options.Filter, err)
+		}
+		if err = syscall.AttachLsf(fd, filter); err != nil {
+			tpacket.Close()
+			return nil, fmt.Errorf("attaching BPF filter %q: %s", options.Filter, err)
+		}
+	}
+	a := &AfpacketHandle{
+		afpacketHandle: tpacket,
+		linkType:       linkType,
+		pollTimeout:    options.PollTimeout,
+		reads:          make(chan afpacketRead, readAhead),
+		closing:        make(chan bool),
+		fd:             fd,
+	}
+	go a.readPackets()
+	return a, nil
+}
+
+// socketDescriptor returns the descriptor of the TPacket's socket, which
+// the afpacket package keeps unexported
+func socketDescriptor(tpacket *afpacket.TPacket) (int, error) {
+	field := reflect.ValueOf(tpacket).Elem().FieldByName("fd")
+	switch field.Kind() {
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		return int(field.Int()), nil
+	}
+	return -1, errors.New("cannot find the socket of afpacket.TPacket")
+}
+
+func (a *AfpacketHandle) readPackets() {
+	for {
+		data, ci, err := a.afpacketHandle.ReadPacketData()
+		select {
+		case <-a.closing:
+			a.closeSocket()
+			return
+		default:
+		}
+		select {
+		case a.reads <- afpacketRead{data, ci, err}:
+		case <-a.closing:
+			a.closeSocket()
+			return
+		}
+	}
+}
+
+func (a *AfpacketHandle) closeSocket() {
+	a.socketMutex.Lock()
+	defer a.socketMutex.Unlock()
+	a.afpacketHandle.Close()
+	a.fd = -1
+}
+
+// NewAfpacketFanoutHandles opens the given number of AF_PACKET sockets
+// on the interface and joins them in a PACKET_FANOUT group with the given
+// identifier, which must not be used by another process. The kernel
+// spreads packets over the group members by flow hash, thus both
+// directions of a TCP connection are read from the same handle; it also
+// reassembles IP fragments before hashing them so that fragments of one
+// datagram are not spread over several handles.
+func NewAfpacketFanoutHandles(netDevice string, options AfpacketOptions, workers int, fanoutID uint16) ([]*AfpacketHandle, error) {
+	linkType := interfaceLinkType(netDevice)
+	handles := make([]*AfpacketHandle, 0, workers)
+	for len(handles) < workers {
+		handle, err := newAfpacketHandle(netDevice, linkType, options)
+		if err == nil {
+			err = handle.afpacketHandle.SetFanout(afpacket.FanoutHashWithDefrag, fanoutID)
+			if err != nil {
+				handle.Close()
+			}
+		}
+		if err != nil {
+			for _, handle := range handles {
+				handle.Close()
+			}
+			return nil, fmt.Errorf("AF_PACKET fanout worker %d: %s", len(handles), err)
+		}
+		handles = append(handles, handle)
+	}
+	return handles, nil
+}
+
+// interfaceLinkType determines how the frames read from a SOCK_RAW
+// AF_PACKET socket bound to the given interface are framed. Interfaces
+// without a link layer header, such as tun devices, produce raw IP.
+func interfaceLinkType(netDevice string) layers.LinkType {
+	contents, err := ioutil.ReadFile(fmt.Sprintf("/sys/class/net/%s/type", netDevice))
+	if err != nil {
+		return layers.LinkTypeEthernet
+	}
+	hardwareType, err := strconv.Atoi(strings.TrimSpace(string(contents)))
+	if err != nil {
+		return layers.LinkTypeEthernet
+	}
+	switch hardwareType {
+	case arphrdNone, arphrdTunnel, arphrdTunnel6, arphrdSit, arphrdIPGRE:
+		return layers.LinkTypeRaw
+	}
+	// Ethernet and loopback devices both deliver Ethernet headers
+	return layers.LinkTypeEthernet
+}
+
+// ReadPacketData returns the next packet of the socket, or ErrTimeout
+// if none arrived within the PollTimeout of the handle's options
 func (a *AfpacketHandle) ReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error) {
-	return a.afpacketHandle.ReadPacketData()
+	select {
+	case read := <-a.reads:
+		return read.data, read.ci, read.err
+	default:
+	}
+	var timeout <-chan time.Time
+	if a.pollTimeout > 0 {
+		timer := time.NewTimer(a.pollTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case read := <-a.reads:
+		return read.data, read.ci, read.err
+	case <-timeout:
+		return nil, ci, ErrTimeout
+	}
 }
 
+// LinkType returns the link type of the capture interface
+func (a *AfpacketHandle) LinkType() layers.LinkType {
+	return a.linkType
+}
+
+// tpacketStats is struct tpacket_stats of linux/if_packet.h, the start
+// of the statistics of all TPACKET versions
+type tpacketStats struct {
+	packets uint32
+	drops   uint32
+}
+
+// CaptureStats returns the kernel's packet counters of the socket.
+// AF_PACKET sockets do not count the drops of the interface.
+func (a *AfpacketHandle) CaptureStats() (types.CaptureStats, error) {
+	a.socketMutex.Lock()
+	defer a.socketMutex.Unlock()
+	if a.fd < 0 {
+		return a.stats, errors.New("AF_PACKET socket is closed")
+	}
+	// the kernel resets its counters when they are read
+	var stats tpacketStats
+	size := uint32(unsafe.Sizeof(stats))
+	_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, uintptr(a.fd), syscall.SOL_PACKET, syscall.PACKET_STATISTICS,
+		uintptr(unsafe.Pointer(&stats)), uintptr(unsafe.Pointer(&size)), 0)
+	if errno != 0 {
+		return a.stats, errno
+	}
+	a.stats.Received += uint64(stats.packets)
+	a.stats.Dropped += uint64(stats.drops)
+	return a.stats, nil
+}
+
+// Close stops reading the socket. The socket is closed as soon as a
+// pending read returns, which may take until the next packet arrives.
 func (a *AfpacketHandle) Close() {
-	a.afpacketHandle.Close()
+	a.closeOnce.Do(func() {
+		close(a.closing)
+	})
 }
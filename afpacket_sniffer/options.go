@@ -0,0 +1,43 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package afpacket_sniffer
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrTimeout is returned by reads when no packet arrived within the
+// PollTimeout of the AfpacketOptions
+var ErrTimeout = errors.New("AF_PACKET read timeout expired")
+
+// AfpacketOptions configure the ring and the filter of AF_PACKET
+// sockets; zero values select the defaults of the afpacket package.
+type AfpacketOptions struct {
+	FrameSize   int
+	BlockSize   int
+	NumBlocks   int
+	PollTimeout time.Duration
+	// Filter is a BPF expression attached to the socket so that the
+	// kernel drops the packets it rejects; packets are truncated to
+	// Snaplen bytes if it is set.
+	Filter  string
+	Snaplen int
+}
@@ -22,6 +22,7 @@ package bpf_sniffer
 import (
 	"fmt"
 	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
 	"golang.org/x/sys/unix"
 	"syscall"
 	"time"
@@ -42,6 +43,7 @@ type TimedFrame struct {
 type BpfSniffer struct {
 	fd       int
 	name     string
+	linkType layers.LinkType
 	stopChan chan bool
 	readChan chan TimedFrame
 }
@@ -81,6 +83,11 @@ func (b *BpfSniffer) Init(name string) error {
 	if err != nil {
 		return err
 	}
+	dlt, err := syscall.BpfDatalink(b.fd)
+	if err != nil {
+		return err
+	}
+	b.linkType = layers.LinkType(dlt)
 
 	go b.readFrames()
 	return nil
@@ -123,6 +130,11 @@ func (b *BpfSniffer) readFrames() {
 	}
 }
 
+// LinkType returns the data link type of the BPF device
+func (b *BpfSniffer) LinkType() layers.LinkType {
+	return b.linkType
+}
+
 func (b *BpfSniffer) ReadTimedFrame() TimedFrame {
 	timedFrame := <-b.readChan
 	return timedFrame
@@ -23,6 +23,7 @@ package bpf_sniffer
 
 import (
 	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
 )
 
 type BpfSniffer struct {
@@ -36,6 +37,10 @@ func (b *BpfSniffer) Init(fufu string) error {
 	return nil
 }
 
+func (b *BpfSniffer) LinkType() layers.LinkType {
+	return layers.LinkTypeEthernet
+}
+
 func (b *BpfSniffer) ReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error) {
 	panic("BPF not supported in Linux")
 }
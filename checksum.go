@@ -0,0 +1,123 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package HoneyBadger
+
+import (
+	"encoding/binary"
+	"net"
+
+	"github.com/google/gopacket/layers"
+)
+
+// onesComplementSum adds the data as big endian 16 bit words to sum,
+// padding odd length data with a zero byte
+func onesComplementSum(sum uint32, data []byte) uint32 {
+	for ; len(data) > 1; data = data[2:] {
+		sum += uint32(data[0])<<8 | uint32(data[1])
+	}
+	if len(data) == 1 {
+		sum += uint32(data[0]) << 8
+	}
+	return sum
+}
+
+// foldChecksum returns the internet checksum of a one's complement sum
+func foldChecksum(sum uint32) uint16 {
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
+
+// validIPv4HeaderChecksum returns true if the checksum of the IPv4
+// header is correct
+func validIPv4HeaderChecksum(ip *layers.IPv4) bool {
+	return foldChecksum(onesComplementSum(0, ip.Contents)) == 0
+}
+
+// validTCPChecksum returns true if the checksum of the TCP segment is
+// correct. The pseudo header is made of the addresses of ip6 if it is
+// not nil, otherwise of those of ip4. The checksums of IPv6 packets whose
+// final destination is unknown, see ipv6FinalDestination, are deemed
+// correct as they cannot be verified.
+func validTCPChecksum(ip4 *layers.IPv4, ip6 *layers.IPv6, tcp *layers.TCP) bool {
+	length := len(tcp.Contents) + len(tcp.Payload)
+	var sum uint32
+	if ip6 != nil {
+		dst, ok := ipv6FinalDestination(ip6)
+		if !ok {
+			return true
+		}
+		sum = onesComplementSum(sum, ip6.SrcIP.To16())
+		sum = onesComplementSum(sum, dst.To16())
+		var pseudo [8]byte
+		binary.BigEndian.PutUint32(pseudo[:4], uint32(length))
+		pseudo[7] = byte(layers.IPProtocolTCP)
+		sum = onesComplementSum(sum, pseudo[:])
+	} else {
+		sum = onesComplementSum(sum, ip4.SrcIP.To4())
+		sum = onesComplementSum(sum, ip4.DstIP.To4())
+		var pseudo [4]byte
+		pseudo[1] = byte(layers.IPProtocolTCP)
+		binary.BigEndian.PutUint16(pseudo[2:], uint16(length))
+		sum = onesComplementSum(sum, pseudo[:])
+	}
+	// TCP headers are a multiple of 4 bytes long, thus the payload
+	// words are aligned with those of the header
+	sum = onesComplementSum(sum, tcp.Contents)
+	sum = onesComplementSum(sum, tcp.Payload)
+	return foldChecksum(sum) == 0
+}
+
+// ipv6FinalDestination returns the destination address of the TCP
+// pseudo header of an IPv6 packet, which is the final destination given
+// by a routing header with segments left rather than the destination of
+// the IPv6 header. It returns false for routing headers with segments
+// left of other types than 0, 2 (mobility) and 4 (segment routing),
+// such as compressed RPL source routes, whose final destination is
+// unknown.
+func ipv6FinalDestination(ip6 *layers.IPv6) (net.IP, bool) {
+	next, data := ip6.NextHeader, ip6.Payload
+	if ip6.HopByHop != nil {
+		next = ip6.HopByHop.NextHeader
+	}
+	for next == layers.IPProtocolIPv6Routing || next == layers.IPProtocolIPv6Destination {
+		if len(data) < 8 || (int(data[1])+1)*8 > len(data) {
+			break
+		}
+		length := (int(data[1]) + 1) * 8
+		if next == layers.IPProtocolIPv6Routing && data[3] != 0 {
+			switch {
+			case length < 24:
+				return nil, false
+			case data[2] == 0 || data[2] == 2:
+				// the addresses are in the order they are visited
+				return net.IP(data[length-16 : length]), true
+			case data[2] == 4:
+				// the segment list is in reverse order
+				return net.IP(data[8:24]), true
+			default:
+				return nil, false
+			}
+		}
+		next, data = layers.IPProtocol(data[0]), data[length:]
+	}
+	return ip6.DstIP, true
+}
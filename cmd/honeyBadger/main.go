@@ -22,6 +22,8 @@ package main
 import (
 	"flag"
 	"log"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/david415/HoneyBadger"
@@ -31,7 +33,7 @@ import (
 
 func main() {
 	var (
-		pcapfile                 = flag.String("pcapfile", "", "pcap filename to read packets from rather than a wire interface.")
+		pcapfile                 = flag.String("pcapfile", "", "pcap or pcapng file, glob or directory to read packets from rather than a wire interface. Further ones may follow the options; the packets of all files are merged by capture timestamp. \"-\" or a named pipe reads a single pcap stream, e.g. from tcpdump -w -")
 		iface                    = flag.String("i", "eth0", "Interface to get packets from")
 		snaplen                  = flag.Int("s", 65536, "SnapLen for pcap packet capture")
 		filter                   = flag.String("f", "tcp", "BPF filter for pcap")
@@ -39,12 +41,20 @@ func main() {
 		wireTimeout              = flag.String("w", "3s", "timeout for reading packets off the wire")
 		metadataAttackLog        = flag.Bool("metadata_attack_log", true, "if set to true then attack reports will only include metadata")
 		logPackets               = flag.Bool("log_packets", false, "if set to true then log all packets for each tracked TCP connection")
+		pcapngLogs               = flag.Bool("pcapng_logs", false, "if set to true then packet logs are written as pcapng with comments on the packets implicated in attacks")
 		tcpTimeout               = flag.Duration("tcp_idle_timeout", time.Minute*5, "tcp idle timeout duration")
-		maxRingPackets           = flag.Int("max_ring_packets", 40, "Max packets per connection stream ring buffer")
+		maxRingPackets           = flag.Int("max_ring_packets", 40, "Max packets per connection stream ring buffer; zero or less is unbounded")
+		maxRingBytes             = flag.Int("max_ring_bytes", 0, "Max payload bytes per connection stream ring buffer; zero or less is unbounded")
+		maxRingAge               = flag.Duration("max_ring_age", 0, "Max time between the oldest and newest segment of a connection stream ring buffer; zero or less is unbounded")
+		ringMemoryBudget         = flag.Int("ring_memory_budget", 0, "Max megabytes of payload held by the stream ring buffers of all connections; zero or less is unbounded")
 		detectHijack             = flag.Bool("detect_hijack", true, "Detect handshake hijack attacks")
 		detectInjection          = flag.Bool("detect_injection", true, "Detect injection attacks")
 		detectCoalesceInjection  = flag.Bool("detect_coalesce_injection", true, "Detect coalesce injection attacks")
+		detectHeaderAnomalies    = flag.Bool("detect_header_anomalies", false, "Detect packets whose TTL or IP ID deviates from the rest of their flow")
+		ttlTolerance             = flag.Int("ttl_tolerance", HoneyBadger.DefaultTTLTolerance, "TTL deviation from the rest of a flow which detect_header_anomalies does not report")
+		ipIDTolerance            = flag.Int("ipid_tolerance", HoneyBadger.DefaultIPIDTolerance, "largest increment of a sender's IP IDs which detect_header_anomalies does not report")
 		maxConcurrentConnections = flag.Int("max_concurrent_connections", 0, "Maximum number of concurrent connection to track.")
+		dispatcherShards         = flag.Int("dispatcher_shards", 1, "number of goroutines tracking connections in parallel, each with its share of the connections and of total_max_buffer")
 		bufferedPerConnection    = flag.Int("connection_max_buffer", 0, `
 Max packets to buffer for a single connection before skipping over a gap in data
 and continuing to stream the connection after the buffer.  If zero or less, this
@@ -56,7 +66,25 @@ continuing to stream connection data.  If zero or less, this is infinite`)
 		maxNumPcapRotations = flag.Int("max_pcap_rotations", 10, "maximum number of pcap rotations per connection")
 		archiveDir          = flag.String("archive_dir", "", "archive directory for storing attack logs and related pcap files")
 		useAfPacket         = flag.Bool("afpacket", false, "Use AF_PACKET for faster, harder sniffing of packets.")
+		afpacketWorkers     = flag.Int("afpacket_workers", 1, "number of AF_PACKET capture workers sharing the interface's packets by flow hash (PACKET_FANOUT)")
+		afpacketFrameSize   = flag.Int("afpacket_frame_size", 0, "AF_PACKET ring frame size in bytes; must hold the snaplen. 0 selects 4096")
+		afpacketBlockSize   = flag.Int("afpacket_block_size", 0, "AF_PACKET ring block size in bytes, a multiple of the page and frame sizes. 0 selects 128 frames")
+		afpacketNumBlocks   = flag.Int("afpacket_blocks", 0, "number of AF_PACKET ring blocks. 0 selects 128")
+		sensorListen        = flag.String("sensor_listen", "", "address or Unix socket path to accept the packets of remote sensors on, e.g. :4242, rather than capturing packets locally")
+		sensorNetwork       = flag.String("sensor_network", "tcp", "socket type of sensor_listen, tcp or unix")
+		sensorSecretFile    = flag.String("sensor_secret_file", "", "file holding the secret remote sensors must know; required unless sensor_listen only accepts local connections")
+		skipChecksums       = flag.Bool("skip_checksums", false, "do not validate IPv4 and TCP checksums; use when capturing on a host whose network interface computes the checksums of the packets it sends")
+		policyFile          = flag.String("policy", "", "file of flow policy rules deciding which connections are tracked, ignored or tracked without payload logging; SIGHUP reloads it")
+		statsInterval       = flag.Duration("stats_interval", time.Minute, "how often to log the received and dropped packet counters of live captures; 0 disables. SIGUSR1 logs them on demand")
 		useBpf              = flag.Bool("bpf", false, "Use *BSD-only BPF for sniffing packets on non-Linux systems.")
+		trackVLAN           = flag.Bool("track_vlan", false, "Include 802.1Q VLAN IDs in connection identity so identical 4-tuples on different VLANs are tracked separately.")
+		fragmentTimeout     = flag.Duration("fragment_timeout", HoneyBadger.DefaultFragmentTimeout, "how long to wait for the missing fragments of an IPv4 datagram")
+		maxFragmentBytes    = flag.Int("max_fragment_buffer", HoneyBadger.DefaultMaxFragmentBytes, "maximum bytes of IPv4 fragments to buffer for reassembly")
+		decapGRE            = flag.Bool("decap_gre", false, "Analyze the TCP/IP packets carried in GRE (including ERSPAN) tunnels.")
+		decapIPIP           = flag.Bool("decap_ipip", false, "Analyze the TCP/IP packets carried in IP-in-IP tunnels.")
+		vxlanPorts          = flag.String("vxlan_ports", "", "comma separated UDP ports whose VXLAN encapsulated packets are analyzed, e.g. 4789")
+		replaySpeed         = flag.Float64("replay_speed", 0, "replay pcap files at this multiple of their captured timing, e.g. 1 for real time; 0 replays as fast as possible")
+		replayLoops         = flag.Int("replay_loops", 1, "number of times to replay the pcap files; a negative count replays them forever")
 	)
 	flag.Parse()
 
@@ -77,6 +105,37 @@ continuing to stream connection data.  If zero or less, this is infinite`)
 		log.Fatal("connection_max_buffer and total_max_buffer must be set to a non-zero value")
 	}
 
+	if *maxRingPackets <= 0 && *maxRingBytes <= 0 && *maxRingAge <= 0 && *ringMemoryBudget <= 0 {
+		log.Fatal("at least one of max_ring_packets, max_ring_bytes, max_ring_age and ring_memory_budget must bound the stream ring buffers")
+	}
+
+	var decapVXLANPorts []uint16
+	if *vxlanPorts != "" {
+		for _, field := range strings.Split(*vxlanPorts, ",") {
+			port, err := strconv.ParseUint(strings.TrimSpace(field), 10, 16)
+			if err != nil {
+				log.Fatal("invalid VXLAN port: ", field)
+			}
+			decapVXLANPorts = append(decapVXLANPorts, uint16(port))
+		}
+	}
+
+	var sensorSecret string
+	if *sensorSecretFile != "" {
+		sensorSecret, err = HoneyBadger.ReadSensorSecret(*sensorSecretFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var policy *HoneyBadger.FlowPolicy
+	if *policyFile != "" {
+		policy, err = HoneyBadger.LoadFlowPolicy(*policyFile)
+		if err != nil {
+			log.Fatal("invalid flow policy: ", err)
+		}
+	}
+
 	var logger types.Logger
 
 	if *metadataAttackLog {
@@ -100,30 +159,69 @@ continuing to stream connection data.  If zero or less, this is infinite`)
 		MaxPcapLogSize:           *maxPcapLogSize,
 		TcpIdleTimeout:           *tcpTimeout,
 		MaxRingPackets:           *maxRingPackets,
+		MaxRingBytes:             *maxRingBytes,
+		MaxRingAge:               *maxRingAge,
 		Logger:                   logger,
 		DetectHijack:             *detectHijack,
 		DetectInjection:          *detectInjection,
 		DetectCoalesceInjection:  *detectCoalesceInjection,
+		DetectHeaderAnomalies:    *detectHeaderAnomalies,
+		TTLTolerance:             *ttlTolerance,
+		IPIDTolerance:            *ipIDTolerance,
 		MaxConcurrentConnections: *maxConcurrentConnections,
+		Shards:                   *dispatcherShards,
+		Policy:                   policy,
+		PolicyFile:               *policyFile,
+		RingMemoryBudget:         *ringMemoryBudget * 1024 * 1024,
+	}
+	if *pcapfile != "" || flag.NArg() > 0 {
+		// replay the capture on its own time rather than ours
+		dispatcherOptions.Clock = types.NewPacketClock()
 	}
 
 	snifferOptions := HoneyBadger.SnifferOptions{
 		Interface:    *iface,
 		Filename:     *pcapfile,
+		Filenames:    flag.Args(),
 		WireDuration: wireDuration,
 		Snaplen:      int32(*snaplen),
 		Filter:       *filter,
 		UseAfPacket:  *useAfPacket,
 		UseBpf:       *useBpf,
+		TrackVLAN:    *trackVLAN,
+
+		FragmentTimeout:  *fragmentTimeout,
+		MaxFragmentBytes: *maxFragmentBytes,
+		DecapGRE:         *decapGRE,
+		DecapIPIP:        *decapIPIP,
+		VXLANPorts:       decapVXLANPorts,
+		ReplaySpeed:      *replaySpeed,
+		ReplayLoops:      *replayLoops,
+		AfpacketWorkers:  *afpacketWorkers,
+
+		AfpacketFrameSize: *afpacketFrameSize,
+		AfpacketBlockSize: *afpacketBlockSize,
+		AfpacketNumBlocks: *afpacketNumBlocks,
+		StatsInterval:     *statsInterval,
+		SkipChecksums:     *skipChecksums,
+		SensorNetwork:     *sensorNetwork,
+		SensorAddress:     *sensorListen,
+		SensorSecret:      sensorSecret,
 	}
 
 	connectionFactory := &HoneyBadger.DefaultConnFactory{}
 	var packetLoggerFactory types.PacketLoggerFactory
 	if *logPackets {
-		packetLoggerFactory = logging.NewPcapLoggerFactory(*logDir, *archiveDir, *maxNumPcapRotations, *maxPcapLogSize)
+		pcapLoggerFactory := logging.NewPcapLoggerFactory(*logDir, *archiveDir, *maxNumPcapRotations, *maxPcapLogSize)
+		pcapLoggerFactory.Pcapng = *pcapngLogs
+		packetLoggerFactory = pcapLoggerFactory
 	} else {
 		packetLoggerFactory = nil
 	}
-	supervisor := HoneyBadger.NewBadgerSupervisor(snifferOptions, dispatcherOptions, HoneyBadger.NewSniffer, connectionFactory, packetLoggerFactory)
+	snifferFactory := HoneyBadger.NewSniffer
+	if *sensorListen != "" {
+		snifferFactory = HoneyBadger.NewSensorListener
+	}
+	supervisor := HoneyBadger.NewBadgerSupervisor(snifferOptions, dispatcherOptions, snifferFactory, connectionFactory, packetLoggerFactory)
 	supervisor.Run()
 }
@@ -0,0 +1,132 @@
+/*
+ *    HoneyBadger remote sensor forwarding packets to a HoneyBadger instance
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+
+	"github.com/david415/HoneyBadger"
+	"github.com/david415/HoneyBadger/afpacket_sniffer"
+	"github.com/david415/HoneyBadger/pcap_sniffer"
+)
+
+// captureHandle is implemented by the pcap and AF_PACKET handles
+type captureHandle interface {
+	ReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+	LinkType() layers.LinkType
+}
+
+func main() {
+	hostname, _ := os.Hostname()
+	var (
+		connect        = flag.String("connect", "", "address or Unix socket path of the HoneyBadger instance to forward packets to")
+		network        = flag.String("network", "tcp", "socket type of connect, tcp or unix")
+		sensor         = flag.String("sensor", hostname, "sensor ID identifying the packets of this sensor")
+		iface          = flag.String("i", "eth0", "Interface to get packets from")
+		snaplen        = flag.Int("s", 65536, "SnapLen for packet capture")
+		filter         = flag.String("f", "tcp", "BPF filter")
+		wireTimeout    = flag.Duration("w", 3*time.Second, "timeout for reading packets off the wire; buffered packets are forwarded at least this often")
+		useAfPacket    = flag.Bool("afpacket", false, "Use AF_PACKET for faster, harder sniffing of packets.")
+		reconnectDelay = flag.Duration("reconnect_delay", 5*time.Second, "how long to wait before reconnecting after the connection failed")
+		secretFile     = flag.String("secret_file", "", "file holding the secret shared with the HoneyBadger instance")
+	)
+	flag.Parse()
+
+	if *connect == "" {
+		log.Fatal("must specify the HoneyBadger instance to connect to")
+	}
+	if err := HoneyBadger.ValidSensorID(*sensor); err != nil {
+		log.Fatal(err)
+	}
+	var secret string
+	if *secretFile != "" {
+		var err error
+		if secret, err = HoneyBadger.ReadSensorSecret(*secretFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var handle captureHandle
+	var err error
+	if *useAfPacket {
+		handle, err = afpacket_sniffer.NewAfpacketHandle(*iface, afpacket_sniffer.AfpacketOptions{
+			PollTimeout: *wireTimeout,
+			Filter:      *filter,
+			Snaplen:     *snaplen,
+		})
+	} else {
+		handle, err = pcap_sniffer.NewPcapWireSniffer(*iface, int32(*snaplen), *wireTimeout, *filter)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for {
+		err = forward(handle, *network, *connect, *sensor, secret, *snaplen)
+		log.Printf("forwarding to %s: %s", *connect, err)
+		time.Sleep(*reconnectDelay)
+	}
+}
+
+// forward connects to the HoneyBadger instance and sends it the
+// captured packets until the connection fails. Packets are buffered
+// and sent whenever the buffer fills up or reading the capture times out.
+func forward(handle captureHandle, network, address, sensor, secret string, snaplen int) error {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	log.Printf("connected to %s; forwarding packets as sensor %s", address, sensor)
+
+	buffered := bufio.NewWriterSize(conn, 65536)
+	if err = HoneyBadger.WriteSensorGreeting(buffered, sensor, secret); err != nil {
+		return err
+	}
+	writer := pcapgo.NewWriter(buffered)
+	if err = writer.WriteFileHeader(uint32(snaplen), handle.LinkType()); err != nil {
+		return err
+	}
+	if err = buffered.Flush(); err != nil {
+		return err
+	}
+	for {
+		data, ci, err := handle.ReadPacketData()
+		if err != nil {
+			// most likely the read timed out
+			if err = buffered.Flush(); err != nil {
+				return err
+			}
+			continue
+		}
+		if err = writer.WritePacket(ci, data); err != nil {
+			return err
+		}
+	}
+}
@@ -30,6 +30,7 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"github.com/david415/HoneyBadger/logging"
+	"github.com/david415/HoneyBadger/types"
 	"github.com/fatih/color"
 )
 
@@ -57,6 +58,15 @@ func colorLineDiff(a, b string) {
 
 }
 
+// formatEvidence returns a one line description of the headers of a segment
+func formatEvidence(e *types.HeaderEvidence) string {
+	s := fmt.Sprintf("seq %d seen %s TTL %d IP ID %d DSCP %d window %d options [%s]", e.Seq, e.Seen, e.TTL, e.IPID, e.DSCP, e.Window, e.TCPOptions)
+	if e.SrcMAC != "" {
+		s += " MAC " + e.SrcMAC
+	}
+	return s
+}
+
 func expandReport(reportPath string) {
 	fmt.Printf("attack report: %s\n", reportPath)
 	file, err := os.Open(reportPath)
@@ -75,8 +85,25 @@ func expandReport(reportPath string) {
 			panic(err)
 		}
 
-		fmt.Printf("Event Type: %s\nFlow: %s\nTime: %s\n", event.Type, event.Flow, event.Time)
+		kind := event.Kind()
+		fmt.Printf("Event Type: %s\nCategory: %s/%s Severity: %s\nFlow: %s\nTime: %s\n", event.Type, kind.Category(), kind.Subtype(), kind.Severity(), event.Flow, event.Time)
+		if event.SrcIP != "" {
+			fmt.Printf("Source: %s port %d\nDestination: %s port %d\n", event.SrcIP, event.SrcPort, event.DstIP, event.DstPort)
+		} else if flow, err := event.TcpIpFlow(); err == nil {
+			// reports written before the endpoints were recorded separately
+			srcIP, srcPort, dstIP, dstPort := flow.Endpoints()
+			fmt.Printf("Source: %s port %d\nDestination: %s port %d\n", srcIP, srcPort, dstIP, dstPort)
+		}
 		fmt.Printf("Packet Number: %d\n", event.PacketCount)
+		if event.Tunnel != nil {
+			fmt.Printf("Tunnel: %s\n", event.Tunnel)
+		}
+		if event.Evidence != nil {
+			fmt.Printf("Evidence: %s\n", formatEvidence(event.Evidence))
+		}
+		for _, evidence := range event.OverlapEvidence {
+			fmt.Printf("Overlap Evidence: %s\n", formatEvidence(evidence))
+		}
 		fmt.Printf("HijackSeq: %d HijackAck: %d\nStart: %d End: %d\nOverlapStart: %d OverlapEnd: %d\n\n", event.HijackSeq, event.HijackAck, event.Start, event.End, event.OverlapStart, event.OverlapEnd)
 
 		var payload []byte
@@ -25,6 +25,7 @@ import (
 	"time"
 
 	"github.com/david415/HoneyBadger/types"
+	"github.com/google/gopacket/layers"
 )
 
 const (
@@ -69,14 +70,17 @@ func (f *DefaultConnFactory) Build(options ConnectionOptions) ConnectionInterfac
 		skipHijackDetectionCount: FIRST_FEW_PACKETS,
 		clientNextSeq:            types.InvalidSequence,
 		serverNextSeq:            types.InvalidSequence,
-		ClientStreamRing:         types.NewRing(options.MaxRingPackets),
-		ServerStreamRing:         types.NewRing(options.MaxRingPackets),
+		ClientStreamRing:         types.NewBoundedRing(options.ringLimits()),
+		ServerStreamRing:         types.NewBoundedRing(options.ringLimits()),
 		clientFlow:               &types.TcpIpFlow{},
 		serverFlow:               &types.TcpIpFlow{},
 	}
+	if conn.Clock == nil {
+		conn.Clock = types.WallClock{}
+	}
 
-	conn.ClientCoalesce = NewOrderedCoalesce(conn.AttackLogger, conn.clientFlow, conn.PageCache, conn.ClientStreamRing, conn.MaxBufferedPagesTotal, conn.MaxBufferedPagesPerConnection/2, conn.DetectCoalesceInjection)
-	conn.ServerCoalesce = NewOrderedCoalesce(conn.AttackLogger, conn.serverFlow, conn.PageCache, conn.ServerStreamRing, conn.MaxBufferedPagesTotal, conn.MaxBufferedPagesPerConnection/2, conn.DetectCoalesceInjection)
+	conn.ClientCoalesce = NewOrderedCoalesce(&conn, conn.clientFlow, conn.PageCache, &conn.ClientStreamRing, conn.MaxBufferedPagesTotal, conn.MaxBufferedPagesPerConnection/2, conn.DetectCoalesceInjection)
+	conn.ServerCoalesce = NewOrderedCoalesce(&conn, conn.serverFlow, conn.PageCache, &conn.ServerStreamRing, conn.MaxBufferedPagesTotal, conn.MaxBufferedPagesPerConnection/2, conn.DetectCoalesceInjection)
 
 	return &conn
 }
@@ -84,7 +88,7 @@ func (f *DefaultConnFactory) Build(options ConnectionOptions) ConnectionInterfac
 type ConnectionInterface interface {
 	Close()
 	SetPacketLogger(types.PacketLogger)
-	GetConnectionHash() types.ConnectionHash
+	GetConnectionKey() types.ConnectionKey
 	GetLastSeen() time.Time
 	ReceivePacket(*types.PacketManifest)
 }
@@ -102,11 +106,36 @@ type ConnectionOptions struct {
 	PageCache                     *pageCache
 	LogDir                        string
 	LogPackets                    bool
-	AttackLogger                  types.Logger
-	DetectHijack                  bool
-	DetectInjection               bool
-	DetectCoalesceInjection       bool
-	Pool                          *map[types.ConnectionHash]ConnectionInterface
+	// OmitPayloads leaves the payload bytes out of attack events
+	OmitPayloads            bool
+	AttackLogger            types.Logger
+	DetectHijack            bool
+	DetectInjection         bool
+	DetectCoalesceInjection bool
+	// DetectHeaderAnomalies reports packets whose TTL or IP ID
+	// deviates from the rest of their flow by more than TTLTolerance
+	// or IPIDTolerance
+	DetectHeaderAnomalies bool
+	TTLTolerance          int
+	IPIDTolerance         int
+	Pool                  *connectionPool
+	Clock                 types.Clock
+	// MaxRingBytes and MaxRingAge further bound the stream segments
+	// kept per direction for retrospective analysis, as does the
+	// RingBudget shared with other connections. A stream ring without
+	// any bound grows with its stream.
+	MaxRingBytes int
+	MaxRingAge   time.Duration
+	RingBudget   *types.RingBudget
+}
+
+func (o *ConnectionOptions) ringLimits() types.RingLimits {
+	return types.RingLimits{
+		MaxPackets: o.MaxRingPackets,
+		MaxBytes:   o.MaxRingBytes,
+		MaxAge:     o.MaxRingAge,
+		Budget:     o.RingBudget,
+	}
 }
 
 // Connection is used to track client and server flows for a given TCP connection.
@@ -137,6 +166,127 @@ type Connection struct {
 	ClientCoalesce           *OrderedCoalesce
 	ServerCoalesce           *OrderedCoalesce
 	PacketLogger             types.PacketLogger
+	linkType                 layers.LinkType // of the packet log, that of the first packet
+	tunnel                   *types.Tunnel
+	pendingPacket            *types.PacketManifest
+	packetTime               time.Time // of the packet being received
+	pendingAnnotations       []string
+	pendingEntry             *packetLogEntry
+	clientFingerprint        headerFingerprint
+	serverFingerprint        headerFingerprint
+}
+
+// packetLogEntry is a packet whose segment an OrderedCoalesce buffered.
+// It is written to the packet log once all of its pages are freed,
+// annotated with the events implicating it.
+type packetLogEntry struct {
+	packet      *types.PacketManifest
+	annotations []string
+	pages       int
+}
+
+// Log records the tunnel the connection was last seen in on the event,
+// stamps it with the time of the packet being received, or that of the
+// connection's clock if no packet is being received, and submits it to
+// the AttackLogger, annotating the packet being received with it.
+// OmitPayloads drops the event's payloads.
+func (c *Connection) Log(event *types.Event) {
+	c.prepareEvent(event)
+	if c.pendingEntry != nil {
+		c.pendingEntry.annotations = append(c.pendingEntry.annotations, "HoneyBadger "+event.String())
+	} else if c.pendingPacket != nil {
+		c.pendingAnnotations = append(c.pendingAnnotations, "HoneyBadger "+event.String())
+	}
+	c.AttackLogger.Log(event)
+}
+
+// logBufferedEvent is Log for the events of an OrderedCoalesce, which
+// implicate the buffered packet of the given entry rather than the
+// packet being received
+func (c *Connection) logBufferedEvent(event *types.Event, entry *packetLogEntry) {
+	c.prepareEvent(event)
+	if entry != nil {
+		entry.annotations = append(entry.annotations, "HoneyBadger "+event.String())
+	}
+	c.AttackLogger.Log(event)
+}
+
+func (c *Connection) prepareEvent(event *types.Event) {
+	event.ResolveKind()
+	if event.Time.IsZero() {
+		if !c.packetTime.IsZero() {
+			event.Time = c.packetTime
+		} else {
+			event.Time = c.Clock.Now()
+		}
+	}
+	if event.Tunnel == nil {
+		event.Tunnel = c.tunnel
+	}
+	if c.OmitPayloads {
+		event.Payload, event.Overlap = nil, nil
+	}
+}
+
+// takePacketLogEntry defers writing the packet being received to the
+// packet log since an OrderedCoalesce buffers its segment. It returns
+// nil if packets are not logged.
+func (c *Connection) takePacketLogEntry(p *types.PacketManifest) *packetLogEntry {
+	if c.PacketLogger == nil || c.pendingPacket != p {
+		return nil
+	}
+	c.pendingEntry = &packetLogEntry{
+		packet:      p,
+		annotations: c.pendingAnnotations,
+	}
+	c.pendingAnnotations = nil
+	return c.pendingEntry
+}
+
+// writePacketLogEntry writes a packet whose pages an OrderedCoalesce
+// freed, unless it is still being received
+func (c *Connection) writePacketLogEntry(entry *packetLogEntry) {
+	if entry != c.pendingEntry {
+		c.writePacket(entry.packet, entry.annotations)
+	}
+}
+
+// logPendingPacket writes the packet being received to the packet log,
+// annotated with the events it was implicated in, unless its segment is
+// still buffered. It is called once the packet went through the state
+// machine or when the packet closes the connection, whichever happens
+// first.
+func (c *Connection) logPendingPacket() {
+	p, annotations, entry := c.pendingPacket, c.pendingAnnotations, c.pendingEntry
+	c.pendingPacket, c.pendingAnnotations, c.pendingEntry = nil, nil, nil
+	if entry != nil {
+		if entry.pages > 0 {
+			return
+		}
+		annotations = entry.annotations
+	}
+	if p != nil {
+		c.writePacket(p, annotations)
+	}
+}
+
+// writePacket writes a packet to the packet log, which is framed
+// according to the link type of the connection's first packet. Packets
+// of another link type, e.g. seen on another interface of a merged
+// capture, would be misread thus are not logged.
+func (c *Connection) writePacket(p *types.PacketManifest, annotations []string) {
+	if c.PacketLogger == nil {
+		return
+	}
+	if p.LinkType != c.linkType {
+		log.Printf("not logging a packet of %s: link type %s differs from the packet log's %s\n", p.Flow, p.LinkType, c.linkType)
+		return
+	}
+	if logger, ok := c.PacketLogger.(types.AnnotatingPacketLogger); ok && len(annotations) > 0 {
+		logger.WriteAnnotatedPacket(p.RawPacket, p.Timestamp, annotations)
+	} else {
+		c.PacketLogger.WritePacket(p.RawPacket, p.Timestamp)
+	}
 }
 
 func (c *Connection) SetPacketLogger(logger types.PacketLogger) {
@@ -159,15 +309,19 @@ func (c *Connection) updateLastSeen(timestamp time.Time) {
 	}
 }
 
-func (c *Connection) GetConnectionHash() types.ConnectionHash {
-	return c.clientFlow.ConnectionHash()
+func (c *Connection) GetConnectionKey() types.ConnectionKey {
+	return c.clientFlow.ConnectionKey()
 }
 
 // Close can be used by the the connection or the dispatcher to close the connection
 func (c *Connection) Close() {
 	log.Print("Close()")
+	c.logPendingPacket()
+	// the coalesces write the packets they buffered
+	c.ClientCoalesce.Close()
+	c.ServerCoalesce.Close()
 	if c.Pool != nil {
-		delete(*c.Pool, c.GetConnectionHash())
+		c.Pool.remove(c.GetConnectionKey())
 	}
 	if c.attackDetected == false {
 		if c.PacketLogger != nil {
@@ -179,8 +333,8 @@ func (c *Connection) Close() {
 			c.PacketLogger.Archive()
 		}
 	}
-	c.ClientCoalesce.Close()
-	c.ServerCoalesce.Close()
+	c.ClientStreamRing.Release()
+	c.ServerStreamRing.Release()
 	if c.LogPackets {
 		c.PacketLogger.Stop()
 		c.PacketLogger = nil // just in case the state machine receives another packet...
@@ -198,13 +352,13 @@ func (c *Connection) detectHijack(p *types.PacketManifest, flow *types.TcpIpFlow
 		if types.Sequence(p.TCP.Ack).Difference(c.hijackNextAck) == 0 {
 			if p.TCP.Seq != c.firstSynAckSeq {
 				log.Print("handshake hijack detected\n")
-				c.AttackLogger.Log(&types.Event{
-					Time:        time.Now(),
-					Type:        "handshake-hijack",
+				c.Log(&types.Event{
+					Kind:        types.EventHandshakeHijack,
 					PacketCount: c.packetCount,
 					Flow:        flow,
 					HijackSeq:   p.TCP.Seq,
-					HijackAck:   p.TCP.Ack})
+					HijackAck:   p.TCP.Ack,
+					Evidence:    types.NewHeaderEvidence(p)})
 				c.attackDetected = true
 			} else {
 				log.Print("SYN/ACK retransmission\n")
@@ -213,6 +367,26 @@ func (c *Connection) detectHijack(p *types.PacketManifest, flow *types.TcpIpFlow
 	}
 }
 
+// detectFragmentOverlap submits a report for a packet which was reassembled
+// from IP fragments that overlapped with conflicting contents; hosts which
+// resolve such overlaps differently would see different segments.
+func (c *Connection) detectFragmentOverlap(p *types.PacketManifest) {
+	log.Printf("conflicting IP fragment overlap at packet # %d\n", c.packetCount)
+	start, end := tcpPayloadOverlap(p.FragmentOverlap, int(p.TCP.DataOffset)*4)
+	c.Log(&types.Event{
+		Kind:          types.EventIPFragmentOverlap,
+		PacketCount:   c.packetCount,
+		Flow:          p.Flow,
+		Payload:       p.FragmentOverlap.Conflict,
+		Overlap:       p.FragmentOverlap.Original,
+		StartSequence: types.Sequence(p.TCP.Seq),
+		OverlapStart:  start,
+		OverlapEnd:    end,
+		Evidence:      types.NewHeaderEvidence(p),
+	})
+	c.attackDetected = true
+}
+
 // detectInjection write an attack report if the given packet indicates a TCP injection attack
 // such as segment veto.
 func (c *Connection) detectInjection(p *types.PacketManifest, flow *types.TcpIpFlow) {
@@ -222,9 +396,9 @@ func (c *Connection) detectInjection(p *types.PacketManifest, flow *types.TcpIpF
 	} else {
 		ringPtr = c.ClientStreamRing
 	}
-	event := injectionInStreamRing(p, flow, ringPtr, "ordered injection", c.packetCount)
+	event := injectionInStreamRing(p, flow, ringPtr, types.EventOrderedInjection, c.packetCount)
 	if event != nil {
-		c.AttackLogger.Log(event)
+		c.Log(event)
 		c.attackDetected = true
 		log.Printf("packet # %d\n", c.packetCount)
 	} else {
@@ -232,6 +406,67 @@ func (c *Connection) detectInjection(p *types.PacketManifest, flow *types.TcpIpF
 	}
 }
 
+// detectBadChecksumInjection writes an attack report if the given packet
+// with a bad checksum conflicts with stream data received before. Its
+// receiver discards such a packet, therefore it is reported as a less
+// severe bad-checksum injection rather than an ordered injection.
+func (c *Connection) detectBadChecksumInjection(p *types.PacketManifest) {
+	if len(p.Payload) == 0 || c.clientFlow == nil {
+		return
+	}
+	var nextSeq types.Sequence
+	var ringPtr *types.Ring
+	if p.Flow.Equal(c.clientFlow) {
+		nextSeq, ringPtr = c.clientNextSeq, c.ServerStreamRing
+	} else if p.Flow.Equal(c.serverFlow) {
+		nextSeq, ringPtr = c.serverNextSeq, c.ClientStreamRing
+	} else {
+		return
+	}
+	if nextSeq.Difference(types.Sequence(p.TCP.Seq)) >= 0 {
+		log.Print("ignoring packet with a bad checksum")
+		return
+	}
+	event := injectionInStreamRing(p, p.Flow, ringPtr, types.EventBadChecksumInjection, c.packetCount)
+	if event != nil {
+		c.Log(event)
+		c.attackDetected = true
+	}
+}
+
+// detectHeaderAnomalies submits a report if the TTL or IP ID of the
+// given packet deviates from the ones learned for its flow.
+func (c *Connection) detectHeaderAnomalies(p *types.PacketManifest) {
+	// the first packet of a connection is from its client
+	fingerprint := &c.clientFingerprint
+	if c.state != TCP_UNKNOWN && !p.Flow.Equal(c.clientFlow) {
+		fingerprint = &c.serverFingerprint
+	}
+	last := fingerprint.last
+	ttlAnomaly, ipIDAnomaly := fingerprint.observe(p, c.TTLTolerance, c.IPIDTolerance)
+	if ttlAnomaly {
+		c.logHeaderAnomaly(types.EventTTLAnomaly, p, last)
+	}
+	if ipIDAnomaly {
+		c.logHeaderAnomaly(types.EventIPIDAnomaly, p, last)
+	}
+}
+
+// logHeaderAnomaly submits a report of the given header anomaly of the
+// packet, which deviated from the last regular packet of its flow
+func (c *Connection) logHeaderAnomaly(kind types.EventKind, p *types.PacketManifest, last *types.HeaderEvidence) {
+	log.Printf("%s at packet # %d\n", kind, c.packetCount)
+	c.Log(&types.Event{
+		Kind:            kind,
+		PacketCount:     c.packetCount,
+		Flow:            p.Flow,
+		StartSequence:   types.Sequence(p.TCP.Seq),
+		Evidence:        types.NewHeaderEvidence(p),
+		OverlapEvidence: []*types.HeaderEvidence{last},
+	})
+	c.attackDetected = true
+}
+
 // stateUnknown gets called by our TCP finite state machine runtime
 // and moves us into the TCP_CONNECTION_REQUEST state if we receive
 // a SYN packet... otherwise TCP_DATA_TRANSFER state.
@@ -245,7 +480,7 @@ func (c *Connection) stateUnknown(p *types.PacketManifest) {
 		// a TCP extension is used...
 		// If so then the sequence number needs to track this payload.
 		// For more information see: https://tools.ietf.org/id/draft-agl-tcpm-sadata-00.html
-		c.clientNextSeq = types.Sequence(p.TCP.Seq).Add(len(p.Payload) + 1)
+		c.clientNextSeq = types.Sequence(p.TCP.Seq).Add(p.SegmentLength() + 1)
 		c.hijackNextAck = c.clientNextSeq
 
 	} else {
@@ -256,7 +491,7 @@ func (c *Connection) stateUnknown(p *types.PacketManifest) {
 
 		// skip handshake hijack detection completely
 		c.skipHijackDetectionCount = 0
-		c.clientNextSeq = types.Sequence(p.TCP.Seq).Add(len(p.Payload) + 1)
+		c.clientNextSeq = types.Sequence(p.TCP.Seq).Add(p.SegmentLength() + 1)
 
 		if p.TCP.FIN || p.TCP.RST {
 			c.state = TCP_CLOSED
@@ -295,7 +530,7 @@ func (c *Connection) stateConnectionRequest(p *types.PacketManifest) {
 		return
 	}
 	c.state = TCP_CONNECTION_ESTABLISHED
-	c.serverNextSeq = types.Sequence(p.TCP.Seq).Add(len(p.Payload) + 1) // XXX see above comment about TCP extentions
+	c.serverNextSeq = types.Sequence(p.TCP.Seq).Add(p.SegmentLength() + 1) // XXX see above comment about TCP extentions
 	c.firstSynAckSeq = p.TCP.Seq
 }
 
@@ -384,25 +619,25 @@ func (c *Connection) stateDataTransfer(p *types.PacketManifest) {
 			// possibly RST or FIN
 		}
 	} else if diff == 0 { // contiguous
-		if len(p.Payload) > 0 {
+		if p.SegmentLength() > 0 {
 			reassembly := types.Reassembly{
-				Seq:   types.Sequence(p.TCP.Seq),
-				Bytes: []byte(p.Payload),
-				Seen:  p.Timestamp,
+				Seq:            types.Sequence(p.TCP.Seq),
+				Bytes:          []byte(p.Payload),
+				TruncatedBytes: p.TruncatedBytes,
+				Seen:           p.Timestamp,
+				Evidence:       types.NewHeaderEvidence(p),
 			}
 			if p.Flow.Equal(c.clientFlow) {
-				c.ServerStreamRing.Reassembly = &reassembly
-				c.ServerStreamRing = c.ServerStreamRing.Next()
-				c.clientNextSeq = types.Sequence(p.TCP.Seq).Add(len(p.Payload))
+				c.ServerStreamRing = c.ServerStreamRing.Add(&reassembly)
+				c.clientNextSeq = types.Sequence(p.TCP.Seq).Add(p.SegmentLength())
 				c.clientNextSeq, isEnd = c.ServerCoalesce.addContiguous(c.clientNextSeq)
 				if isEnd {
 					c.state = TCP_CLOSED
 					return
 				}
 			} else {
-				c.ClientStreamRing.Reassembly = &reassembly
-				c.ClientStreamRing = c.ClientStreamRing.Next()
-				c.serverNextSeq = types.Sequence(p.TCP.Seq).Add(len(p.Payload))
+				c.ClientStreamRing = c.ClientStreamRing.Add(&reassembly)
+				c.serverNextSeq = types.Sequence(p.TCP.Seq).Add(p.SegmentLength())
 				c.serverNextSeq, isEnd = c.ClientCoalesce.addContiguous(c.serverNextSeq)
 				if isEnd {
 					c.state = TCP_CLOSED
@@ -460,7 +695,7 @@ func (c *Connection) stateFinWait1(p *types.PacketManifest, flow *types.TcpIpFlo
 		if p.TCP.FIN {
 			*statePtr = TCP_CLOSING
 			*otherStatePtr = TCP_LAST_ACK
-			*nextSeqPtr = types.Sequence(p.TCP.Seq).Add(len(p.Payload) + 1)
+			*nextSeqPtr = types.Sequence(p.TCP.Seq).Add(p.SegmentLength() + 1)
 			if types.Sequence(p.TCP.Ack).Difference(*nextAckPtr) != 0 {
 				log.Printf("FIN-WAIT-1: unexpected ACK: got %d expected %d TCP.Seq %d\n", p.TCP.Ack, *nextAckPtr, p.TCP.Seq)
 				c.closingFlow = p.Flow
@@ -469,7 +704,7 @@ func (c *Connection) stateFinWait1(p *types.PacketManifest, flow *types.TcpIpFlo
 			}
 		} else {
 			*statePtr = TCP_FIN_WAIT2
-			*nextSeqPtr = types.Sequence(p.TCP.Seq).Add(len(p.Payload))
+			*nextSeqPtr = types.Sequence(p.TCP.Seq).Add(p.SegmentLength())
 		}
 	} else {
 		log.Print("FIN-WAIT-1: non-ACK packet received.\n")
@@ -562,7 +797,7 @@ func (c *Connection) stateLastAck(p *types.PacketManifest, flow *types.TcpIpFlow
 }
 
 func (c *Connection) detectCensorInjection(p *types.PacketManifest) {
-	var attackType string
+	var kind types.EventKind
 	if p.TCP.FIN || p.TCP.RST {
 		// ignore "closing" retransmissions
 		return
@@ -571,29 +806,24 @@ func (c *Connection) detectCensorInjection(p *types.PacketManifest) {
 		return
 	}
 	if c.closingRST {
-		attackType = "censor-injection-RST_"
+		kind = types.EventCensorInjectionRST
 	} else if c.closingFIN {
-		attackType = "censor-injection-FIN_"
+		kind = types.EventCensorInjectionFIN
 	} else {
-		attackType = "censor-injection-coalesce_"
+		kind = types.EventCensorInjectionCoalesce
 	}
-	if c.closingFlow != nil {
-		if p.Flow.Equal(c.closingFlow) && types.Sequence(p.TCP.Seq).Difference(c.closingSeq) == 0 {
-			attackType += "closing-sequence-overlap"
-		} else {
-			return
-		}
-	} else {
+	// only data at the closing sequence of the closing flow is reported
+	if c.closingFlow == nil || !p.Flow.Equal(c.closingFlow) || types.Sequence(p.TCP.Seq).Difference(c.closingSeq) != 0 {
 		return
 	}
 	event := types.Event{
-		Type:          attackType,
+		Kind:          kind,
 		PacketCount:   c.packetCount,
-		Time:          time.Now(),
 		Flow:          p.Flow,
 		StartSequence: types.Sequence(p.TCP.Seq),
+		Evidence:      types.NewHeaderEvidence(p),
 	}
-	c.AttackLogger.Log(&event)
+	c.Log(&event)
 	c.attackDetected = true
 }
 
@@ -652,10 +882,30 @@ func (c *Connection) stateConnectionClosing(p *types.PacketManifest) {
 // The goal is to detect all manner of content injection.
 func (c *Connection) ReceivePacket(p *types.PacketManifest) {
 	c.updateLastSeen(p.Timestamp)
-	if c.PacketLogger != nil {
-		c.PacketLogger.WritePacket(p.RawPacket, p.Timestamp)
-	}
+	c.pendingPacket = p
+	c.packetTime = p.Timestamp
 	c.packetCount += 1
+	if c.packetCount == 1 {
+		c.linkType = p.LinkType
+	}
+	if p.Tunnel != nil {
+		c.tunnel = p.Tunnel
+	}
+	if p.FragmentOverlap != nil && c.DetectInjection {
+		c.detectFragmentOverlap(p)
+	}
+	if p.BadChecksum {
+		// the receiver discards the packet, thus it does not advance the connection
+		if c.DetectInjection {
+			c.detectBadChecksumInjection(p)
+		}
+		c.logPendingPacket()
+		c.packetTime = time.Time{}
+		return
+	}
+	if c.DetectHeaderAnomalies {
+		c.detectHeaderAnomalies(p)
+	}
 	switch c.state {
 	case TCP_UNKNOWN:
 		c.stateUnknown(p)
@@ -670,4 +920,6 @@ func (c *Connection) ReceivePacket(p *types.PacketManifest) {
 	case TCP_CLOSED:
 		c.stateClosed(p)
 	}
+	c.logPendingPacket()
+	c.packetTime = time.Time{}
 }
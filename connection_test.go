@@ -555,3 +555,385 @@ func TestTCPHijack(t *testing.T) {
 	}
 
 }
+
+// annotatingPacketLogger records the comments of the packets it logs
+type annotatingPacketLogger struct {
+	comments [][]string
+}
+
+func (l *annotatingPacketLogger) WritePacket(rawPacket []byte, timestamp time.Time) {
+	l.comments = append(l.comments, nil)
+}
+
+func (l *annotatingPacketLogger) WriteAnnotatedPacket(rawPacket []byte, timestamp time.Time, comments []string) {
+	l.comments = append(l.comments, comments)
+}
+
+func (l *annotatingPacketLogger) Start()   {}
+func (l *annotatingPacketLogger) Stop()    {}
+func (l *annotatingPacketLogger) Remove()  {}
+func (l *annotatingPacketLogger) Archive() {}
+
+func TestFragmentOverlapDetection(t *testing.T) {
+	attackLogger := NewDummyAttackLogger()
+	options := ConnectionOptions{
+		MaxBufferedPagesTotal:         0,
+		MaxBufferedPagesPerConnection: 0,
+		MaxRingPackets:                40,
+		PageCache:                     nil,
+		LogDir:                        "fake-log-dir",
+		AttackLogger:                  attackLogger,
+		DetectInjection:               true,
+		Clock:                         types.NewPacketClock(),
+	}
+	// the clock is ahead of the packet, as when another shard is
+	captureTime := time.Unix(1500000000, 0)
+	options.Clock.(*types.PacketClock).Advance(captureTime.Add(time.Hour))
+	f := &DefaultConnFactory{}
+	conn := f.Build(options).(*Connection)
+	packetLogger := &annotatingPacketLogger{}
+	conn.SetPacketLogger(packetLogger)
+
+	ip := layers.IPv4{
+		SrcIP:    net.IP{1, 2, 3, 4},
+		DstIP:    net.IP{2, 3, 4, 5},
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolTCP,
+	}
+	tcp := layers.TCP{
+		Seq:     3,
+		SYN:     true,
+		SrcPort: 1,
+		DstPort: 2,
+	}
+	p := types.PacketManifest{
+		Timestamp: time.Now(),
+		Flow:      types.NewTcpIpFlowFromLayers(ip, tcp),
+		IP:        ip,
+		TCP:       tcp,
+		Payload:   []byte{},
+	}
+	conn.ReceivePacket(&p)
+	if attackLogger.Count != 0 {
+		t.Fatal("reported an attack for an unfragmented packet")
+	}
+
+	// the overlap offset counts the TCP header, unlike the annotation
+	tcp.SYN = false
+	tcp.Seq = 4
+	tcp.DataOffset = 5
+	p = types.PacketManifest{
+		Timestamp: captureTime,
+		Flow:      types.NewTcpIpFlowFromLayers(ip, tcp),
+		IP:        ip,
+		TCP:       tcp,
+		Payload:   []byte{1, 2, 3},
+		FragmentOverlap: &types.FragmentOverlap{
+			Offset:   22,
+			Original: []byte{1},
+			Conflict: []byte{9},
+		},
+	}
+	conn.ReceivePacket(&p)
+	if attackLogger.Count != 1 || !conn.attackDetected {
+		t.Errorf("conflicting fragment overlap not reported; %d events", attackLogger.Count)
+	}
+	if !attackLogger.LastEvent.Time.Equal(captureTime) {
+		t.Errorf("event time %s is not the capture time %s", attackLogger.LastEvent.Time, captureTime)
+	}
+	if len(packetLogger.comments) != 2 || packetLogger.comments[0] != nil {
+		t.Fatalf("packets not logged as expected: %v", packetLogger.comments)
+	}
+	want := "HoneyBadger ip-fragment-overlap: packet 2, sequence 4, overlap bytes 2-3"
+	if len(packetLogger.comments[1]) != 1 || packetLogger.comments[1][0] != want {
+		t.Errorf("packet annotation %q != %q", packetLogger.comments[1], want)
+	}
+}
+
+// testStream is a connection in the data transfer state whose server
+// flow, from port 1 of 1.2.3.4 to port 2 of 2.3.4.5, expects sequence 3
+// next
+type testStream struct {
+	conn         *Connection
+	attackLogger *DummyAttackLogger
+	ip           layers.IPv4
+	flow         *types.TcpIpFlow
+}
+
+// newTestStream builds the connection of a testStream with the given
+// options, reporting to an attack logger of its own
+func newTestStream(options ConnectionOptions) *testStream {
+	s := &testStream{
+		attackLogger: NewDummyAttackLogger(),
+		ip: layers.IPv4{
+			SrcIP:    net.IP{1, 2, 3, 4},
+			DstIP:    net.IP{2, 3, 4, 5},
+			Version:  4,
+			TTL:      64,
+			Protocol: layers.IPProtocolTCP,
+		},
+	}
+	options.LogDir = "fake-log-dir"
+	options.AttackLogger = s.attackLogger
+	f := &DefaultConnFactory{}
+	s.conn = f.Build(options).(*Connection)
+	s.conn.state = TCP_DATA_TRANSFER
+	s.flow = makeTestPortFlow(s.ip, 1, 2)
+	s.conn.serverFlow = s.flow
+	s.conn.clientFlow = s.flow.Reverse()
+	s.conn.clientNextSeq = 9666
+	s.conn.serverNextSeq = 3
+	return s
+}
+
+// segment returns a segment of the server flow
+func (s *testStream) segment(seq uint32, payload []byte) *types.PacketManifest {
+	return &types.PacketManifest{
+		Timestamp: time.Now(),
+		Flow:      s.flow,
+		IP:        s.ip,
+		TCP:       layers.TCP{Seq: seq, SrcPort: 1, DstPort: 2},
+		Payload:   payload,
+	}
+}
+
+func TestPacketLogLinkType(t *testing.T) {
+	options := ConnectionOptions{
+		MaxBufferedPagesTotal:         0,
+		MaxBufferedPagesPerConnection: 0,
+		MaxRingPackets:                40,
+		PageCache:                     nil,
+		LogDir:                        "fake-log-dir",
+		AttackLogger:                  NewDummyAttackLogger(),
+		Clock:                         types.NewPacketClock(),
+	}
+	f := &DefaultConnFactory{}
+	conn := f.Build(options).(*Connection)
+	packetLogger := &annotatingPacketLogger{}
+	conn.SetPacketLogger(packetLogger)
+
+	ip := layers.IPv4{
+		SrcIP:    net.IP{1, 2, 3, 4},
+		DstIP:    net.IP{2, 3, 4, 5},
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolTCP,
+	}
+	tcp := layers.TCP{
+		Seq:     3,
+		SYN:     true,
+		SrcPort: 1,
+		DstPort: 2,
+	}
+	p := types.PacketManifest{
+		Timestamp: time.Now(),
+		Flow:      types.NewTcpIpFlowFromLayers(ip, tcp),
+		LinkType:  layers.LinkTypeEthernet,
+		IP:        ip,
+		TCP:       tcp,
+		Payload:   []byte{},
+	}
+	conn.ReceivePacket(&p)
+
+	// a retransmission seen on an interface of another link type
+	p.Timestamp = time.Now()
+	p.LinkType = layers.LinkTypeRaw
+	conn.ReceivePacket(&p)
+
+	p.Timestamp = time.Now()
+	p.LinkType = layers.LinkTypeEthernet
+	conn.ReceivePacket(&p)
+	if len(packetLogger.comments) != 2 {
+		t.Errorf("logged %d packets, not the 2 of the packet log's link type", len(packetLogger.comments))
+	}
+}
+
+func TestCoalesceInjectionAnnotation(t *testing.T) {
+	s := newTestStream(ConnectionOptions{
+		MaxRingPackets:          40,
+		PageCache:               newPageCache(),
+		DetectCoalesceInjection: true,
+	})
+	conn, attackLogger := s.conn, s.attackLogger
+	packetLogger := &annotatingPacketLogger{}
+	conn.SetPacketLogger(packetLogger)
+
+	conn.ReceivePacket(s.segment(3, []byte{1, 2, 3, 4, 5}))
+	// buffered until the gap before it is filled
+	conn.ReceivePacket(s.segment(10, []byte{99, 99, 13, 14, 15}))
+	if len(packetLogger.comments) != 1 {
+		t.Fatalf("%d packets logged rather than 1", len(packetLogger.comments))
+	}
+	conn.ReceivePacket(s.segment(8, []byte{9, 10, 11, 12}))
+	if attackLogger.Count != 1 || attackLogger.LastEvent.Kind != types.EventCoalesceInjection {
+		t.Fatalf("coalesce injection not reported; %d events", attackLogger.Count)
+	}
+	if !attackLogger.LastEvent.Flow.Equal(s.flow) {
+		t.Errorf("coalesce injection reported for flow %s", attackLogger.LastEvent.Flow)
+	}
+	comments := packetLogger.comments
+	if len(comments) != 3 || comments[0] != nil || comments[2] != nil {
+		t.Fatalf("packets not logged as expected: %v", comments)
+	}
+	if len(comments[1]) != 1 || comments[1][0] != "HoneyBadger "+attackLogger.LastEvent.String() {
+		t.Errorf("the injected segment is annotated with %q", comments[1])
+	}
+}
+
+func TestTruncatedSegments(t *testing.T) {
+	s := newTestStream(ConnectionOptions{
+		MaxRingPackets:  40,
+		DetectInjection: true,
+	})
+	conn, attackLogger := s.conn, s.attackLogger
+
+	// a 10 byte segment of which only 4 bytes were captured
+	truncated := s.segment(3, []byte{1, 2, 3, 4})
+	truncated.TruncatedBytes = 6
+	conn.ReceivePacket(truncated)
+	if conn.serverNextSeq != 13 {
+		t.Fatalf("next sequence %d does not account for the truncated bytes", conn.serverNextSeq)
+	}
+	conn.ReceivePacket(s.segment(13, []byte{11, 12, 13, 14, 15}))
+	if conn.serverNextSeq != 18 {
+		t.Fatalf("contiguous segment after a truncated one not accepted; next sequence %d", conn.serverNextSeq)
+	}
+
+	// a genuine retransmission spanning the uncaptured bytes
+	conn.ReceivePacket(s.segment(3, []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}))
+	if attackLogger.Count != 0 {
+		t.Fatalf("retransmission over truncated bytes reported as %s", attackLogger.LastEvent)
+	}
+
+	// conflicting captured bytes are still reported, marked as truncated
+	conn.ReceivePacket(s.segment(3, []byte{1, 2, 3, 99, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}))
+	if attackLogger.Count != 1 {
+		t.Fatal("injection into the captured bytes of a truncated segment not reported")
+	}
+	if !attackLogger.LastEvent.Truncated {
+		t.Error("event compared with a truncated segment not marked as truncated")
+	}
+}
+
+func TestBadChecksumInjection(t *testing.T) {
+	s := newTestStream(ConnectionOptions{
+		MaxRingPackets:  40,
+		DetectInjection: true,
+	})
+	conn, attackLogger := s.conn, s.attackLogger
+	badChecksum := func(seq uint32, payload []byte) *types.PacketManifest {
+		p := s.segment(seq, payload)
+		p.BadChecksum = true
+		return p
+	}
+
+	// the receiver discards a segment with a bad checksum
+	conn.ReceivePacket(badChecksum(3, []byte{9, 9, 9}))
+	if conn.serverNextSeq != 3 || attackLogger.Count != 0 {
+		t.Fatalf("bad checksum segment accepted; next sequence %d", conn.serverNextSeq)
+	}
+	conn.ReceivePacket(s.segment(3, []byte{1, 2, 3, 4, 5}))
+	if conn.serverNextSeq != 8 {
+		t.Fatalf("valid segment not accepted; next sequence %d", conn.serverNextSeq)
+	}
+
+	conn.ReceivePacket(badChecksum(4, []byte{2, 3}))
+	if attackLogger.Count != 0 {
+		t.Fatalf("identical bad checksum retransmission reported as %s", attackLogger.LastEvent)
+	}
+	conn.ReceivePacket(badChecksum(4, []byte{2, 99}))
+	if attackLogger.Count != 1 || attackLogger.LastEvent.Kind != types.EventBadChecksumInjection {
+		t.Fatalf("conflicting bad checksum segment not reported as such: %d events", attackLogger.Count)
+	}
+	if conn.serverNextSeq != 8 {
+		t.Errorf("bad checksum segment moved the next sequence to %d", conn.serverNextSeq)
+	}
+}
+
+func TestInjectionHeaderEvidence(t *testing.T) {
+	s := newTestStream(ConnectionOptions{
+		MaxRingPackets:  40,
+		DetectInjection: true,
+	})
+	conn, attackLogger := s.conn, s.attackLogger
+	segment := func(seq uint32, payload []byte, id uint16) *types.PacketManifest {
+		p := s.segment(seq, payload)
+		p.IP.Id = id
+		p.TCP.Window = 1000
+		p.SrcMAC = net.HardwareAddr{0xde, 0xad, 0xbe, 0xee, 0xee, 0xff}
+		return p
+	}
+
+	conn.ReceivePacket(segment(3, []byte{1, 2, 3, 4, 5}, 100))
+	conn.ReceivePacket(segment(8, []byte{6, 7, 8, 9, 10}, 101))
+	injected := segment(6, []byte{4, 5, 99, 7}, 7777)
+	injected.IP.TTL = 50
+	injected.IP.TOS = 0x28
+	injected.TCP.Window = 512
+	injected.TCP.Options = []layers.TCPOption{{OptionType: 1}, {OptionType: 3, OptionLength: 3, OptionData: []byte{7}}}
+	injected.SrcMAC = net.HardwareAddr{0, 1, 2, 3, 4, 5}
+	conn.ReceivePacket(injected)
+	if attackLogger.Count != 1 {
+		t.Fatalf("%d events rather than 1", attackLogger.Count)
+	}
+
+	evidence := attackLogger.LastEvent.Evidence
+	want := types.HeaderEvidence{
+		Seq:        6,
+		Seen:       injected.Timestamp,
+		TTL:        50,
+		IPID:       7777,
+		DSCP:       10,
+		Window:     512,
+		TCPOptions: "NOP,WS:07",
+		SrcMAC:     "00:01:02:03:04:05",
+	}
+	if evidence == nil || *evidence != want {
+		t.Errorf("injected segment evidence %+v != %+v", evidence, want)
+	}
+	overlap := attackLogger.LastEvent.OverlapEvidence
+	if len(overlap) != 2 {
+		t.Fatalf("evidence of %d overlapped segments rather than 2", len(overlap))
+	}
+	for i, id := range []uint16{100, 101} {
+		if overlap[i].IPID != id || overlap[i].TTL != 64 || overlap[i].Window != 1000 || overlap[i].SrcMAC != "de:ad:be:ee:ee:ff" {
+			t.Errorf("overlapped segment evidence %+v", overlap[i])
+		}
+	}
+}
+
+func TestStreamRingBounds(t *testing.T) {
+	budget := types.NewRingBudget(1000)
+	s := newTestStream(ConnectionOptions{
+		MaxRingBytes:    10,
+		RingBudget:      budget,
+		DetectInjection: true,
+	})
+	conn, attackLogger := s.conn, s.attackLogger
+
+	conn.ReceivePacket(s.segment(3, []byte{1, 2, 3, 4, 5}))
+	conn.ReceivePacket(s.segment(8, []byte{6, 7, 8, 9, 10}))
+	conn.ReceivePacket(s.segment(13, []byte{11, 12, 13, 14, 15}))
+	if count := conn.ClientStreamRing.Prev().Count(); count != 2 {
+		t.Fatalf("ring of 10 bytes holds %d segments of 5 bytes", count)
+	}
+	if budget.Used() != 10 {
+		t.Errorf("budget used %d rather than 10", budget.Used())
+	}
+
+	// the first segment has left the window
+	conn.ReceivePacket(s.segment(3, []byte{1, 99, 3}))
+	if attackLogger.Count != 0 {
+		t.Errorf("%d events for a segment beyond the window", attackLogger.Count)
+	}
+	conn.ReceivePacket(s.segment(9, []byte{7, 99, 9}))
+	if attackLogger.Count != 1 {
+		t.Errorf("%d events rather than 1", attackLogger.Count)
+	}
+
+	conn.Close()
+	if budget.Used() != 0 {
+		t.Errorf("closed connection holds %d budgeted bytes", budget.Used())
+	}
+}
@@ -0,0 +1,385 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package HoneyBadger
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+// dot1QStack is a gopacket.DecodingLayer for single and stacked (QinQ)
+// 802.1Q VLAN tags. It remembers every VLAN identifier it decodes,
+// outermost first, until Reset is called.
+type dot1QStack struct {
+	layers.Dot1Q
+	VLANs []uint16
+}
+
+// DecodeFromBytes decodes one 802.1Q tag and records its VLAN identifier
+func (d *dot1QStack) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	err := d.Dot1Q.DecodeFromBytes(data, df)
+	if err != nil {
+		return err
+	}
+	d.VLANs = append(d.VLANs, d.VLANIdentifier)
+	return nil
+}
+
+// Reset forgets the VLAN identifiers of the previously decoded frame
+func (d *dot1QStack) Reset() {
+	d.VLANs = d.VLANs[:0]
+}
+
+// loopback is a gopacket.DecodingLayer for the BSD loopback encapsulation
+// used by DLT_NULL and DLT_LOOP captures; gopacket's layers.Loopback can
+// only be used with the slower gopacket.NewPacket API.
+type loopback struct {
+	layers.Loopback
+}
+
+// DecodeFromBytes decodes the 4 byte address family header which may be
+// in either byte order.
+func (l *loopback) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	var family uint32
+	if len(data) < 4 {
+		return errors.New("loopback packet too small")
+	}
+	if data[0] == 0 && data[1] == 0 {
+		family = binary.BigEndian.Uint32(data[:4])
+	} else {
+		family = binary.LittleEndian.Uint32(data[:4])
+	}
+	if family > 0xFF {
+		return errors.New("invalid loopback protocol family")
+	}
+	l.Family = layers.ProtocolFamily(family)
+	l.BaseLayer = layers.BaseLayer{Contents: data[:4], Payload: data[4:]}
+	return nil
+}
+
+func (l *loopback) CanDecode() gopacket.LayerClass {
+	return layers.LayerTypeLoopback
+}
+
+func (l *loopback) NextLayerType() gopacket.LayerType {
+	return l.Family.LayerType()
+}
+
+// packetDecoder parses raw frames of any supported link type into
+// PacketManifests. The flows of a decoder receiving the packets of a
+// remote sensor are bound to that sensor. It is not safe for concurrent use; each decoding
+// goroutine must use its own packetDecoder.
+type packetDecoder struct {
+	trackVLAN     bool
+	eth           layers.Ethernet
+	sll           layers.LinuxSLL
+	loopback      loopback
+	dot1q         dot1QStack
+	ip            tunnelIPv4
+	ip6           tunnelIPv6
+	ip6extensions layers.IPv6ExtensionSkipper
+	gre           gre
+	udp           layers.UDP
+	tcp           layers.TCP
+	payload       gopacket.Payload
+	decoded       []gopacket.LayerType
+	parsers       map[gopacket.LayerType]*gopacket.DecodingLayerParser
+	unsupported   map[layers.LinkType]bool
+	defragmenter  *ipv4Defragmenter
+	decapGRE      bool
+	vxlanPorts    map[layers.UDPPort]bool
+	sensor        string
+	checksums     bool
+	attackLogger  types.Logger
+}
+
+// newPacketDecoder returns a packetDecoder configured by the given
+// sniffer options. If TrackVLAN is set then the VLAN tags of each
+// frame become part of the resulting flow. Tunnels selected by the
+// DecapGRE, DecapIPIP and VXLANPorts options are decapsulated. IPv4
+// and TCP checksums are validated unless SkipChecksums is set.
+func newPacketDecoder(options SnifferOptions) *packetDecoder {
+	d := &packetDecoder{
+		trackVLAN:    options.TrackVLAN,
+		checksums:    !options.SkipChecksums,
+		decoded:      make([]gopacket.LayerType, 0, 8),
+		parsers:      make(map[gopacket.LayerType]*gopacket.DecodingLayerParser),
+		unsupported:  make(map[layers.LinkType]bool),
+		defragmenter: newIPv4Defragmenter(options.FragmentTimeout, options.MaxFragmentBytes),
+		decapGRE:     options.DecapGRE,
+		vxlanPorts:   make(map[layers.UDPPort]bool),
+		attackLogger: options.AttackLogger,
+	}
+	d.ip.decapIPIP = options.DecapIPIP
+	d.ip6.decapIPIP = options.DecapIPIP
+	for _, port := range options.VXLANPorts {
+		d.vxlanPorts[layers.UDPPort(port)] = true
+	}
+	return d
+}
+
+// firstLayerType returns the layer type that frames of the given link
+// type begin with. Raw IP frames carry no link header, therefore the IP
+// version is read from the frame itself.
+func firstLayerType(linkType layers.LinkType, data []byte) gopacket.LayerType {
+	switch linkType {
+	case layers.LinkTypeEthernet:
+		return layers.LayerTypeEthernet
+	case layers.LinkTypeLinuxSLL:
+		return layers.LayerTypeLinuxSLL
+	case layers.LinkTypeNull, layers.LinkTypeLoop:
+		return layers.LayerTypeLoopback
+	case layers.LinkTypeRaw, 12, 14: // DLT_RAW is 12 or 14 on some BSDs
+		if len(data) > 0 && data[0]>>4 == 6 {
+			return layers.LayerTypeIPv6
+		}
+		return layers.LayerTypeIPv4
+	}
+	return gopacket.LayerTypeZero
+}
+
+// parser returns the DecodingLayerParser for frames starting with the
+// given layer type. All parsers share the same decoding layers.
+func (d *packetDecoder) parser(first gopacket.LayerType) *gopacket.DecodingLayerParser {
+	parser, ok := d.parsers[first]
+	if !ok {
+		parser = gopacket.NewDecodingLayerParser(first, &d.eth, &d.sll, &d.loopback, &d.dot1q, &d.ip, &d.ip6, &d.ip6extensions, &d.gre, &d.udp, &d.tcp, &d.payload)
+		d.parsers[first] = parser
+	}
+	return parser
+}
+
+// decode parses the raw frame into the shared decoding layers
+func (d *packetDecoder) decode(first gopacket.LayerType, rawPacket []byte) error {
+	newPayload := new(gopacket.Payload)
+	d.payload = *newPayload
+	d.dot1q.Reset()
+	return d.parser(first).DecodeLayers(rawPacket, &d.decoded)
+}
+
+// decodedIPv4Fragment returns true if the last decoded frame was a
+// fragment of an IPv4 datagram carrying TCP or a tunnel to decapsulate
+func (d *packetDecoder) decodedIPv4Fragment() bool {
+	for _, typ := range d.decoded {
+		if typ == layers.LayerTypeIPv4 {
+			return isIPv4Fragment(&d.ip.IPv4) && d.reassembles(d.ip.Protocol)
+		}
+	}
+	return false
+}
+
+// srcMAC returns a copy of the source hardware address of the last
+// decoded frame, or nil if its link header has none
+func (d *packetDecoder) srcMAC() net.HardwareAddr {
+	for _, typ := range d.decoded {
+		switch typ {
+		case layers.LayerTypeEthernet:
+			return append(net.HardwareAddr(nil), d.eth.SrcMAC...)
+		case layers.LayerTypeLinuxSLL:
+			// the sender's address, unless it is not a MAC address
+			if d.sll.AddrLen == 6 {
+				return append(net.HardwareAddr(nil), d.sll.Addr...)
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+// reportAbandonedOverlaps reports the conflicting fragment overlaps of
+// the incomplete datagrams the defragmenter dropped, which no connection
+// sees
+func (d *packetDecoder) reportAbandonedOverlaps() {
+	for _, datagram := range d.defragmenter.takeAbandoned() {
+		if d.attackLogger == nil {
+			continue
+		}
+		event := datagram.overlapEvent()
+		event.ResolveKind()
+		if d.sensor != "" {
+			event.Flow = event.Flow.WithSensor(d.sensor)
+		}
+		d.attackLogger.Log(event)
+	}
+}
+
+// copyIPv4Options returns a deep copy of the options, which the decoding
+// layers reuse for the next packet
+func copyIPv4Options(options []layers.IPv4Option) []layers.IPv4Option {
+	if len(options) == 0 {
+		return nil
+	}
+	copied := make([]layers.IPv4Option, len(options))
+	for i, option := range options {
+		copied[i] = option
+		copied[i].OptionData = append([]byte(nil), option.OptionData...)
+	}
+	return copied
+}
+
+// copyTCPOptions returns a deep copy of the options, which the decoding
+// layers reuse for the next packet
+func copyTCPOptions(options []layers.TCPOption) []layers.TCPOption {
+	if len(options) == 0 {
+		return nil
+	}
+	copied := make([]layers.TCPOption, len(options))
+	for i, option := range options {
+		copied[i] = option
+		copied[i].OptionData = append([]byte(nil), option.OptionData...)
+	}
+	return copied
+}
+
+// reassembles returns true if fragmented datagrams of the given
+// protocol are worth reassembling
+func (d *packetDecoder) reassembles(protocol layers.IPProtocol) bool {
+	switch {
+	case protocol == layers.IPProtocolTCP:
+		return true
+	case protocol == layers.IPProtocolGRE:
+		return d.decapGRE
+	case protocol == layers.IPProtocolUDP:
+		return len(d.vxlanPorts) > 0
+	case isIPIPProtocol(protocol):
+		return d.ip.decapIPIP
+	}
+	return false
+}
+
+// Decode returns a PacketManifest for the given raw frame
+// or nil if it is not a TCP/IP packet we can track.
+// IPv4 fragments are buffered until their datagram can be
+// reassembled; the frame completing a datagram then results in
+// a PacketManifest of the reassembled datagram. Packets of
+// decapsulated tunnels are described by the PacketManifest, whose
+// RawPacket still holds the encapsulating frame.
+func (d *packetDecoder) Decode(timedRawPacket TimedRawPacket) *types.PacketManifest {
+	first := firstLayerType(timedRawPacket.LinkType, timedRawPacket.RawPacket)
+	if first == gopacket.LayerTypeZero {
+		if !d.unsupported[timedRawPacket.LinkType] {
+			log.Printf("unsupported link type %s; ignoring its packets", timedRawPacket.LinkType)
+			d.unsupported[timedRawPacket.LinkType] = true
+		}
+		return nil
+	}
+	rawPacket, data := timedRawPacket.RawPacket, timedRawPacket.RawPacket
+	var fragmentOverlap *types.FragmentOverlap
+	var tunnel *types.Tunnel
+	var srcMAC net.HardwareAddr
+	for depth := 0; ; depth++ {
+		err := d.decode(first, data)
+		if d.decodedIPv4Fragment() {
+			// the IPv4 header is a subslice of the frame; whatever precedes it is link header
+			linkHeader := data[:cap(data)-cap(d.ip.Contents)]
+			data, fragmentOverlap = d.defragmenter.Insert(linkHeader, &d.ip.IPv4, timedRawPacket.Timestamp)
+			d.reportAbandonedOverlaps()
+			if data == nil {
+				return nil
+			}
+			if depth == 0 {
+				rawPacket = data
+			}
+			err = d.decode(first, data)
+		}
+		if depth == 0 {
+			// the link header of the captured frame rather than of a tunneled one
+			srcMAC = d.srcMAC()
+		}
+		next, payload, outer := d.tunneledPacket()
+		if next != gopacket.LayerTypeZero && depth < maxTunnelDepth {
+			if tunnel == nil {
+				tunnel = outer
+			}
+			first, data = next, payload
+			continue
+		}
+		if err != nil {
+			return nil
+		}
+		break
+	}
+	packetManifest := types.PacketManifest{
+		Timestamp:       timedRawPacket.Timestamp,
+		LinkType:        timedRawPacket.LinkType,
+		RawPacket:       rawPacket,
+		FragmentOverlap: fragmentOverlap,
+		Tunnel:          tunnel,
+		SrcMAC:          srcMAC,
+	}
+	var ipFlow gopacket.Flow
+	var ip4 *layers.IPv4
+	var ip6 *layers.IPv6
+	isTCP, isFragment := false, false
+	// the IP header tells how much of the packet the snaplen cut off
+	truncated := 0
+	for _, typ := range d.decoded {
+		switch typ {
+		case layers.LayerTypeIPv4:
+			packetManifest.IP = d.ip.IPv4
+			packetManifest.IP.Options = copyIPv4Options(d.ip.Options)
+			ipFlow = d.ip.NetworkFlow()
+			ip4 = &d.ip.IPv4
+			truncated = int(d.ip.Length) - len(d.ip.Contents) - len(d.ip.Payload)
+		case layers.LayerTypeIPv6:
+			packetManifest.IPv6 = d.ip6.IPv6
+			packetManifest.IPv6.HopByHop = nil
+			ipFlow = d.ip6.NetworkFlow()
+			ip4, ip6 = nil, &d.ip6.IPv6
+			if d.ip6.Length != 0 { // not a jumbogram
+				truncated = int(d.ip6.Length) - len(d.ip6.Payload)
+			}
+		case layers.LayerTypeIPv6Fragment:
+			// XXX IPv6 fragments are not reassembled
+			isFragment = true
+		case layers.LayerTypeTCP:
+			isTCP = true
+		}
+	}
+	if !isTCP || isFragment {
+		return nil
+	}
+	if d.trackVLAN {
+		packetManifest.Flow = types.NewTcpIpFlowWithVLANTags(ipFlow, d.tcp.TransportFlow(), types.NewVLANTags(d.dot1q.VLANs...))
+	} else {
+		packetManifest.Flow = types.NewTcpIpFlowFromFlows(ipFlow, d.tcp.TransportFlow())
+	}
+	if d.sensor != "" {
+		packetManifest.Flow = packetManifest.Flow.WithSensor(d.sensor)
+	}
+	packetManifest.TCP = d.tcp
+	packetManifest.TCP.Options = copyTCPOptions(d.tcp.Options)
+	packetManifest.Payload = d.payload
+	if truncated > 0 {
+		packetManifest.TruncatedBytes = truncated
+	}
+	// the checksums of truncated packets cannot be verified
+	if d.checksums && truncated <= 0 {
+		packetManifest.BadChecksum = (ip4 != nil && !validIPv4HeaderChecksum(ip4)) || !validTCPChecksum(ip4, ip6, &d.tcp)
+	}
+	return &packetManifest
+}
@@ -0,0 +1,363 @@
+package HoneyBadger
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/david415/HoneyBadger/types"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func serializeTestLayers(t *testing.T, l ...gopacket.SerializableLayer) []byte {
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{
+		FixLengths:       true,
+		ComputeChecksums: true,
+	}
+	err := gopacket.SerializeLayers(buf, opts, l...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// makeTestTcpIpPacket returns a raw IPv4 or IPv6 TCP packet without any link layer
+func makeTestTcpIpPacket(t *testing.T, v6 bool) []byte {
+	tcp := layers.TCP{
+		SrcPort: 1,
+		DstPort: 2,
+		Seq:     1234,
+		ACK:     true,
+	}
+	payload := gopacket.Payload([]byte{1, 2, 3})
+	if v6 {
+		ip6 := layers.IPv6{
+			SrcIP:      net.ParseIP("2001:db8::1"),
+			DstIP:      net.ParseIP("2001:db8::2"),
+			Version:    6,
+			HopLimit:   64,
+			NextHeader: layers.IPProtocolTCP,
+		}
+		tcp.SetNetworkLayerForChecksum(&ip6)
+		return serializeTestLayers(t, &ip6, &tcp, payload)
+	}
+	ip := layers.IPv4{
+		SrcIP:    net.IP{1, 2, 3, 4},
+		DstIP:    net.IP{2, 3, 4, 5},
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolTCP,
+	}
+	tcp.SetNetworkLayerForChecksum(&ip)
+	return serializeTestLayers(t, &ip, &tcp, payload)
+}
+
+func checkTestManifest(t *testing.T, p *types.PacketManifest, v6 bool, wantFlow string) {
+	if p == nil {
+		t.Fatal("failed to decode packet")
+	}
+	if p.IsIPv6() != v6 {
+		t.Errorf("IsIPv6 is %v", p.IsIPv6())
+	}
+	if p.TCP.Seq != 1234 || !bytes.Equal(p.Payload, []byte{1, 2, 3}) {
+		t.Errorf("bad TCP decode: seq %d payload %v", p.TCP.Seq, p.Payload)
+	}
+	if p.Flow.String() != wantFlow {
+		t.Errorf("flow %s != %s", p.Flow, wantFlow)
+	}
+}
+
+func TestDecodeEthernetIPv4(t *testing.T) {
+	eth := layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0xde, 0xad, 0xbe, 0xee, 0xee, 0xff},
+		DstMAC:       net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	frame := serializeTestLayers(t, &eth, gopacket.Payload(makeTestTcpIpPacket(t, false)))
+	decoder := newPacketDecoder(SnifferOptions{})
+	p := decoder.Decode(TimedRawPacket{
+		Timestamp: time.Now(),
+		LinkType:  layers.LinkTypeEthernet,
+		RawPacket: frame,
+	})
+	checkTestManifest(t, p, false, "1.2.3.4:1-2.3.4.5:2")
+	if p.LinkType != layers.LinkTypeEthernet {
+		t.Errorf("link type %s not carried into manifest", p.LinkType)
+	}
+	if p.SrcMAC.String() != "de:ad:be:ee:ee:ff" {
+		t.Errorf("source MAC %s not carried into manifest", p.SrcMAC)
+	}
+}
+
+func TestDecodeQinQ(t *testing.T) {
+	eth := layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0xde, 0xad, 0xbe, 0xee, 0xee, 0xff},
+		DstMAC:       net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		EthernetType: layers.EthernetTypeQinQ,
+	}
+	outer := layers.Dot1Q{
+		VLANIdentifier: 100,
+		Type:           layers.EthernetTypeDot1Q,
+	}
+	inner := layers.Dot1Q{
+		VLANIdentifier: 200,
+		Type:           layers.EthernetTypeIPv6,
+	}
+	frame := serializeTestLayers(t, &eth, &outer, &inner, gopacket.Payload(makeTestTcpIpPacket(t, true)))
+	timedRawPacket := TimedRawPacket{
+		Timestamp: time.Now(),
+		LinkType:  layers.LinkTypeEthernet,
+		RawPacket: frame,
+	}
+
+	decoder := newPacketDecoder(SnifferOptions{})
+	checkTestManifest(t, decoder.Decode(timedRawPacket), true, "[2001:db8::1]:1-[2001:db8::2]:2")
+
+	decoder = newPacketDecoder(SnifferOptions{TrackVLAN: true})
+	checkTestManifest(t, decoder.Decode(timedRawPacket), true, "[2001:db8::1]:1-[2001:db8::2]:2-vlan100.200")
+	// the tag stack must not leak into the next frame
+	checkTestManifest(t, decoder.Decode(timedRawPacket), true, "[2001:db8::1]:1-[2001:db8::2]:2-vlan100.200")
+}
+
+func TestDecodeLinuxSLL(t *testing.T) {
+	sll := make([]byte, 16)
+	binary.BigEndian.PutUint16(sll[2:4], 1) // ARPHRD_ETHER
+	binary.BigEndian.PutUint16(sll[4:6], 6)
+	copy(sll[6:], []byte{0xde, 0xad, 0xbe, 0xee, 0xee, 0xff})
+	binary.BigEndian.PutUint16(sll[14:16], uint16(layers.EthernetTypeIPv4))
+	frame := append(sll, makeTestTcpIpPacket(t, false)...)
+
+	decoder := newPacketDecoder(SnifferOptions{})
+	p := decoder.Decode(TimedRawPacket{
+		Timestamp: time.Now(),
+		LinkType:  layers.LinkTypeLinuxSLL,
+		RawPacket: frame,
+	})
+	checkTestManifest(t, p, false, "1.2.3.4:1-2.3.4.5:2")
+	if p.SrcMAC.String() != "de:ad:be:ee:ee:ff" {
+		t.Errorf("source MAC %s not carried into manifest", p.SrcMAC)
+	}
+}
+
+func TestDecodeLoopback(t *testing.T) {
+	decoder := newPacketDecoder(SnifferOptions{})
+
+	// little endian AF_INET as written on x86 BSDs
+	frame := append([]byte{2, 0, 0, 0}, makeTestTcpIpPacket(t, false)...)
+	p := decoder.Decode(TimedRawPacket{
+		Timestamp: time.Now(),
+		LinkType:  layers.LinkTypeNull,
+		RawPacket: frame,
+	})
+	checkTestManifest(t, p, false, "1.2.3.4:1-2.3.4.5:2")
+
+	// big endian AF_INET6 (Darwin) as written by DLT_LOOP
+	frame = append([]byte{0, 0, 0, 30}, makeTestTcpIpPacket(t, true)...)
+	p = decoder.Decode(TimedRawPacket{
+		Timestamp: time.Now(),
+		LinkType:  layers.LinkTypeLoop,
+		RawPacket: frame,
+	})
+	checkTestManifest(t, p, true, "[2001:db8::1]:1-[2001:db8::2]:2")
+}
+
+func TestDecodeRawIP(t *testing.T) {
+	decoder := newPacketDecoder(SnifferOptions{})
+	p := decoder.Decode(TimedRawPacket{
+		Timestamp: time.Now(),
+		LinkType:  layers.LinkTypeRaw,
+		RawPacket: makeTestTcpIpPacket(t, false),
+	})
+	checkTestManifest(t, p, false, "1.2.3.4:1-2.3.4.5:2")
+
+	p = decoder.Decode(TimedRawPacket{
+		Timestamp: time.Now(),
+		LinkType:  layers.LinkTypeRaw,
+		RawPacket: makeTestTcpIpPacket(t, true),
+	})
+	checkTestManifest(t, p, true, "[2001:db8::1]:1-[2001:db8::2]:2")
+}
+
+func TestDecodeUnsupported(t *testing.T) {
+	decoder := newPacketDecoder(SnifferOptions{})
+	p := decoder.Decode(TimedRawPacket{
+		Timestamp: time.Now(),
+		LinkType:  layers.LinkTypeIEEE802_11,
+		RawPacket: makeTestTcpIpPacket(t, false),
+	})
+	if p != nil {
+		t.Error("decoded a packet of an unsupported link type")
+	}
+
+	ip := layers.IPv4{
+		SrcIP:    net.IP{1, 2, 3, 4},
+		DstIP:    net.IP{2, 3, 4, 5},
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+	}
+	udp := layers.UDP{
+		SrcPort: 1,
+		DstPort: 2,
+	}
+	udp.SetNetworkLayerForChecksum(&ip)
+	p = decoder.Decode(TimedRawPacket{
+		Timestamp: time.Now(),
+		LinkType:  layers.LinkTypeRaw,
+		RawPacket: serializeTestLayers(t, &ip, &udp, gopacket.Payload([]byte{1, 2, 3})),
+	})
+	if p != nil {
+		t.Error("decoded a UDP packet")
+	}
+}
+
+func TestDecodeTruncated(t *testing.T) {
+	packet := makeTestTcpIpPacket(t, false)
+	decoder := newPacketDecoder(SnifferOptions{})
+	p := decoder.Decode(TimedRawPacket{
+		Timestamp: time.Now(),
+		LinkType:  layers.LinkTypeRaw,
+		RawPacket: packet[:len(packet)-2],
+	})
+	if p == nil {
+		t.Fatal("failed to decode truncated packet")
+	}
+	if !bytes.Equal(p.Payload, []byte{1}) || p.TruncatedBytes != 2 || p.SegmentLength() != 3 {
+		t.Errorf("payload %v truncated bytes %d", p.Payload, p.TruncatedBytes)
+	}
+
+	p = decoder.Decode(TimedRawPacket{
+		Timestamp: time.Now(),
+		LinkType:  layers.LinkTypeRaw,
+		RawPacket: packet,
+	})
+	if p == nil || p.TruncatedBytes != 0 {
+		t.Errorf("complete packet considered truncated: %v", p)
+	}
+}
+
+func TestDecodeChecksums(t *testing.T) {
+	for _, v6 := range []bool{false, true} {
+		packet := makeTestTcpIpPacket(t, v6)
+		decode := func(options SnifferOptions, rawPacket []byte) *types.PacketManifest {
+			p := newPacketDecoder(options).Decode(TimedRawPacket{
+				Timestamp: time.Now(),
+				LinkType:  layers.LinkTypeRaw,
+				RawPacket: rawPacket,
+			})
+			if p == nil {
+				t.Fatal("failed to decode packet")
+			}
+			return p
+		}
+		if decode(SnifferOptions{}, packet).BadChecksum {
+			t.Errorf("IPv6 %v: valid checksum reported as bad", v6)
+		}
+		corrupt := append([]byte(nil), packet...)
+		corrupt[len(corrupt)-1] ^= 0xff
+		if !decode(SnifferOptions{}, corrupt).BadChecksum {
+			t.Errorf("IPv6 %v: bad TCP checksum not detected", v6)
+		}
+		if decode(SnifferOptions{SkipChecksums: true}, corrupt).BadChecksum {
+			t.Errorf("IPv6 %v: checksum validated although skipped", v6)
+		}
+		if v6 {
+			continue
+		}
+		corrupt = append([]byte(nil), packet...)
+		corrupt[8] -= 1 // TTL
+		if !decode(SnifferOptions{}, corrupt).BadChecksum {
+			t.Error("bad IPv4 header checksum not detected")
+		}
+	}
+}
+
+func TestDecodeRoutingHeaderChecksum(t *testing.T) {
+	final := net.ParseIP("2001:db8::3")
+	withRoutingHeader := func(routingType, segmentsLeft byte) []byte {
+		tcp := layers.TCP{
+			SrcPort: 1,
+			DstPort: 2,
+			Seq:     1234,
+			ACK:     true,
+		}
+		// the checksum covers the final destination, not the next hop
+		tcp.SetNetworkLayerForChecksum(&layers.IPv6{
+			SrcIP:      net.ParseIP("2001:db8::1"),
+			DstIP:      final,
+			NextHeader: layers.IPProtocolTCP,
+		})
+		segment := serializeTestLayers(t, &tcp, gopacket.Payload([]byte{1, 2, 3}))
+		routing := append([]byte{byte(layers.IPProtocolTCP), 2, routingType, segmentsLeft, 0, 0, 0, 0}, final...)
+		ip6 := layers.IPv6{
+			SrcIP:      net.ParseIP("2001:db8::1"),
+			DstIP:      net.ParseIP("2001:db8::2"),
+			Version:    6,
+			HopLimit:   64,
+			NextHeader: layers.IPProtocolIPv6Routing,
+		}
+		return serializeTestLayers(t, &ip6, gopacket.Payload(append(routing, segment...)))
+	}
+	for _, routingType := range []byte{0, 2, 4} {
+		p := newPacketDecoder(SnifferOptions{}).Decode(TimedRawPacket{time.Now(), layers.LinkTypeRaw, withRoutingHeader(routingType, 1)})
+		if p == nil {
+			t.Fatalf("failed to decode packet with a type %d routing header", routingType)
+		}
+		if p.BadChecksum {
+			t.Errorf("type %d routing header: valid checksum reported as bad", routingType)
+		}
+	}
+	// once no segments are left the destination is the final one
+	p := newPacketDecoder(SnifferOptions{}).Decode(TimedRawPacket{time.Now(), layers.LinkTypeRaw, withRoutingHeader(0, 0)})
+	if p == nil || !p.BadChecksum {
+		t.Error("checksum over the final destination accepted for the next hop")
+	}
+}
+
+func TestDecodeCopiesOptions(t *testing.T) {
+	withOption := func(option layers.TCPOption) []byte {
+		ip := layers.IPv4{
+			SrcIP:    net.IP{1, 2, 3, 4},
+			DstIP:    net.IP{2, 3, 4, 5},
+			Version:  4,
+			TTL:      64,
+			Protocol: layers.IPProtocolTCP,
+		}
+		tcp := layers.TCP{
+			SrcPort: 1,
+			DstPort: 2,
+			Seq:     1234,
+			SYN:     true,
+			Options: []layers.TCPOption{option},
+		}
+		tcp.SetNetworkLayerForChecksum(&ip)
+		return serializeTestLayers(t, &ip, &tcp)
+	}
+	decoder := newPacketDecoder(SnifferOptions{})
+	rawPacket := withOption(layers.TCPOption{OptionType: 2, OptionLength: 4, OptionData: []byte{5, 180}})
+	p := decoder.Decode(TimedRawPacket{
+		Timestamp: time.Now(),
+		LinkType:  layers.LinkTypeRaw,
+		RawPacket: rawPacket,
+	})
+	if p == nil {
+		t.Fatal("failed to decode packet")
+	}
+	// the next packet reuses the decoding layers and a capture may
+	// reuse the buffer of the raw packet
+	decoder.Decode(TimedRawPacket{
+		Timestamp: time.Now(),
+		LinkType:  layers.LinkTypeRaw,
+		RawPacket: withOption(layers.TCPOption{OptionType: 3, OptionLength: 3, OptionData: []byte{7}}),
+	})
+	for i := range rawPacket {
+		rawPacket[i] = 0
+	}
+	if len(p.TCP.Options) == 0 || p.TCP.Options[0].OptionType != 2 || !bytes.Equal(p.TCP.Options[0].OptionData, []byte{5, 180}) {
+		t.Errorf("TCP options of the manifest changed to %v", p.TCP.Options)
+	}
+}
@@ -0,0 +1,337 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package HoneyBadger
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"log"
+	"net"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+const (
+	// DefaultFragmentTimeout is how long an incomplete IPv4 datagram
+	// is kept waiting for its missing fragments.
+	DefaultFragmentTimeout = 30 * time.Second
+	// DefaultMaxFragmentBytes bounds the fragment payload bytes
+	// buffered for all incomplete IPv4 datagrams together.
+	DefaultMaxFragmentBytes = 4 * 1024 * 1024
+
+	// maxIPv4Datagram is the largest datagram an IPv4 header can describe
+	maxIPv4Datagram = 65535
+)
+
+// ipv4FragmentKey identifies the fragments of one IPv4 datagram as described in RFC 791
+type ipv4FragmentKey struct {
+	src, dst [4]byte
+	id       uint16
+	protocol layers.IPProtocol
+}
+
+type ipv4Fragment struct {
+	offset int
+	data   []byte
+}
+
+// ipv4Datagram is an IPv4 datagram that is being reassembled
+type ipv4Datagram struct {
+	key        ipv4FragmentKey
+	linkHeader []byte
+	header     []byte
+	fragments  []ipv4Fragment // in order of arrival
+	length     int            // payload length, or -1 until the last fragment arrives
+	size       int
+	lastSeen   time.Time
+	overlap    *types.FragmentOverlap
+	element    *list.Element
+}
+
+// ipv4Defragmenter reassembles fragmented IPv4 datagrams.
+// Overlapping fragments are resolved in favor of the fragment received
+// first; the first overlap with conflicting contents is reported along
+// with the reassembled datagram. Incomplete datagrams are dropped once
+// they have not seen a fragment for the timeout duration, judged by
+// packet timestamps, or when maxBytes would otherwise be exceeded.
+// Dropped datagrams with a conflicting overlap are kept in abandoned
+// until taken by the caller, since an overlap may be meant for hosts
+// which reassemble the datagram from fewer fragments.
+type ipv4Defragmenter struct {
+	timeout   time.Duration
+	maxBytes  int
+	size      int
+	datagrams map[ipv4FragmentKey]*ipv4Datagram
+	lru       *list.List // least recently seen datagram first
+	abandoned []*ipv4Datagram
+}
+
+// newIPv4Defragmenter returns an ipv4Defragmenter. Zero values
+// select DefaultFragmentTimeout and DefaultMaxFragmentBytes.
+func newIPv4Defragmenter(timeout time.Duration, maxBytes int) *ipv4Defragmenter {
+	if timeout <= 0 {
+		timeout = DefaultFragmentTimeout
+	}
+	if maxBytes <= 0 {
+		maxBytes = DefaultMaxFragmentBytes
+	}
+	return &ipv4Defragmenter{
+		timeout:   timeout,
+		maxBytes:  maxBytes,
+		datagrams: make(map[ipv4FragmentKey]*ipv4Datagram),
+		lru:       list.New(),
+	}
+}
+
+// isIPv4Fragment returns true if ip is one fragment of a larger datagram
+func isIPv4Fragment(ip *layers.IPv4) bool {
+	return ip.Flags&layers.IPv4MoreFragments != 0 || ip.FragOffset != 0
+}
+
+// Insert adds the fragment ip to its datagram. linkHeader holds the
+// frame bytes preceding the IPv4 header. Once all fragments of the
+// datagram arrived it returns the link header of its first fragment
+// followed by the reassembled datagram together with the first
+// conflicting overlap, if any; otherwise it returns nil.
+func (d *ipv4Defragmenter) Insert(linkHeader []byte, ip *layers.IPv4, timestamp time.Time) ([]byte, *types.FragmentOverlap) {
+	d.expire(timestamp)
+	if len(ip.Contents)+len(ip.Payload) != int(ip.Length) {
+		log.Printf("dropping truncated IPv4 fragment from %s", ip.SrcIP)
+		return nil, nil
+	}
+
+	key := ipv4FragmentKey{
+		id:       ip.Id,
+		protocol: ip.Protocol,
+	}
+	copy(key.src[:], ip.SrcIP.To4())
+	copy(key.dst[:], ip.DstIP.To4())
+	datagram, ok := d.datagrams[key]
+
+	offset := int(ip.FragOffset) * 8
+	end := offset + len(ip.Payload)
+	if len(ip.Contents)+end > maxIPv4Datagram {
+		log.Printf("dropping oversized fragmented IPv4 datagram from %s", ip.SrcIP)
+		if ok {
+			d.abandon(datagram)
+		}
+		return nil, nil
+	}
+	if !ok {
+		datagram = &ipv4Datagram{
+			key:    key,
+			length: -1,
+		}
+		datagram.element = d.lru.PushBack(datagram)
+		d.datagrams[key] = datagram
+	} else {
+		d.lru.MoveToBack(datagram.element)
+	}
+	datagram.lastSeen = timestamp
+
+	if offset == 0 && datagram.header == nil {
+		datagram.header = append([]byte(nil), ip.Contents...)
+		datagram.linkHeader = append([]byte(nil), linkHeader...)
+	}
+	if ip.Flags&layers.IPv4MoreFragments == 0 && datagram.length == -1 {
+		datagram.length = end
+	}
+	for _, fragment := range datagram.fragments {
+		start, stop := fragment.offset, fragment.offset+len(fragment.data)
+		if start < offset {
+			start = offset
+		}
+		if stop > end {
+			stop = end
+		}
+		if start >= stop {
+			continue
+		}
+		original := fragment.data[start-fragment.offset : stop-fragment.offset]
+		conflict := ip.Payload[start-offset : stop-offset]
+		if datagram.overlap == nil && !bytes.Equal(original, conflict) {
+			datagram.overlap = &types.FragmentOverlap{
+				Offset:   start,
+				Original: append([]byte(nil), original...),
+				Conflict: append([]byte(nil), conflict...),
+			}
+		}
+	}
+	datagram.fragments = append(datagram.fragments, ipv4Fragment{
+		offset: offset,
+		data:   append([]byte(nil), ip.Payload...),
+	})
+	datagram.size += len(ip.Payload)
+	d.size += len(ip.Payload)
+
+	if datagram.complete() {
+		d.remove(datagram)
+		return datagram.reassemble(), datagram.overlap
+	}
+	for d.size > d.maxBytes {
+		log.Print("fragment buffer full; dropping the oldest incomplete IPv4 datagram")
+		d.abandon(d.lru.Front().Value.(*ipv4Datagram))
+	}
+	return nil, nil
+}
+
+// expire drops the datagrams which have not seen a fragment within
+// the timeout duration prior to now.
+func (d *ipv4Defragmenter) expire(now time.Time) {
+	for e := d.lru.Front(); e != nil; e = d.lru.Front() {
+		datagram := e.Value.(*ipv4Datagram)
+		if now.Sub(datagram.lastSeen) <= d.timeout {
+			return
+		}
+		d.abandon(datagram)
+	}
+}
+
+// abandon drops an incomplete datagram, keeping it in abandoned if its
+// fragments overlapped with conflicting contents
+func (d *ipv4Defragmenter) abandon(datagram *ipv4Datagram) {
+	if datagram.overlap != nil {
+		log.Printf("incomplete IPv4 datagram %d from %s to %s with conflicting fragment overlap dropped", datagram.key.id, net.IP(datagram.key.src[:]), net.IP(datagram.key.dst[:]))
+		d.abandoned = append(d.abandoned, datagram)
+	}
+	d.remove(datagram)
+}
+
+// takeAbandoned returns the abandoned datagrams and forgets them
+func (d *ipv4Defragmenter) takeAbandoned() []*ipv4Datagram {
+	abandoned := d.abandoned
+	d.abandoned = nil
+	return abandoned
+}
+
+func (d *ipv4Defragmenter) remove(datagram *ipv4Datagram) {
+	d.lru.Remove(datagram.element)
+	delete(d.datagrams, datagram.key)
+	d.size -= datagram.size
+}
+
+// overlapEvent returns the report of the conflicting overlap of an
+// abandoned datagram. Its ports, sequence number and the position of
+// the overlap within the TCP payload are only known if the fragment
+// holding the TCP header arrived.
+func (g *ipv4Datagram) overlapEvent() *types.Event {
+	var ports [4]byte
+	var seq uint32
+	headerLength := -1
+	for _, fragment := range g.fragments {
+		if fragment.offset == 0 && g.key.protocol == layers.IPProtocolTCP && len(fragment.data) >= 13 {
+			copy(ports[:], fragment.data[0:4])
+			seq = binary.BigEndian.Uint32(fragment.data[4:8])
+			headerLength = int(fragment.data[12]>>4) * 4
+			break
+		}
+	}
+	flow := types.NewTcpIpFlowFromFlows(
+		gopacket.NewFlow(layers.EndpointIPv4, g.key.src[:], g.key.dst[:]),
+		gopacket.NewFlow(layers.EndpointTCPPort, ports[0:2], ports[2:4]))
+	event := &types.Event{
+		Kind:          types.EventIPFragmentOverlap,
+		Flow:          flow,
+		Time:          g.lastSeen,
+		Payload:       g.overlap.Conflict,
+		Overlap:       g.overlap.Original,
+		StartSequence: types.Sequence(seq),
+	}
+	if headerLength >= 0 {
+		event.OverlapStart, event.OverlapEnd = tcpPayloadOverlap(g.overlap, headerLength)
+	}
+	return event
+}
+
+// tcpPayloadOverlap returns the range of the overlap within the TCP
+// payload of its datagram, whose TCP header is headerLength bytes long,
+// as the overlaps of injection events are reported. Both are zero if
+// the overlap lies within the TCP header.
+func tcpPayloadOverlap(overlap *types.FragmentOverlap, headerLength int) (start, end int) {
+	start = overlap.Offset - headerLength
+	end = start + len(overlap.Original)
+	if end <= 0 {
+		return 0, 0
+	}
+	if start < 0 {
+		start = 0
+	}
+	return start, end
+}
+
+// complete returns true if the fragments received so far
+// cover the whole datagram from the first to the last byte.
+func (g *ipv4Datagram) complete() bool {
+	if g.header == nil || g.length == -1 {
+		return false
+	}
+	covered := 0
+	for covered < g.length {
+		next := covered
+		for _, fragment := range g.fragments {
+			if fragment.offset <= covered && fragment.offset+len(fragment.data) > next {
+				next = fragment.offset + len(fragment.data)
+			}
+		}
+		if next == covered {
+			return false
+		}
+		covered = next
+	}
+	return true
+}
+
+// reassemble returns the link header followed by the reassembled
+// datagram, whose IPv4 header is rewritten to describe a whole datagram.
+func (g *ipv4Datagram) reassemble() []byte {
+	headerStart := len(g.linkHeader)
+	payloadStart := headerStart + len(g.header)
+	frame := make([]byte, payloadStart+g.length)
+	copy(frame, g.linkHeader)
+	copy(frame[headerStart:], g.header)
+	// copy the latest fragments first so that the earliest ones win
+	for i := len(g.fragments) - 1; i >= 0; i-- {
+		fragment := g.fragments[i]
+		if fragment.offset >= g.length {
+			continue
+		}
+		copy(frame[payloadStart+fragment.offset:], fragment.data)
+	}
+
+	header := frame[headerStart:payloadStart]
+	binary.BigEndian.PutUint16(header[2:4], uint16(len(header)+g.length))
+	// keep the don't fragment flag, clear more fragments and the offset
+	header[6] &= byte(layers.IPv4DontFragment) << 5
+	header[7] = 0
+	header[10], header[11] = 0, 0
+	binary.BigEndian.PutUint16(header[10:12], ipv4HeaderChecksum(header))
+	return frame
+}
+
+// ipv4HeaderChecksum returns the internet checksum of an IPv4 header
+// whose checksum field is zeroed.
+func ipv4HeaderChecksum(header []byte) uint16 {
+	return foldChecksum(onesComplementSum(0, header))
+}
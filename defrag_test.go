@@ -0,0 +1,192 @@
+package HoneyBadger
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/david415/HoneyBadger/types"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+var testFragmentPayload = []byte("ABCDEFGHIJKLMNOPQRSTUVWX")
+
+// makeTestTcpSegment returns a TCP header followed by testFragmentPayload
+func makeTestTcpSegment(t *testing.T) []byte {
+	ip := layers.IPv4{
+		SrcIP:    net.IP{1, 2, 3, 4},
+		DstIP:    net.IP{2, 3, 4, 5},
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolTCP,
+	}
+	tcp := layers.TCP{
+		SrcPort: 1,
+		DstPort: 2,
+		Seq:     1234,
+		ACK:     true,
+	}
+	tcp.SetNetworkLayerForChecksum(&ip)
+	return serializeTestLayers(t, &tcp, gopacket.Payload(testFragmentPayload))
+}
+
+// makeTestFragmentFrame returns an Ethernet frame carrying an IPv4 fragment
+// with the given data at the given byte offset into the datagram's payload
+func makeTestFragmentFrame(t *testing.T, id uint16, offset int, more bool, data []byte) []byte {
+	ip := layers.IPv4{
+		SrcIP:      net.IP{1, 2, 3, 4},
+		DstIP:      net.IP{2, 3, 4, 5},
+		Version:    4,
+		IHL:        5,
+		TTL:        64,
+		Id:         id,
+		FragOffset: uint16(offset / 8),
+		Protocol:   layers.IPProtocolTCP,
+	}
+	if more {
+		ip.Flags = layers.IPv4MoreFragments
+	}
+	eth := layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0xde, 0xad, 0xbe, 0xee, 0xee, 0xff},
+		DstMAC:       net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	datagram := serializeTestLayers(t, &ip, gopacket.Payload(data))
+	return serializeTestLayers(t, &eth, gopacket.Payload(datagram))
+}
+
+func TestDefragmentInOrder(t *testing.T) {
+	segment := makeTestTcpSegment(t)
+	first := makeTestFragmentFrame(t, 1, 0, true, segment[:24])
+	last := makeTestFragmentFrame(t, 1, 24, false, segment[24:])
+
+	decoder := newPacketDecoder(SnifferOptions{})
+	if p := decoder.Decode(TimedRawPacket{time.Now(), layers.LinkTypeEthernet, first}); p != nil {
+		t.Fatal("decoded an incomplete datagram")
+	}
+	p := decoder.Decode(TimedRawPacket{time.Now(), layers.LinkTypeEthernet, last})
+	if p == nil {
+		t.Fatal("failed to reassemble datagram")
+	}
+	if p.TCP.Seq != 1234 || !bytes.Equal(p.Payload, testFragmentPayload) {
+		t.Errorf("bad reassembly: seq %d payload %q", p.TCP.Seq, []byte(p.Payload))
+	}
+	if p.Flow.String() != "1.2.3.4:1-2.3.4.5:2" {
+		t.Errorf("bad flow %s", p.Flow)
+	}
+	if p.FragmentOverlap != nil {
+		t.Error("reported an overlap for disjoint fragments")
+	}
+	if isIPv4Fragment(&p.IP) || int(p.IP.Length) != 20+len(segment) {
+		t.Errorf("reassembled header not rewritten: flags %s offset %d length %d", p.IP.Flags, p.IP.FragOffset, p.IP.Length)
+	}
+	if len(decoder.defragmenter.datagrams) != 0 || decoder.defragmenter.size != 0 {
+		t.Error("completed datagram is still buffered")
+	}
+}
+
+func TestDefragmentOutOfOrder(t *testing.T) {
+	segment := makeTestTcpSegment(t)
+	decoder := newPacketDecoder(SnifferOptions{})
+	frames := [][]byte{
+		makeTestFragmentFrame(t, 2, 32, false, segment[32:]),
+		makeTestFragmentFrame(t, 2, 16, true, segment[16:32]),
+		makeTestFragmentFrame(t, 2, 0, true, segment[:16]),
+	}
+	for _, frame := range frames[:2] {
+		if p := decoder.Decode(TimedRawPacket{time.Now(), layers.LinkTypeEthernet, frame}); p != nil {
+			t.Fatal("decoded an incomplete datagram")
+		}
+	}
+	p := decoder.Decode(TimedRawPacket{time.Now(), layers.LinkTypeEthernet, frames[2]})
+	if p == nil || !bytes.Equal(p.Payload, testFragmentPayload) {
+		t.Fatalf("bad reassembly %v", p)
+	}
+}
+
+func TestDefragmentOverlap(t *testing.T) {
+	segment := makeTestTcpSegment(t)
+
+	// an identical retransmission of overlapping bytes is harmless
+	decoder := newPacketDecoder(SnifferOptions{})
+	decoder.Decode(TimedRawPacket{time.Now(), layers.LinkTypeEthernet, makeTestFragmentFrame(t, 3, 0, true, segment[:32])})
+	decoder.Decode(TimedRawPacket{time.Now(), layers.LinkTypeEthernet, makeTestFragmentFrame(t, 3, 24, true, segment[24:40])})
+	p := decoder.Decode(TimedRawPacket{time.Now(), layers.LinkTypeEthernet, makeTestFragmentFrame(t, 3, 40, false, segment[40:])})
+	if p == nil || p.FragmentOverlap != nil {
+		t.Fatalf("identical overlap mishandled: %v", p)
+	}
+
+	// a conflicting overlap is reported and the first received bytes win
+	conflict := []byte("xxxxxxxx")
+	decoder.Decode(TimedRawPacket{time.Now(), layers.LinkTypeEthernet, makeTestFragmentFrame(t, 4, 0, true, segment[:32])})
+	decoder.Decode(TimedRawPacket{time.Now(), layers.LinkTypeEthernet, makeTestFragmentFrame(t, 4, 24, true, conflict)})
+	p = decoder.Decode(TimedRawPacket{time.Now(), layers.LinkTypeEthernet, makeTestFragmentFrame(t, 4, 32, false, segment[32:])})
+	if p == nil {
+		t.Fatal("failed to reassemble overlapping fragments")
+	}
+	if !bytes.Equal(p.Payload, testFragmentPayload) {
+		t.Errorf("later fragment overwrote earlier bytes: %q", []byte(p.Payload))
+	}
+	overlap := p.FragmentOverlap
+	if overlap == nil {
+		t.Fatal("conflicting overlap not reported")
+	}
+	if overlap.Offset != 24 || !bytes.Equal(overlap.Original, segment[24:32]) || !bytes.Equal(overlap.Conflict, conflict) {
+		t.Errorf("bad overlap %+v", overlap)
+	}
+}
+
+func TestDefragmentTimeout(t *testing.T) {
+	segment := makeTestTcpSegment(t)
+	decoder := newPacketDecoder(SnifferOptions{FragmentTimeout: time.Second})
+	start := time.Now()
+	decoder.Decode(TimedRawPacket{start, layers.LinkTypeEthernet, makeTestFragmentFrame(t, 5, 0, true, segment[:24])})
+	p := decoder.Decode(TimedRawPacket{start.Add(2 * time.Second), layers.LinkTypeEthernet, makeTestFragmentFrame(t, 5, 24, false, segment[24:])})
+	if p != nil {
+		t.Error("reassembled a datagram from an expired fragment")
+	}
+	if len(decoder.defragmenter.datagrams) != 1 || decoder.defragmenter.size != len(segment)-24 {
+		t.Errorf("expired fragment still buffered: %d bytes", decoder.defragmenter.size)
+	}
+}
+
+func TestDefragmentMaxBytes(t *testing.T) {
+	segment := makeTestTcpSegment(t)
+	decoder := newPacketDecoder(SnifferOptions{MaxFragmentBytes: 40})
+	decoder.Decode(TimedRawPacket{time.Now(), layers.LinkTypeEthernet, makeTestFragmentFrame(t, 6, 0, true, segment[:24])})
+	decoder.Decode(TimedRawPacket{time.Now(), layers.LinkTypeEthernet, makeTestFragmentFrame(t, 7, 0, true, segment[:24])})
+	if len(decoder.defragmenter.datagrams) != 1 || decoder.defragmenter.size != 24 {
+		t.Fatalf("fragment buffer exceeded its bound: %d bytes", decoder.defragmenter.size)
+	}
+	p := decoder.Decode(TimedRawPacket{time.Now(), layers.LinkTypeEthernet, makeTestFragmentFrame(t, 7, 24, false, segment[24:])})
+	if p == nil || !bytes.Equal(p.Payload, testFragmentPayload) {
+		t.Error("failed to reassemble the most recent datagram")
+	}
+}
+
+func TestDefragmentAbandonedOverlap(t *testing.T) {
+	segment := makeTestTcpSegment(t)
+	attackLogger := NewDummyAttackLogger()
+	decoder := newPacketDecoder(SnifferOptions{FragmentTimeout: time.Second, AttackLogger: attackLogger})
+	start := time.Now()
+	decoder.Decode(TimedRawPacket{start, layers.LinkTypeEthernet, makeTestFragmentFrame(t, 8, 0, true, segment[:32])})
+	decoder.Decode(TimedRawPacket{start, layers.LinkTypeEthernet, makeTestFragmentFrame(t, 8, 24, true, []byte("xxxxxxxx"))})
+	if attackLogger.Count != 0 {
+		t.Fatal("reported an overlap before the datagram was dropped")
+	}
+
+	// the datagram never completes, yet its overlap is reported on expiry
+	decoder.Decode(TimedRawPacket{start.Add(2 * time.Second), layers.LinkTypeEthernet, makeTestFragmentFrame(t, 9, 0, true, segment[:24])})
+	if attackLogger.Count != 1 {
+		t.Fatalf("abandoned overlap not reported; %d events", attackLogger.Count)
+	}
+	event := attackLogger.LastEvent
+	if event.Kind != types.EventIPFragmentOverlap || event.Flow.String() != "1.2.3.4:1-2.3.4.5:2" || event.StartSequence != 1234 {
+		t.Errorf("bad event %s %s sequence %d", event.Kind, event.Flow, event.StartSequence)
+	}
+	if event.OverlapStart != 4 || event.OverlapEnd != 12 || !bytes.Equal(event.Overlap, testFragmentPayload[4:12]) || !event.Time.Equal(start) {
+		t.Errorf("bad overlap %d-%d %q at %s", event.OverlapStart, event.OverlapEnd, event.Overlap, event.Time)
+	}
+}
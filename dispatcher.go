@@ -20,14 +20,20 @@
 package HoneyBadger
 
 import (
+	"errors"
 	"log"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/google/gopacket/layers"
+
 	"github.com/david415/HoneyBadger/types"
 )
 
 type TimedRawPacket struct {
 	Timestamp time.Time
+	LinkType  layers.LinkType
 	RawPacket []byte
 }
 
@@ -43,92 +49,320 @@ type DispatcherOptions struct {
 	MaxPcapLogSize           int
 	TcpIdleTimeout           time.Duration
 	MaxRingPackets           int
+	MaxRingBytes             int
+	MaxRingAge               time.Duration
 	Logger                   types.Logger
 	DetectHijack             bool
 	DetectInjection          bool
 	DetectCoalesceInjection  bool
+	DetectHeaderAnomalies    bool
+	TTLTolerance             int
+	IPIDTolerance            int
 	MaxConcurrentConnections int
+	// Clock drives idle timeouts and the times of events which no packet
+	// raised, e.g. on timeouts; a *types.PacketClock is advanced by the
+	// dispatched packets. nil selects the wall clock.
+	Clock types.Clock
+	// Shards is the number of goroutines tracking connections in
+	// parallel, each with its own share of the connections; values
+	// below 2 track all connections in a single goroutine.
+	Shards int
+	// Policy decides which new connections are tracked; nil tracks
+	// all of them. ReloadFlowPolicy reads it again from PolicyFile.
+	Policy     *FlowPolicy
+	PolicyFile string
+	// RingMemoryBudget bounds the bytes held by the stream rings of
+	// all connections together; zero leaves them unbounded.
+	RingMemoryBudget int
+}
+
+// connectionPool holds the connections of one dispatcher shard. It is
+// locked since connections remove themselves from it when they close and
+// Connections may be called from any goroutine. count is shared by the
+// pools of all shards; it includes the connections reserved but not
+// yet put.
+type connectionPool struct {
+	sync.Mutex
+	connections map[types.ConnectionKey]ConnectionInterface
+	count       *int64
+}
+
+func newConnectionPool(count *int64) *connectionPool {
+	return &connectionPool{
+		connections: make(map[types.ConnectionKey]ConnectionInterface),
+		count:       count,
+	}
+}
+
+func (p *connectionPool) get(key types.ConnectionKey) (ConnectionInterface, bool) {
+	p.Lock()
+	defer p.Unlock()
+	conn, ok := p.connections[key]
+	return conn, ok
+}
+
+// reserve counts a connection about to be put into the pool, unless the
+// pools of all shards hold max connections already; zero max is
+// unbounded. The count is compared and swapped so that shards setting
+// up connections at once cannot exceed max together.
+func (p *connectionPool) reserve(max int) bool {
+	for {
+		count := atomic.LoadInt64(p.count)
+		if max != 0 && count >= int64(max) {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(p.count, count, count+1) {
+			return true
+		}
+	}
+}
+
+// put adds a connection reserved with reserve
+func (p *connectionPool) put(key types.ConnectionKey, conn ConnectionInterface) {
+	p.Lock()
+	defer p.Unlock()
+	if _, ok := p.connections[key]; ok {
+		// the replaced connection is counted already
+		atomic.AddInt64(p.count, -1)
+	}
+	p.connections[key] = conn
+}
+
+func (p *connectionPool) remove(key types.ConnectionKey) {
+	p.Lock()
+	defer p.Unlock()
+	if _, ok := p.connections[key]; ok {
+		atomic.AddInt64(p.count, -1)
+		delete(p.connections, key)
+	}
+}
+
+// list returns a snapshot of the connections in the pool
+func (p *connectionPool) list() []ConnectionInterface {
+	p.Lock()
+	defer p.Unlock()
+	conns := make([]ConnectionInterface, 0, len(p.connections))
+	for _, conn := range p.connections {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+// dispatcherShard tracks the connections whose ConnectionHash selects
+// it in its own goroutine. Its page cache is only used by its own
+// connections, hence needs no locking. A value on timeoutChan asks it
+// to close its idle connections.
+type dispatcherShard struct {
+	dispatcher         *Dispatcher
+	pool               *connectionPool
+	pageCache          *pageCache
+	dispatchPacketChan chan *types.PacketManifest
+	stopDispatchChan   chan bool
+	timeoutChan        chan bool
 }
 
-// Inquisitor sets up the connection pool and is an abstraction layer for dealing
+// Dispatcher sets up the connection pool and is an abstraction layer for dealing
 // with incoming packets weather they be from a pcap file or directly off the wire.
+// Connections are spread over shards by their ConnectionHash so that both
+// directions of a connection are always tracked by the same shard.
 type Dispatcher struct {
 	options                DispatcherOptions
 	connectionFactory      ConnectionFactory
+	observeMutex           sync.Mutex
 	observeConnectionCount int
 	observeConnectionChan  chan bool
-	dispatchPacketChan     chan *types.PacketManifest
-	stopDispatchChan       chan bool
-	closeConnectionChan    chan ConnectionInterface
-	pageCache              *pageCache
+	connectionCount        int64
+	shards                 []*dispatcherShard
 	PacketLoggerFactory    types.PacketLoggerFactory
-	pool                   map[types.ConnectionHash]ConnectionInterface
+	clock                  types.Clock
+	policyMutex            sync.RWMutex
+	policy                 *FlowPolicy
+	ringBudget             *types.RingBudget
+	// timeoutMutex guards nextTimeoutCheck, the packet clock time at
+	// which the shards are next asked to close their idle connections
+	timeoutMutex     sync.Mutex
+	nextTimeoutCheck time.Time
+	// stoppedChan is closed once the dispatcher is stopped, packets
+	// received afterwards are dropped
+	stoppedChan chan bool
 }
 
-// NewInquisitor creates a new Inquisitor struct
+// NewDispatcher creates a new Dispatcher struct
 func NewDispatcher(options DispatcherOptions, connectionFactory ConnectionFactory, packetLoggerFactory types.PacketLoggerFactory) *Dispatcher {
 	i := Dispatcher{
 		PacketLoggerFactory:   packetLoggerFactory,
 		connectionFactory:     connectionFactory,
 		options:               options,
-		dispatchPacketChan:    make(chan *types.PacketManifest),
-		stopDispatchChan:      make(chan bool),
-		closeConnectionChan:   make(chan ConnectionInterface),
-		pageCache:             newPageCache(),
-		observeConnectionChan: make(chan bool, 0),
-		pool: make(map[types.ConnectionHash]ConnectionInterface),
+		observeConnectionChan: make(chan bool, 1),
+		clock:                 options.Clock,
+		policy:                options.Policy,
+		stoppedChan:           make(chan bool),
+	}
+	if i.clock == nil {
+		i.clock = types.WallClock{}
+	}
+	if options.RingMemoryBudget > 0 {
+		i.ringBudget = types.NewRingBudget(options.RingMemoryBudget)
+	}
+	shards := options.Shards
+	if shards < 1 {
+		shards = 1
+	}
+	i.shards = make([]*dispatcherShard, shards)
+	for n := range i.shards {
+		i.shards[n] = &dispatcherShard{
+			dispatcher:         &i,
+			pool:               newConnectionPool(&i.connectionCount),
+			pageCache:          newPageCache(),
+			dispatchPacketChan: make(chan *types.PacketManifest),
+			stopDispatchChan:   make(chan bool),
+			timeoutChan:        make(chan bool, 1),
+		}
 	}
 	return &i
 }
 
+// GetObservedConnectionsChan returns a channel which receives a value once
+// the given number of connections are tracked. If they already are then
+// the value is ready to be received right away.
 func (i *Dispatcher) GetObservedConnectionsChan(count int) chan bool {
+	i.observeMutex.Lock()
+	defer i.observeMutex.Unlock()
 	i.observeConnectionCount = count
+	i.notifyObservers()
 	return i.observeConnectionChan
 }
 
+// notifyObservers tells the observer once the number of connections it
+// waits for is reached; observeMutex must be held.
+func (i *Dispatcher) notifyObservers() {
+	if i.observeConnectionCount != 0 && int64(i.observeConnectionCount) == atomic.LoadInt64(&i.connectionCount) {
+		select {
+		case i.observeConnectionChan <- true:
+		default:
+		}
+	}
+}
+
 // Start... starts the TCP attack inquisition!
 func (i *Dispatcher) Start() {
-	go i.dispatchPackets()
+	for _, shard := range i.shards {
+		go shard.dispatchPackets()
+	}
 }
 
 // Stop... stops the TCP attack inquisition!
 func (i *Dispatcher) Stop() {
-	i.stopDispatchChan <- true
+	close(i.stoppedChan)
+	for _, shard := range i.shards {
+		shard.stopDispatchChan <- true
+	}
 	closedConns := i.CloseAllConnections()
 	log.Printf("%d connection(s) closed.", closedConns)
 }
 
-// connectionsLocked returns a slice of Connection pointers.
+// SetFlowPolicy replaces the policy deciding which new connections are
+// tracked. Connections which are already tracked are not affected.
+func (i *Dispatcher) SetFlowPolicy(policy *FlowPolicy) {
+	i.policyMutex.Lock()
+	defer i.policyMutex.Unlock()
+	i.policy = policy
+}
+
+func (i *Dispatcher) flowPolicy() *FlowPolicy {
+	i.policyMutex.RLock()
+	defer i.policyMutex.RUnlock()
+	return i.policy
+}
+
+// ReloadFlowPolicy reads the flow policy from the PolicyFile option
+// again. The current policy is kept if the file cannot be loaded.
+func (i *Dispatcher) ReloadFlowPolicy() error {
+	if i.options.PolicyFile == "" {
+		return errors.New("no flow policy file to reload")
+	}
+	policy, err := LoadFlowPolicy(i.options.PolicyFile)
+	if err != nil {
+		return err
+	}
+	i.SetFlowPolicy(policy)
+	log.Printf("loaded %d flow policy rule(s) from %s", len(policy.Rules), i.options.PolicyFile)
+	return nil
+}
+
+// Connections returns a slice of the connections of all shards.
 func (i *Dispatcher) Connections() []ConnectionInterface {
 	return i.connections()
 }
 
+// ConnectionCount returns the number of connections being tracked
+func (i *Dispatcher) ConnectionCount() int {
+	return int(atomic.LoadInt64(&i.connectionCount))
+}
+
 func (i *Dispatcher) connections() []ConnectionInterface {
-	conns := make([]ConnectionInterface, 0, len(i.pool))
-	for _, conn := range i.pool {
-		conns = append(conns, conn)
+	var conns []ConnectionInterface
+	for _, shard := range i.shards {
+		conns = append(conns, shard.pool.list()...)
 	}
 	return conns
 }
 
+// shard returns the shard tracking the connection with the given hash
+func (i *Dispatcher) shard(hash types.ConnectionHash) *dispatcherShard {
+	if len(i.shards) == 1 {
+		return i.shards[0]
+	}
+	return i.shards[(hash.IpFlowHash^hash.TcpFlowHash)%uint64(len(i.shards))]
+}
+
+// ReceivePacket hands the packet to the shard tracking its connection.
+// Packet sources may still be running when the dispatcher is stopped,
+// hence the packet is dropped rather than blocking them forever.
 func (i *Dispatcher) ReceivePacket(p *types.PacketManifest) {
-	i.dispatchPacketChan <- p
+	i.advanceClock(p)
+	select {
+	case i.shard(p.Flow.ConnectionHash()).dispatchPacketChan <- p:
+	case <-i.stoppedChan:
+	}
+}
+
+// advanceClock advances a packet clock to the time of the packet. Once
+// per idle timeout of packet time, every shard is asked to close its idle
+// connections, including the shards which no longer receive packets.
+func (i *Dispatcher) advanceClock(p *types.PacketManifest) {
+	packetClock, ok := i.clock.(*types.PacketClock)
+	if !ok {
+		return
+	}
+	packetClock.Advance(p.Timestamp)
+	if i.options.TcpIdleTimeout <= 0 {
+		return
+	}
+	now := packetClock.Now()
+	i.timeoutMutex.Lock()
+	defer i.timeoutMutex.Unlock()
+	if now.Before(i.nextTimeoutCheck) {
+		return
+	}
+	if !i.nextTimeoutCheck.IsZero() {
+		for _, shard := range i.shards {
+			select {
+			case shard.timeoutChan <- true:
+			default:
+				// the shard has yet to handle the previous request
+			}
+		}
+	}
+	i.nextTimeoutCheck = now.Add(i.options.TcpIdleTimeout)
 }
 
 // CloseOlderThan takes a Time argument and closes all the connections
 // that have not received packet since that specified time
 func (i *Dispatcher) CloseOlderThan(t time.Time) int {
 	closed := 0
-	conns := i.connections()
-	if conns == nil {
-		return 0
-	}
-	for _, conn := range conns {
-		lastSeen := conn.GetLastSeen()
-		if lastSeen.Equal(t) || lastSeen.Before(t) {
-			conn.Close()
-			closed += 1
-		}
+	for _, shard := range i.shards {
+		closed += shard.closeOlderThan(t)
 	}
 	return closed
 }
@@ -147,62 +381,121 @@ func (i *Dispatcher) CloseAllConnections() int {
 	return count
 }
 
-func (i *Dispatcher) setupNewConnection(flow *types.TcpIpFlow) ConnectionInterface {
+// closeOlderThan closes the connections of the shard that have not
+// received a packet since the given time
+func (s *dispatcherShard) closeOlderThan(t time.Time) int {
+	closed := 0
+	for _, conn := range s.pool.list() {
+		lastSeen := conn.GetLastSeen()
+		if lastSeen.Equal(t) || lastSeen.Before(t) {
+			conn.Close()
+			closed += 1
+		}
+	}
+	return closed
+}
+
+// closeIdleConnections closes the connections which have not received
+// a packet within the idle timeout
+func (s *dispatcherShard) closeIdleConnections() {
+	i := s.dispatcher
+	closed := s.closeOlderThan(i.clock.Now().Add(i.options.TcpIdleTimeout * -1))
+	if closed != 0 {
+		log.Printf("timeout closed %d connections\n", closed)
+	}
+}
+
+// setupNewConnection tracks a new connection of the given flow, whose
+// slot in the pool is reserved, as the given policy action allows
+func (s *dispatcherShard) setupNewConnection(flow *types.TcpIpFlow, linkType layers.LinkType, action PolicyAction) ConnectionInterface {
+	i := s.dispatcher
+	// every shard buffers its share of the total pages
+	bufferedTotal := i.options.BufferedTotal
+	if bufferedTotal > 0 {
+		bufferedTotal = (bufferedTotal + len(i.shards) - 1) / len(i.shards)
+	}
+	logPackets := i.options.LogPackets && action != PolicyTrackWithoutPayloads
 	options := ConnectionOptions{
-		MaxBufferedPagesTotal:         i.options.BufferedTotal,
+		MaxBufferedPagesTotal:         bufferedTotal,
 		MaxBufferedPagesPerConnection: i.options.BufferedPerConnection,
 		MaxRingPackets:                i.options.MaxRingPackets,
-		PageCache:                     i.pageCache,
+		MaxRingBytes:                  i.options.MaxRingBytes,
+		MaxRingAge:                    i.options.MaxRingAge,
+		RingBudget:                    i.ringBudget,
+		PageCache:                     s.pageCache,
 		LogDir:                        i.options.LogDir,
 		AttackLogger:                  i.options.Logger,
-		LogPackets:                    i.options.LogPackets,
+		LogPackets:                    logPackets,
+		OmitPayloads:                  action == PolicyTrackWithoutPayloads,
 		DetectHijack:                  i.options.DetectHijack,
 		DetectInjection:               i.options.DetectInjection,
 		DetectCoalesceInjection:       i.options.DetectCoalesceInjection,
-		Pool: &i.pool,
+		DetectHeaderAnomalies:         i.options.DetectHeaderAnomalies,
+		TTLTolerance:                  i.options.TTLTolerance,
+		IPIDTolerance:                 i.options.IPIDTolerance,
+		Pool:                          s.pool,
+		Clock:                         i.clock,
 	}
 
 	conn := i.connectionFactory.Build(options)
-	if i.options.LogPackets {
-		packetLogger := i.PacketLoggerFactory.Build(flow)
+	if logPackets {
+		packetLogger := i.PacketLoggerFactory.Build(flow, linkType)
 		conn.SetPacketLogger(packetLogger)
 		packetLogger.Start()
 	}
 
-	i.pool[flow.ConnectionHash()] = conn
-	if i.observeConnectionCount != 0 && i.observeConnectionCount == len(i.connections()) {
-		i.observeConnectionChan <- true
-	}
+	s.pool.put(flow.ConnectionKey(), conn)
+	i.observeMutex.Lock()
+	i.notifyObservers()
+	i.observeMutex.Unlock()
 	return conn
 }
 
-func (i *Dispatcher) dispatchPackets() {
-	var conn ConnectionInterface
-	timeout := i.options.TcpIdleTimeout
-	ticker := time.Tick(timeout)
+func (s *dispatcherShard) dispatchPackets() {
+	i := s.dispatcher
+	// a packet clock only moves with the packets, so the dispatcher
+	// requests its timeout checks on timeoutChan
+	var ticker <-chan time.Time
+	if _, isPacketClock := i.clock.(*types.PacketClock); !isPacketClock {
+		ticker = time.Tick(i.options.TcpIdleTimeout)
+	}
 
 	for {
 		select {
 		case <-ticker:
-			closed := i.CloseOlderThan(time.Now().Add(timeout * -1))
-			if closed != 0 {
-				log.Printf("timeout closed %d connections\n", closed)
-			}
-		case <-i.stopDispatchChan:
+			s.closeIdleConnections()
+		case <-s.timeoutChan:
+			s.closeIdleConnections()
+		case <-s.stopDispatchChan:
 			return
-		case packetManifest := <-i.dispatchPacketChan:
-			_, ok := i.pool[packetManifest.Flow.ConnectionHash()]
-			if ok {
-				conn = i.pool[packetManifest.Flow.ConnectionHash()]
-			} else {
-				if i.options.MaxConcurrentConnections != 0 {
-					if len(i.pool) >= i.options.MaxConcurrentConnections {
-						continue
-					}
-				}
-				conn = i.setupNewConnection(packetManifest.Flow)
+		case packetManifest := <-s.dispatchPacketChan:
+			s.dispatchPacket(packetManifest)
+			// the dispatcher requests a timeout check before handing
+			// over the packet which passed it, hence idle connections
+			// are closed by the time that packet was dispatched
+			select {
+			case <-s.timeoutChan:
+				s.closeIdleConnections()
+			default:
 			}
-			conn.ReceivePacket(packetManifest)
 		}
 	}
 }
+
+// dispatchPacket hands the packet to its connection, setting one up if
+// the flow policy and MaxConcurrentConnections allow
+func (s *dispatcherShard) dispatchPacket(p *types.PacketManifest) {
+	i := s.dispatcher
+	conn, ok := s.pool.get(p.Flow.ConnectionKey())
+	if !ok {
+		action := i.flowPolicy().Action(policyClientFlow(p))
+		if action == PolicyIgnore {
+			return
+		}
+		if !s.pool.reserve(i.options.MaxConcurrentConnections) {
+			return
+		}
+		conn = s.setupNewConnection(p.Flow, p.LinkType, action)
+	}
+	conn.ReceivePacket(p)
+}
@@ -9,6 +9,7 @@ import (
 
 	"github.com/david415/HoneyBadger/logging"
 	"github.com/david415/HoneyBadger/types"
+	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 )
 
@@ -57,8 +58,8 @@ func (m MockConnection) ReceivePacket(p *types.PacketManifest) {
 	m.packetObserverChan <- true
 }
 
-func (m MockConnection) GetConnectionHash() types.ConnectionHash {
-	return m.clientFlow.ConnectionHash()
+func (m MockConnection) GetConnectionKey() types.ConnectionKey {
+	return m.clientFlow.ConnectionKey()
 }
 
 func (m MockConnection) GetLastSeen() time.Time {
@@ -86,7 +87,7 @@ type MockPacketLoggerFactory struct {
 	pcapSize int
 }
 
-func (f MockPacketLoggerFactory) Build(flow *types.TcpIpFlow) types.PacketLogger {
+func (f MockPacketLoggerFactory) Build(flow *types.TcpIpFlow, linkType layers.LinkType) types.PacketLogger {
 	return NewMockPacketLogger("str", flow, 10, 50)
 }
 
@@ -319,3 +320,194 @@ func SetupRealConnectionInquisitor() (*BadgerSupervisor, PacketDispatcher, types
 	<-startedChan
 	return supervisor, dispatcher, sniffer
 }
+
+// makeTestPortFlow returns the flow of the given IPv4 layer and TCP ports;
+// unlike the TransportFlow of a TCP layer which was not decoded, it
+// distinguishes the ports
+func makeTestPortFlow(ip layers.IPv4, srcPort, dstPort uint16) *types.TcpIpFlow {
+	src := []byte{byte(srcPort >> 8), byte(srcPort)}
+	dst := []byte{byte(dstPort >> 8), byte(dstPort)}
+	return types.NewTcpIpFlowFromFlows(ip.NetworkFlow(), gopacket.NewFlow(layers.EndpointTCPPort, src, dst))
+}
+
+// newTestDispatcher returns a dispatcher with the given options building
+// connections which time out after a minute of idleness
+func newTestDispatcher(options DispatcherOptions) *Dispatcher {
+	options.TcpIdleTimeout = time.Minute
+	options.MaxRingPackets = 40
+	options.Logger = NewDummyAttackLogger()
+	return NewDispatcher(options, &DefaultConnFactory{}, MockPacketLoggerFactory{})
+}
+
+// makeTestSYN returns a SYN sent from the given port of 1.2.3.4 to the
+// given port of 2.3.4.5
+func makeTestSYN(srcPort, dstPort uint16, timestamp time.Time) *types.PacketManifest {
+	ip := layers.IPv4{
+		SrcIP:    net.IP{1, 2, 3, 4},
+		DstIP:    net.IP{2, 3, 4, 5},
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolTCP,
+	}
+	return &types.PacketManifest{
+		Timestamp: timestamp,
+		Flow:      makeTestPortFlow(ip, srcPort, dstPort),
+		IP:        ip,
+		TCP: layers.TCP{
+			Seq:     3,
+			SYN:     true,
+			SrcPort: layers.TCPPort(srcPort),
+			DstPort: layers.TCPPort(dstPort),
+		},
+	}
+}
+
+func TestDispatcherPacketClockIdleTimeout(t *testing.T) {
+	dispatcher := newTestDispatcher(DispatcherOptions{Clock: types.NewPacketClock()})
+	dispatcher.Start()
+
+	start := time.Unix(1500000000, 0)
+	// a day long capture replayed in no time still times out idle connections
+	dispatcher.ReceivePacket(makeTestSYN(1, 2, start))
+	dispatcher.ReceivePacket(makeTestSYN(2, 2, start.Add(30*time.Second)))
+	dispatcher.ReceivePacket(makeTestSYN(3, 2, start.Add(24*time.Hour)))
+	dispatcher.shards[0].stopDispatchChan <- true
+
+	conns := dispatcher.Connections()
+	if len(conns) != 1 {
+		t.Fatalf("%d connections left; idle connections not closed", len(conns))
+	}
+	for _, conn := range conns {
+		if !conn.GetLastSeen().Equal(start.Add(24 * time.Hour)) {
+			t.Errorf("the wrong connection survived the timeout: last seen %s", conn.GetLastSeen())
+		}
+	}
+	if now := dispatcher.clock.Now(); !now.Equal(start.Add(24 * time.Hour)) {
+		t.Errorf("packet clock at %s", now)
+	}
+}
+
+func TestShardedDispatcher(t *testing.T) {
+	dispatcher := newTestDispatcher(DispatcherOptions{Shards: 4})
+	connsChan := dispatcher.GetObservedConnectionsChan(16)
+	dispatcher.Start()
+
+	for port := uint16(1); port <= 16; port++ {
+		p := makeTestSYN(port, 80, time.Now())
+		dispatcher.ReceivePacket(p)
+		// the reply must be tracked by the same connection
+		if dispatcher.shard(p.Flow.ConnectionHash()) != dispatcher.shard(p.Flow.Reverse().ConnectionHash()) {
+			t.Errorf("the directions of flow %s are tracked by different shards", p.Flow)
+		}
+	}
+	<-connsChan
+	for _, shard := range dispatcher.shards {
+		shard.stopDispatchChan <- true
+	}
+
+	used := 0
+	for _, shard := range dispatcher.shards {
+		if len(shard.pool.list()) > 0 {
+			used += 1
+		}
+	}
+	if used < 2 {
+		t.Errorf("connections were spread over %d shards", used)
+	}
+	if conns := dispatcher.Connections(); len(conns) != 16 {
+		t.Errorf("%d connections tracked rather than 16", len(conns))
+	}
+	if closed := dispatcher.CloseAllConnections(); closed != 16 || len(dispatcher.Connections()) != 0 {
+		t.Errorf("closed %d connections, %d left", closed, len(dispatcher.Connections()))
+	}
+}
+
+func TestDispatcherIdleShardTimeout(t *testing.T) {
+	dispatcher := newTestDispatcher(DispatcherOptions{Clock: types.NewPacketClock(), Shards: 2})
+	dispatcher.Start()
+
+	// find a port whose connection another shard tracks
+	start := time.Unix(1500000000, 0)
+	idle := makeTestSYN(1, 80, start)
+	idleShard := dispatcher.shard(idle.Flow.ConnectionHash())
+	busyPort := uint16(2)
+	for dispatcher.shard(makeTestSYN(busyPort, 80, start).Flow.ConnectionHash()) == idleShard {
+		busyPort++
+	}
+
+	// the idle connection's shard receives no packets after its SYN
+	dispatcher.ReceivePacket(idle)
+	for n := 1; n <= 3; n++ {
+		dispatcher.ReceivePacket(makeTestSYN(busyPort, 80, start.Add(time.Duration(n)*time.Hour)))
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(idleShard.pool.list()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the connection of a shard without packets never timed out")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, shard := range dispatcher.shards {
+		shard.stopDispatchChan <- true
+	}
+}
+
+func TestConnectionPoolReserve(t *testing.T) {
+	var count int64
+	a, b := newConnectionPool(&count), newConnectionPool(&count)
+
+	// the pools of all shards share the limit, reserved slots included
+	if !a.reserve(2) || !b.reserve(2) {
+		t.Fatal("failed to reserve slots below the limit")
+	}
+	if a.reserve(2) || b.reserve(2) {
+		t.Error("reserved a slot beyond the limit")
+	}
+	a.put(types.ConnectionKey{}, nil)
+	a.remove(types.ConnectionKey{})
+	if !b.reserve(2) || count != 2 {
+		t.Errorf("slot not freed: %d connections counted", count)
+	}
+	if !a.reserve(0) || count != 3 {
+		t.Errorf("unbounded reservation failed: %d connections counted", count)
+	}
+}
+
+func TestDispatcherConnectionHashCollision(t *testing.T) {
+	dispatcher := newTestDispatcher(DispatcherOptions{})
+	connsChan := dispatcher.GetObservedConnectionsChan(2)
+	dispatcher.Start()
+
+	// 1.2.3.4:1-2.3.4.5:2 and 1.2.3.4:2-2.3.4.5:1 have the same ConnectionHash
+	packets := []*types.PacketManifest{makeTestSYN(1, 2, time.Now()), makeTestSYN(2, 1, time.Now())}
+	if packets[0].Flow.ConnectionHash() != packets[1].Flow.ConnectionHash() {
+		t.Fatal("expected a ConnectionHash collision")
+	}
+	for _, p := range packets {
+		dispatcher.ReceivePacket(p)
+	}
+	<-connsChan
+	dispatcher.shards[0].stopDispatchChan <- true
+
+	if conns := dispatcher.Connections(); len(conns) != 2 {
+		t.Errorf("%d connections tracked rather than 2", len(conns))
+	}
+}
+
+func TestDispatcherReceiveAfterStop(t *testing.T) {
+	dispatcher := newTestDispatcher(DispatcherOptions{})
+	dispatcher.Start()
+	dispatcher.Stop()
+
+	received := make(chan bool)
+	go func() {
+		dispatcher.ReceivePacket(makeTestSYN(1, 80, time.Now()))
+		close(received)
+	}()
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ReceivePacket blocks once the dispatcher is stopped")
+	}
+}
@@ -0,0 +1,188 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package HoneyBadger
+
+import (
+	"log"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+const (
+	// fingerprintLearnPackets is the number of packets of a flow whose
+	// headers are learned before deviations from them are reported. A
+	// deviating TTL seen in as many packets in a row is learned as the
+	// new TTL of the flow since a route change rather than injection
+	// is the likely cause.
+	fingerprintLearnPackets = 4
+
+	// DefaultTTLTolerance and DefaultIPIDTolerance are the default
+	// deviations of TTL and IP ID which are not reported
+	DefaultTTLTolerance  = 0
+	DefaultIPIDTolerance = 256
+)
+
+// ipIDBehaviour is how the sender of a flow chooses IP IDs
+type ipIDBehaviour int
+
+const (
+	ipIDUnknown ipIDBehaviour = iota
+	ipIDZero
+	ipIDIncrementing
+	ipIDRandom
+)
+
+// headerFingerprint learns the TTL and IP ID behaviour of the sender of
+// one direction of a connection. Packets injected by an on-path host
+// usually arrive with a different TTL, and their IP IDs do not follow
+// the sender's sequence, even if they do not overlap any stream data.
+type headerFingerprint struct {
+	packets   int
+	ttl       uint8
+	ttlStable bool
+	newTTL    uint8
+	newTTLs   int
+	ipID      ipIDBehaviour
+	lastID    uint16
+	jumpedID  uint16
+	jumped    bool
+	// last is the evidence of the last packet which did not deviate
+	last *types.HeaderEvidence
+}
+
+// ttlDistance returns the absolute difference of two TTLs
+func ttlDistance(a, b uint8) int {
+	if a > b {
+		return int(a - b)
+	}
+	return int(b - a)
+}
+
+// ipIDDistance returns how far the IP ID is from the last one, taking
+// the wrap around of the sender's counter into account. It is negative
+// if the packet was sent before the last one.
+func ipIDDistance(id, last uint16) int {
+	return int(int16(id - last))
+}
+
+// ipIDWithin returns true if the IP ID is at most tolerance IDs before
+// or after the last one. Packets are often reordered by a few IDs.
+func ipIDWithin(id, last uint16, tolerance int) bool {
+	distance := ipIDDistance(id, last)
+	return distance <= tolerance && -distance <= tolerance
+}
+
+// advanceIPID makes the IP ID the last one unless it was sent before
+func (f *headerFingerprint) advanceIPID(id uint16) {
+	if ipIDDistance(id, f.lastID) > 0 {
+		f.lastID = id
+	}
+}
+
+// observe learns from the packet's headers and returns whether its
+// TTL and IP ID deviate from the ones learned by more than the given
+// tolerances. IP IDs are only checked if the sender either always
+// sets them to zero or increments them by at most the tolerance.
+// Reordered packets whose IP ID is at most the tolerance behind are
+// not reported.
+func (f *headerFingerprint) observe(p *types.PacketManifest, ttlTolerance, ipIDTolerance int) (ttlAnomaly, ipIDAnomaly bool) {
+	ttl, id, hasID := p.IP.TTL, p.IP.Id, !p.IsIPv6()
+	if !hasID {
+		ttl = p.IPv6.HopLimit
+	}
+	if f.packets < fingerprintLearnPackets {
+		f.learn(ttl, id, hasID, ttlTolerance, ipIDTolerance)
+		f.last = types.NewHeaderEvidence(p)
+		return false, false
+	}
+
+	if f.ttlStable && ttlDistance(ttl, f.ttl) > ttlTolerance {
+		ttlAnomaly = true
+		if f.newTTLs > 0 && ttl == f.newTTL {
+			f.newTTLs += 1
+		} else {
+			f.newTTL, f.newTTLs = ttl, 1
+		}
+		if f.newTTLs == fingerprintLearnPackets {
+			log.Printf("TTL of flow %s changed from %d to %d", p.Flow, f.ttl, ttl)
+			f.ttl, f.newTTLs = ttl, 0
+		}
+	} else {
+		f.newTTLs = 0
+	}
+
+	if hasID {
+		switch f.ipID {
+		case ipIDZero:
+			ipIDAnomaly = id != 0
+		case ipIDIncrementing:
+			if ipIDWithin(id, f.lastID, ipIDTolerance) {
+				f.advanceIPID(id)
+				f.jumped = false
+			} else if f.jumped && ipIDWithin(id, f.jumpedID, ipIDTolerance) {
+				// the sender's counter jumped rather than a packet being injected
+				f.lastID, f.jumped = id, false
+			} else {
+				ipIDAnomaly = true
+				f.jumpedID, f.jumped = id, true
+			}
+		}
+	}
+	if !ttlAnomaly && !ipIDAnomaly {
+		// a snapshot rather than the manifest, which would pin its buffers
+		f.last = types.NewHeaderEvidence(p)
+	}
+	return ttlAnomaly, ipIDAnomaly
+}
+
+// learn records the headers of one of the first packets of the flow
+func (f *headerFingerprint) learn(ttl uint8, id uint16, hasID bool, ttlTolerance, ipIDTolerance int) {
+	defer func() { f.packets += 1 }()
+	if f.packets == 0 {
+		f.ttl, f.ttlStable = ttl, true
+		if hasID {
+			f.lastID = id
+			if id == 0 {
+				f.ipID = ipIDZero
+			}
+		}
+		return
+	}
+	if ttlDistance(ttl, f.ttl) > ttlTolerance {
+		// e.g. load balanced paths of different lengths
+		f.ttlStable = false
+	}
+	if !hasID {
+		return
+	}
+	switch f.ipID {
+	case ipIDZero:
+		if id != 0 {
+			f.ipID = ipIDRandom
+		}
+	case ipIDUnknown, ipIDIncrementing:
+		if ipIDWithin(id, f.lastID, ipIDTolerance) {
+			f.ipID = ipIDIncrementing
+		} else {
+			f.ipID = ipIDRandom
+		}
+	}
+	f.advanceIPID(id)
+}
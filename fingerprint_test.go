@@ -0,0 +1,138 @@
+package HoneyBadger
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/david415/HoneyBadger/types"
+	"github.com/google/gopacket/layers"
+)
+
+func makeTestFingerprintPacket(ttl uint8, id uint16) *types.PacketManifest {
+	return &types.PacketManifest{
+		Timestamp: time.Now(),
+		IP: layers.IPv4{
+			SrcIP:    net.IP{1, 2, 3, 4},
+			DstIP:    net.IP{2, 3, 4, 5},
+			Version:  4,
+			TTL:      ttl,
+			Id:       id,
+			Protocol: layers.IPProtocolTCP,
+		},
+	}
+}
+
+func TestHeaderFingerprint(t *testing.T) {
+	type observation struct {
+		ttl               uint8
+		id                uint16
+		ttlAnomaly, ipIDs bool
+	}
+	tests := []struct {
+		name         string
+		observations []observation
+	}{
+		{"incrementing IP IDs", []observation{
+			{64, 100, false, false}, {64, 101, false, false}, {64, 105, false, false}, {64, 106, false, false},
+			{64, 107, false, false},
+			{64, 40000, false, true},
+			{64, 108, false, false},
+			// the counter wraps around
+			{64, 65000, false, true}, {64, 109, false, false},
+		}},
+		{"out of order IP IDs", []observation{
+			{64, 65533, false, false}, {64, 65534, false, false}, {64, 0, false, false}, {64, 1, false, false},
+			{64, 3, false, false},
+			// sent before the previous packet
+			{64, 2, false, false},
+			{64, 65535, false, false},
+			{64, 4, false, false},
+		}},
+		{"jumping IP ID counter", []observation{
+			{64, 65530, false, false}, {64, 65531, false, false}, {64, 65533, false, false}, {64, 2, false, false},
+			{64, 9000, false, true},
+			// the sender's counter did jump, which is learned
+			{64, 9001, false, false}, {64, 9002, false, false},
+		}},
+		{"zero IP IDs", []observation{
+			{64, 0, false, false}, {64, 0, false, false}, {64, 0, false, false}, {64, 0, false, false},
+			{64, 1234, false, true}, {64, 0, false, false},
+		}},
+		{"random IP IDs", []observation{
+			{64, 100, false, false}, {64, 30000, false, false}, {64, 7, false, false}, {64, 50000, false, false},
+			{64, 1234, false, false},
+		}},
+		{"TTL", []observation{
+			{64, 0, false, false}, {64, 0, false, false}, {64, 0, false, false}, {64, 0, false, false},
+			{50, 0, true, false}, {64, 0, false, false},
+			// a route change is learned after as many packets as learning took
+			{63, 0, true, false}, {63, 0, true, false}, {63, 0, true, false}, {63, 0, true, false},
+			{63, 0, false, false}, {64, 0, true, false},
+		}},
+		{"unstable TTL", []observation{
+			{64, 0, false, false}, {60, 0, false, false}, {64, 0, false, false}, {64, 0, false, false},
+			{50, 0, false, false},
+		}},
+	}
+	for _, test := range tests {
+		f := headerFingerprint{}
+		for i, o := range test.observations {
+			ttlAnomaly, ipIDAnomaly := f.observe(makeTestFingerprintPacket(o.ttl, o.id), DefaultTTLTolerance, DefaultIPIDTolerance)
+			if ttlAnomaly != o.ttlAnomaly || ipIDAnomaly != o.ipIDs {
+				t.Errorf("%s: packet %d: TTL anomaly %v IP ID anomaly %v", test.name, i, ttlAnomaly, ipIDAnomaly)
+			}
+		}
+	}
+
+	// tolerated deviations are not reported
+	f := headerFingerprint{}
+	for i, ttl := range []uint8{64, 64, 64, 64, 62, 66, 67} {
+		ttlAnomaly, _ := f.observe(makeTestFingerprintPacket(ttl, 0), 2, DefaultIPIDTolerance)
+		if ttlAnomaly != (ttl == 67) {
+			t.Errorf("packet %d with TTL %d: TTL anomaly %v", i, ttl, ttlAnomaly)
+		}
+	}
+}
+
+func TestHeaderAnomalyDetection(t *testing.T) {
+	attackLogger := NewDummyAttackLogger()
+	options := ConnectionOptions{
+		MaxRingPackets:        40,
+		LogDir:                "fake-log-dir",
+		AttackLogger:          attackLogger,
+		DetectHeaderAnomalies: true,
+		IPIDTolerance:         DefaultIPIDTolerance,
+	}
+	f := &DefaultConnFactory{}
+	conn := f.Build(options).(*Connection)
+
+	flow := makeTestPortFlow(makeTestFingerprintPacket(64, 0).IP, 1, 2)
+	seq, ack := uint32(3), uint32(9666)
+	receive := func(flow *types.TcpIpFlow, tcp layers.TCP, ttl uint8, id uint16) {
+		p := makeTestFingerprintPacket(ttl, id)
+		p.Flow, p.TCP = flow, tcp
+		conn.ReceivePacket(p)
+	}
+	receive(flow, layers.TCP{Seq: seq, SYN: true}, 64, 1000)
+	receive(flow.Reverse(), layers.TCP{Seq: ack, Ack: seq + 1, SYN: true, ACK: true}, 50, 0)
+	seq += 1
+	ack += 1
+	for id := uint16(1001); id < 1005; id++ {
+		receive(flow, layers.TCP{Seq: seq, Ack: ack, ACK: true}, 64, id)
+		receive(flow.Reverse(), layers.TCP{Seq: ack, Ack: seq, ACK: true}, 50, 0)
+	}
+	if attackLogger.Count != 0 {
+		t.Fatalf("regular packets reported as %s", attackLogger.LastEvent)
+	}
+
+	// the TTL of the client flow is unlike the server's
+	receive(flow, layers.TCP{Seq: seq, Ack: ack, ACK: true, RST: true}, 50, 1005)
+	if attackLogger.Count != 1 || attackLogger.LastEvent.Kind != types.EventTTLAnomaly {
+		t.Fatalf("TTL anomaly not reported: %d events", attackLogger.Count)
+	}
+	event := attackLogger.LastEvent
+	if event.Evidence.TTL != 50 || len(event.OverlapEvidence) != 1 || event.OverlapEvidence[0].TTL != 64 || event.OverlapEvidence[0].IPID != 1004 {
+		t.Errorf("bad anomaly evidence %+v %+v", event.Evidence, event.OverlapEvidence)
+	}
+}
@@ -30,17 +30,37 @@ import (
 	"time"
 )
 
+// SerializedEvent is the JSON attack report of an event. Flow is the
+// string representation of the flow, which ParseTcpIpFlow turns back
+// into a flow; its endpoints are also given by the SrcIP, SrcPort,
+// DstIP and DstPort fields. Type is the event type string of
+// SchemaVersion 1 reports, which lack the Category, Subtype and
+// Severity of the event. Evidence holds the headers of the packet the
+// event was detected for and OverlapEvidence those of the stream
+// segments it conflicted with.
 type SerializedEvent struct {
+	SchemaVersion            int
 	Type                     string
+	Category                 string
+	Subtype                  string
+	Severity                 string
 	Time                     time.Time
 	PacketCount              uint64
 	Flow                     string
+	SrcIP                    string
+	SrcPort                  uint16
+	DstIP                    string
+	DstPort                  uint16
 	HijackSeq                uint32
 	HijackAck                uint32
 	Payload                  string
 	Overlap                  string
 	Start, End               types.Sequence
 	OverlapStart, OverlapEnd int
+	Tunnel                   *types.Tunnel
+	Truncated                bool
+	Evidence                 *types.HeaderEvidence
+	OverlapEvidence          []*types.HeaderEvidence
 }
 
 // AttackJsonLogger is responsible for recording all attack reports as JSON objects in a file.
@@ -81,24 +101,58 @@ func (a *AttackJsonLogger) receiveReports() {
 }
 
 func (a *AttackJsonLogger) Log(event *types.Event) {
+	event.ResolveKind()
 	a.attackReportChan <- event
 }
 
-func (a *AttackJsonLogger) SerializeAndWrite(event *types.Event) {
-	serialized := &SerializedEvent{
-		Type:         event.Type,
-		PacketCount:  event.PacketCount,
-		Flow:         event.Flow.String(),
-		HijackSeq:    event.HijackSeq,
-		HijackAck:    event.HijackAck,
-		Time:         event.Time,
-		Payload:      base64.StdEncoding.EncodeToString(event.Payload),
-		Overlap:      base64.StdEncoding.EncodeToString(event.Overlap),
-		Start:        event.StartSequence,
-		End:          event.EndSequence,
-		OverlapStart: event.OverlapStart,
-		OverlapEnd:   event.OverlapEnd,
+// newSerializedEvent returns the SerializedEvent of the event's
+// metadata, leaving out the payload and overlap bytes
+func newSerializedEvent(event *types.Event) *SerializedEvent {
+	srcIP, srcPort, dstIP, dstPort := event.Flow.Endpoints()
+	return &SerializedEvent{
+		SchemaVersion:   types.EventSchemaVersion,
+		Type:            event.Kind.String(),
+		Category:        event.Kind.Category(),
+		Subtype:         event.Kind.Subtype(),
+		Severity:        event.Kind.Severity().String(),
+		PacketCount:     event.PacketCount,
+		Flow:            event.Flow.String(),
+		SrcIP:           srcIP.String(),
+		SrcPort:         srcPort,
+		DstIP:           dstIP.String(),
+		DstPort:         dstPort,
+		HijackSeq:       event.HijackSeq,
+		HijackAck:       event.HijackAck,
+		Time:            event.Time,
+		Start:           event.StartSequence,
+		End:             event.EndSequence,
+		OverlapStart:    event.OverlapStart,
+		OverlapEnd:      event.OverlapEnd,
+		Tunnel:          event.Tunnel,
+		Truncated:       event.Truncated,
+		Evidence:        event.Evidence,
+		OverlapEvidence: event.OverlapEvidence,
 	}
+}
+
+// Kind returns the kind of the event, which is derived from its type
+// string for reports predating SchemaVersion 2
+func (e *SerializedEvent) Kind() types.EventKind {
+	if e.SchemaVersion < 2 {
+		return types.ParseEventKind(e.Type)
+	}
+	return types.EventKindOf(e.Category, e.Subtype)
+}
+
+// TcpIpFlow returns the flow the event was observed on
+func (e *SerializedEvent) TcpIpFlow() (*types.TcpIpFlow, error) {
+	return types.ParseTcpIpFlow(e.Flow)
+}
+
+func (a *AttackJsonLogger) SerializeAndWrite(event *types.Event) {
+	serialized := newSerializedEvent(event)
+	serialized.Payload = base64.StdEncoding.EncodeToString(event.Payload)
+	serialized.Overlap = base64.StdEncoding.EncodeToString(event.Overlap)
 	a.Publish(serialized)
 }
 
@@ -0,0 +1,73 @@
+package logging
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+func TestSerializedEventFlow(t *testing.T) {
+	flow, err := types.NewTcpIpFlowFromEndpoints(net.ParseIP("2001:db8::1"), 1234, net.ParseIP("2001:db8::2"), 80)
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := &types.Event{
+		Kind: types.EventOrderedInjection,
+		Flow: flow.WithSensor("edge-1"),
+		Time: time.Now(),
+	}
+	data, err := json.Marshal(newSerializedEvent(event))
+	if err != nil {
+		t.Fatal(err)
+	}
+	serialized := SerializedEvent{}
+	if err := json.Unmarshal(data, &serialized); err != nil {
+		t.Fatal(err)
+	}
+	if serialized.SrcIP != "2001:db8::1" || serialized.SrcPort != 1234 || serialized.DstIP != "2001:db8::2" || serialized.DstPort != 80 {
+		t.Errorf("bad endpoints %+v", serialized)
+	}
+	parsed, err := serialized.TcpIpFlow()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !parsed.Equal(event.Flow) {
+		t.Errorf("flow %s != %s", parsed, event.Flow)
+	}
+}
+
+func TestSerializedEventKind(t *testing.T) {
+	flow, err := types.ParseTcpIpFlow("1.2.3.4:1-2.3.4.5:2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serialized := newSerializedEvent(&types.Event{
+		Kind:     types.EventCensorInjectionRST,
+		Flow:     flow,
+		Evidence: &types.HeaderEvidence{TTL: 9},
+	})
+	if serialized.Evidence == nil || serialized.Evidence.TTL != 9 {
+		t.Errorf("header evidence not serialized: %+v", serialized.Evidence)
+	}
+	if serialized.SchemaVersion != types.EventSchemaVersion || serialized.Category != "censor-injection" || serialized.Subtype != "rst" || serialized.Severity != "high" {
+		t.Errorf("bad event kind %+v", serialized)
+	}
+	if serialized.Type != "censor-injection-RST_closing-sequence-overlap" {
+		t.Errorf("type string %q changed", serialized.Type)
+	}
+	if serialized.Kind() != types.EventCensorInjectionRST {
+		t.Errorf("kind %s", serialized.Kind())
+	}
+
+	old := SerializedEvent{}
+	err = json.Unmarshal([]byte(`{"Type":"coalesce injection","Flow":"1.2.3.4:1-2.3.4.5:2"}`), &old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if old.Kind() != types.EventCoalesceInjection {
+		t.Errorf("kind of version 1 report %s", old.Kind())
+	}
+}
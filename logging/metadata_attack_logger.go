@@ -67,23 +67,12 @@ func (a *AttackMetadataJsonLogger) receiveReports() {
 }
 
 func (a *AttackMetadataJsonLogger) Log(event *types.Event) {
+	event.ResolveKind()
 	a.attackReportChan <- event
 }
 
 func (a *AttackMetadataJsonLogger) SerializeAndWrite(event *types.Event) {
-	publishableEvent := &SerializedEvent{
-		Type:         event.Type,
-		PacketCount:  event.PacketCount,
-		Flow:         event.Flow.String(),
-		HijackSeq:    event.HijackSeq,
-		HijackAck:    event.HijackAck,
-		Time:         event.Time,
-		Start:        event.StartSequence,
-		End:          event.EndSequence,
-		OverlapStart: event.OverlapStart,
-		OverlapEnd:   event.OverlapEnd,
-	}
-	a.Publish(publishableEvent)
+	a.Publish(newSerializedEvent(event))
 }
 
 // Publish writes a JSON report to the attack-report file for that flow.
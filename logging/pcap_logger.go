@@ -36,27 +36,40 @@ import (
 type TimedPacket struct {
 	RawPacket []byte
 	Timestamp time.Time
+	Comments  []string
+}
+
+// packetWriter is implemented by the pcap and pcapng writers
+type packetWriter interface {
+	WriteFileHeader(snaplen uint32, linkType layers.LinkType) error
+	WritePacket(ci gopacket.CaptureInfo, data []byte) error
 }
 
 // PcapLogger struct is used to log packets to a pcap file
+// or, if Pcapng is set, to a pcapng file with packet comments
 type PcapLogger struct {
 	packetChan chan TimedPacket
 	stopChan   chan bool
 	LogDir     string
 	ArchiveDir string
 	Flow       *types.TcpIpFlow
-	writer     *pcapgo.Writer
+	LinkType   layers.LinkType
+	Pcapng     bool
+	writer     packetWriter
 	fileWriter io.WriteCloser
 	pcapLogNum int
 	pcapQuota  int
 	basename   string
 }
 
-func NewPcapLogger(logDir, archiveDir string, flow *types.TcpIpFlow, pcapLogNum int, pcapQuota int) types.PacketLogger {
+// NewPcapLogger returns a PacketLogger which writes the raw packets of
+// the given flow, framed according to linkType, to rotated pcap files
+func NewPcapLogger(logDir, archiveDir string, flow *types.TcpIpFlow, linkType layers.LinkType, pcapLogNum int, pcapQuota int) types.PacketLogger {
 	p := PcapLogger{
 		packetChan: make(chan TimedPacket),
 		stopChan:   make(chan bool),
 		Flow:       flow,
+		LinkType:   linkType,
 		LogDir:     logDir,
 		ArchiveDir: archiveDir,
 		pcapLogNum: pcapLogNum,
@@ -65,11 +78,20 @@ func NewPcapLogger(logDir, archiveDir string, flow *types.TcpIpFlow, pcapLogNum
 	return types.PacketLogger(&p)
 }
 
+// NewPcapngLogger returns a PacketLogger like NewPcapLogger which
+// writes pcapng files, annotating packets with their comments
+func NewPcapngLogger(logDir, archiveDir string, flow *types.TcpIpFlow, linkType layers.LinkType, pcapLogNum int, pcapQuota int) types.PacketLogger {
+	p := NewPcapLogger(logDir, archiveDir, flow, linkType, pcapLogNum, pcapQuota).(*PcapLogger)
+	p.Pcapng = true
+	return p
+}
+
 type PcapLoggerFactory struct {
 	LogDir     string
 	ArchiveDir string
 	PcapLogNum int
 	PcapQuota  int
+	Pcapng     bool
 }
 
 func NewPcapLoggerFactory(logDir, archiveDir string, pcapLogNum, pcapQuota int) PcapLoggerFactory {
@@ -81,22 +103,39 @@ func NewPcapLoggerFactory(logDir, archiveDir string, pcapLogNum, pcapQuota int)
 	}
 }
 
-func (f PcapLoggerFactory) Build(flow *types.TcpIpFlow) types.PacketLogger {
-	return NewPcapLogger(f.LogDir, f.ArchiveDir, flow, f.PcapLogNum, f.PcapQuota)
+func (f PcapLoggerFactory) Build(flow *types.TcpIpFlow, linkType layers.LinkType) types.PacketLogger {
+	if f.Pcapng {
+		return NewPcapngLogger(f.LogDir, f.ArchiveDir, flow, linkType, f.PcapLogNum, f.PcapQuota)
+	}
+	return NewPcapLogger(f.LogDir, f.ArchiveDir, flow, linkType, f.PcapLogNum, f.PcapQuota)
 }
 
 func (p *PcapLogger) WriteHeader() {
-	err := p.writer.WriteFileHeader(65536, layers.LinkTypeEthernet)
+	err := p.writer.WriteFileHeader(65536, p.LinkType)
 	if err != nil {
 		panic(err)
 	}
 }
 
+// extension returns the file name extension of the log files
+func (p *PcapLogger) extension() string {
+	if p.Pcapng {
+		return "pcapng"
+	}
+	return "pcap"
+}
+
 func (p *PcapLogger) Start() {
 	if p.fileWriter == nil {
-		p.basename = filepath.Join(p.LogDir, fmt.Sprintf("%s.pcap", p.Flow))
+		p.basename = filepath.Join(p.LogDir, fmt.Sprintf("%s.%s", p.Flow, p.extension()))
 		p.fileWriter = NewRotatingQuotaWriter(p.basename, p.pcapQuota, p.pcapLogNum, p.WriteHeader)
-		p.writer = pcapgo.NewWriter(p.fileWriter)
+	}
+	if p.writer == nil {
+		if p.Pcapng {
+			p.writer = NewPcapngWriter(p.fileWriter)
+		} else {
+			p.writer = pcapgo.NewWriter(p.fileWriter)
+		}
 	}
 	go p.logPackets()
 }
@@ -110,7 +149,7 @@ func (p *PcapLogger) Archive() {
 	newBasename := filepath.Join(p.ArchiveDir, filepath.Base(p.basename))
 	os.Rename(p.basename, newBasename)
 	for i := 1; i < p.pcapLogNum+1; i++ {
-		os.Rename(filepath.Join(p.LogDir, fmt.Sprintf("%s.pcap.%d", p.Flow.String(), i)), fmt.Sprintf("%s.%d", newBasename, i))
+		os.Rename(filepath.Join(p.LogDir, fmt.Sprintf("%s.%s.%d", p.Flow.String(), p.extension(), i)), fmt.Sprintf("%s.%d", newBasename, i))
 	}
 }
 
@@ -120,7 +159,7 @@ func (p *PcapLogger) logPackets() {
 		case <-p.stopChan:
 			return
 		case timedPacket := <-p.packetChan:
-			p.WritePacketToFile(timedPacket.RawPacket, timedPacket.Timestamp)
+			p.WriteAnnotatedPacketToFile(timedPacket.RawPacket, timedPacket.Timestamp, timedPacket.Comments)
 		}
 	}
 }
@@ -128,7 +167,7 @@ func (p *PcapLogger) logPackets() {
 func (p *PcapLogger) Remove() {
 	os.Remove(p.basename)
 	for i := 1; i < p.pcapLogNum+1; i++ {
-		os.Remove(filepath.Join(p.LogDir, fmt.Sprintf("%s.pcap.%d", p.Flow, i)))
+		os.Remove(filepath.Join(p.LogDir, fmt.Sprintf("%s.%s.%d", p.Flow, p.extension(), i)))
 	}
 }
 
@@ -139,13 +178,33 @@ func (p *PcapLogger) WritePacket(rawPacket []byte, timestamp time.Time) {
 	}
 }
 
+// WriteAnnotatedPacket logs a packet along with comments describing it,
+// such as the attack events it was implicated in. The comments are
+// dropped unless the logger writes pcapng.
+func (p *PcapLogger) WriteAnnotatedPacket(rawPacket []byte, timestamp time.Time, comments []string) {
+	p.packetChan <- TimedPacket{
+		RawPacket: rawPacket,
+		Timestamp: timestamp,
+		Comments:  comments,
+	}
+}
+
 func (p *PcapLogger) WritePacketToFile(rawPacket []byte, timestamp time.Time) {
-	err := p.writer.WritePacket(gopacket.CaptureInfo{
+	p.WriteAnnotatedPacketToFile(rawPacket, timestamp, nil)
+}
+
+func (p *PcapLogger) WriteAnnotatedPacketToFile(rawPacket []byte, timestamp time.Time, comments []string) {
+	ci := gopacket.CaptureInfo{
 		Timestamp:     timestamp,
 		CaptureLength: len(rawPacket),
 		Length:        len(rawPacket),
-	}, rawPacket)
-
+	}
+	var err error
+	if writer, ok := p.writer.(*PcapngWriter); ok {
+		err = writer.WriteAnnotatedPacket(ci, rawPacket, comments)
+	} else {
+		err = p.writer.WritePacket(ci, rawPacket)
+	}
 	if err != nil {
 		panic(err)
 	}
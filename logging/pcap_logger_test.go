@@ -63,13 +63,14 @@ func TestPcapLogger(t *testing.T) {
 	tcpFlow, _ := gopacket.FlowFromEndpoints(layers.NewTCPPortEndpoint(layers.TCPPort(1)), layers.NewTCPPortEndpoint(layers.TCPPort(2)))
 	flow := types.NewTcpIpFlowFromFlows(ipFlow, tcpFlow)
 
-	pcapLogger := NewPcapLogger("fake-dir", flow)
+	pcapLogger := NewPcapLogger("fake-dir", "fake-archive-dir", flow, layers.LinkTypeEthernet, 10, 50).(*PcapLogger)
 	testWriter := NewTestPcapWriter()
 	pcapLogger.fileWriter = testWriter
 
 	pcapLogger.Start()
 
 	// test pcap header
+	pcapLogger.WriteHeader()
 	want := []byte("\xd4\xc3\xb2\xa1\x02\x00\x04\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x00\x01\x00\x00\x00")
 	if !bytes.Equal(testWriter.lastWrite, want) {
 		t.Errorf("pcap header is wrong")
@@ -79,7 +80,7 @@ func TestPcapLogger(t *testing.T) {
 	// test pcap packet
 	rawPacket := makeTestPacket()
 	testWriter.lastWrite = make([]byte, 0)
-	pcapLogger.WritePacket(rawPacket, time.Now())
+	pcapLogger.WritePacketToFile(rawPacket, time.Now())
 
 	if !bytes.Equal(testWriter.lastWrite, rawPacket) {
 		t.Errorf("pcap packet is wrong")
@@ -88,3 +89,23 @@ func TestPcapLogger(t *testing.T) {
 
 	pcapLogger.Stop()
 }
+
+func TestPcapLoggerLinkType(t *testing.T) {
+	ipFlow, _ := gopacket.FlowFromEndpoints(layers.NewIPEndpoint(net.IPv4(1, 2, 3, 4)), layers.NewIPEndpoint(net.IPv4(2, 3, 4, 5)))
+	tcpFlow, _ := gopacket.FlowFromEndpoints(layers.NewTCPPortEndpoint(layers.TCPPort(1)), layers.NewTCPPortEndpoint(layers.TCPPort(2)))
+	flow := types.NewTcpIpFlowFromFlows(ipFlow, tcpFlow)
+
+	factory := NewPcapLoggerFactory("fake-dir", "fake-archive-dir", 10, 50)
+	pcapLogger := factory.Build(flow, layers.LinkTypeLinuxSLL).(*PcapLogger)
+	testWriter := NewTestPcapWriter()
+	pcapLogger.fileWriter = testWriter
+	pcapLogger.Start()
+
+	pcapLogger.WriteHeader()
+	want := []byte("\xd4\xc3\xb2\xa1\x02\x00\x04\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x00\x71\x00\x00\x00")
+	if !bytes.Equal(testWriter.lastWrite, want) {
+		t.Errorf("pcap header link type is wrong: %x", testWriter.lastWrite)
+	}
+
+	pcapLogger.Stop()
+}
@@ -0,0 +1,147 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package logging
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// pcapng block types and options, see https://github.com/pcapng/pcapng
+const (
+	pcapngSectionHeaderBlock  = 0x0a0d0d0a
+	pcapngInterfaceBlock      = 1
+	pcapngEnhancedPacketBlock = 6
+	pcapngByteOrderMagic      = 0x1a2b3c4d
+	pcapngOptionEndOfOptions  = 0
+	pcapngOptionComment       = 1
+	pcapngOptionTsResol       = 9
+)
+
+// PcapngWriter writes packets of a single interface in the pcapng
+// format. Unlike classic pcap, each packet may carry comments which
+// Wireshark displays along with the packet.
+type PcapngWriter struct {
+	w   io.Writer
+	buf []byte
+}
+
+// NewPcapngWriter returns a PcapngWriter writing to w
+func NewPcapngWriter(w io.Writer) *PcapngWriter {
+	return &PcapngWriter{
+		w: w,
+	}
+}
+
+// WriteFileHeader writes a section header and the description of an
+// interface with nanosecond timestamp resolution.
+func (w *PcapngWriter) WriteFileHeader(snaplen uint32, linkType layers.LinkType) error {
+	w.buf = w.buf[:0]
+	start := w.beginBlock(pcapngSectionHeaderBlock)
+	w.buf = appendUint32(w.buf, pcapngByteOrderMagic)
+	w.buf = appendUint16(w.buf, 1) // major version
+	w.buf = appendUint16(w.buf, 0) // minor version
+	w.buf = appendUint32(w.buf, 0xffffffff)
+	w.buf = appendUint32(w.buf, 0xffffffff) // unspecified section length
+	w.endBlock(start)
+
+	start = w.beginBlock(pcapngInterfaceBlock)
+	w.buf = appendUint16(w.buf, uint16(linkType))
+	w.buf = appendUint16(w.buf, 0)
+	w.buf = appendUint32(w.buf, snaplen)
+	w.appendOption(pcapngOptionTsResol, []byte{9})
+	w.appendOption(pcapngOptionEndOfOptions, nil)
+	w.endBlock(start)
+
+	_, err := w.w.Write(w.buf)
+	return err
+}
+
+// WritePacket writes a packet without comments
+func (w *PcapngWriter) WritePacket(ci gopacket.CaptureInfo, data []byte) error {
+	return w.WriteAnnotatedPacket(ci, data, nil)
+}
+
+// WriteAnnotatedPacket writes a packet with an opt_comment for each of the given comments
+func (w *PcapngWriter) WriteAnnotatedPacket(ci gopacket.CaptureInfo, data []byte, comments []string) error {
+	w.buf = w.buf[:0]
+	start := w.beginBlock(pcapngEnhancedPacketBlock)
+	timestamp := uint64(ci.Timestamp.UnixNano())
+	w.buf = appendUint32(w.buf, 0) // interface
+	w.buf = appendUint32(w.buf, uint32(timestamp>>32))
+	w.buf = appendUint32(w.buf, uint32(timestamp))
+	w.buf = appendUint32(w.buf, uint32(ci.CaptureLength))
+	w.buf = appendUint32(w.buf, uint32(ci.Length))
+	w.buf = appendPadded(w.buf, data)
+	for _, comment := range comments {
+		w.appendOption(pcapngOptionComment, []byte(comment))
+	}
+	if len(comments) > 0 {
+		w.appendOption(pcapngOptionEndOfOptions, nil)
+	}
+	w.endBlock(start)
+
+	_, err := w.w.Write(w.buf)
+	return err
+}
+
+// beginBlock appends the header of a block whose length is
+// filled in by endBlock and returns the offset of the block
+func (w *PcapngWriter) beginBlock(blockType uint32) int {
+	start := len(w.buf)
+	w.buf = appendUint32(w.buf, blockType)
+	w.buf = appendUint32(w.buf, 0)
+	return start
+}
+
+func (w *PcapngWriter) endBlock(start int) {
+	length := uint32(len(w.buf) - start + 4)
+	binary.LittleEndian.PutUint32(w.buf[start+4:], length)
+	w.buf = appendUint32(w.buf, length)
+}
+
+func (w *PcapngWriter) appendOption(code uint16, value []byte) {
+	if len(value) > 0xffff {
+		value = value[:0xffff]
+	}
+	w.buf = appendUint16(w.buf, code)
+	w.buf = appendUint16(w.buf, uint16(len(value)))
+	w.buf = appendPadded(w.buf, value)
+}
+
+func appendUint16(buf []byte, v uint16) []byte {
+	return append(buf, byte(v), byte(v>>8))
+}
+
+func appendUint32(buf []byte, v uint32) []byte {
+	return append(buf, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+// appendPadded appends data followed by zeros up to a 32 bit boundary
+func appendPadded(buf []byte, data []byte) []byte {
+	buf = append(buf, data...)
+	for i := len(data); i%4 != 0; i++ {
+		buf = append(buf, 0)
+	}
+	return buf
+}
@@ -0,0 +1,67 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/david415/HoneyBadger/pcapfile_sniffer"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestPcapngWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewPcapngWriter(&buf)
+	if err := w.WriteFileHeader(65536, layers.LinkTypeLinuxSLL); err != nil {
+		t.Fatal(err)
+	}
+	rawPacket := makeTestPacket()
+	timestamp := time.Unix(1500000000, 123456789)
+	ci := gopacket.CaptureInfo{
+		Timestamp:     timestamp,
+		CaptureLength: len(rawPacket),
+		Length:        len(rawPacket),
+	}
+	if err := w.WritePacket(ci, rawPacket); err != nil {
+		t.Fatal(err)
+	}
+	annotatedStart := buf.Len()
+	comment := "HoneyBadger ordered injection: packet 2, sequence 10-20"
+	ci.CaptureLength -= 1
+	if err := w.WriteAnnotatedPacket(ci, rawPacket[:len(rawPacket)-1], []string{comment}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the annotated block ends with the comment option,
+	// the end of options and the block length
+	block := buf.Bytes()[annotatedStart:]
+	length := binary.LittleEndian.Uint32(block[4:8])
+	if int(length) != len(block) || binary.LittleEndian.Uint32(block[len(block)-4:]) != length {
+		t.Fatalf("bad block length %d for %d bytes", length, len(block))
+	}
+	if !bytes.Contains(block, []byte(comment)) {
+		t.Error("packet comment missing")
+	}
+
+	handle, err := pcapfile_sniffer.NewPcapReaderSniffer(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range [][]byte{rawPacket, rawPacket[:len(rawPacket)-1]} {
+		data, ci, err := handle.ReadPacketData()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, want) {
+			t.Error("packet data is wrong")
+		}
+		if !ci.Timestamp.Equal(timestamp) {
+			t.Errorf("timestamp %s != %s", ci.Timestamp, timestamp)
+		}
+		if handle.LinkType() != layers.LinkTypeLinuxSLL {
+			t.Errorf("link type %s", handle.LinkType())
+		}
+	}
+}
@@ -34,6 +34,8 @@ type page struct {
 	index      int
 	prev, next *page
 	buf        [pageBytes]byte
+	// entry is the packet log entry of the page's packet, if any
+	entry *packetLogEntry
 }
 
 // pageCache is a concurrency-unsafe store of page objects we use to avoid
@@ -86,6 +88,7 @@ func (c *pageCache) next(ts time.Time) (p *page) {
 	p, c.free = c.free[i], c.free[:i]
 	p.prev = nil
 	p.next = nil
+	p.entry = nil
 	p.Seen = ts
 	p.Bytes = p.buf[:0]
 	c.used++
@@ -118,6 +121,15 @@ func byteSpan(expected, received types.Sequence, bytes []byte) (toSend []byte, n
 	return bytes[span:], expected.Add(len(bytes) - span)
 }
 
+// coalesceLogger logs the injections an OrderedCoalesce detects. The
+// packets whose segments it buffers are written to the packet log once
+// their pages are freed, so that these events can annotate them.
+type coalesceLogger interface {
+	logBufferedEvent(event *types.Event, entry *packetLogEntry)
+	takePacketLogEntry(p *types.PacketManifest) *packetLogEntry
+	writePacketLogEntry(entry *packetLogEntry)
+}
+
 type OrderedCoalesce struct {
 	// MaxBufferedPagesTotal is an upper limit on the total number of pages to
 	// buffer while waiting for out-of-order packets.  Once this limit is
@@ -131,15 +143,18 @@ type OrderedCoalesce struct {
 	MaxBufferedPagesPerFlow int
 
 	Flow                    *types.TcpIpFlow
-	StreamRing              *types.Ring
-	log                     types.Logger
+	StreamRing              **types.Ring
+	log                     coalesceLogger
 	pageCount               int
 	PageCache               *pageCache
 	first, last             *page
 	DetectCoalesceInjection bool
 }
 
-func NewOrderedCoalesce(log types.Logger, flow *types.TcpIpFlow, pageCache *pageCache, streamRing *types.Ring, maxBufferedPagesTotal, maxBufferedPagesPerFlow int, DetectCoalesceInjection bool) *OrderedCoalesce {
+// NewOrderedCoalesce returns an OrderedCoalesce adding the segments it
+// buffered to the stream ring whose write position streamRing points to,
+// which is shared with the connection adding contiguous segments.
+func NewOrderedCoalesce(log coalesceLogger, flow *types.TcpIpFlow, pageCache *pageCache, streamRing **types.Ring, maxBufferedPagesTotal, maxBufferedPagesPerFlow int, DetectCoalesceInjection bool) *OrderedCoalesce {
 	return &OrderedCoalesce{
 		log:        log,
 		Flow:       flow,
@@ -148,14 +163,27 @@ func NewOrderedCoalesce(log types.Logger, flow *types.TcpIpFlow, pageCache *page
 
 		MaxBufferedPagesTotal:   maxBufferedPagesTotal,
 		MaxBufferedPagesPerFlow: maxBufferedPagesPerFlow,
+		DetectCoalesceInjection: DetectCoalesceInjection,
 	}
 }
 
 // Close returns all used pages to the page cache
 func (o *OrderedCoalesce) Close() {
 	for c := o.first; c != nil; c = c.next {
-		o.PageCache.replace(c)
+		o.release(c)
+	}
+}
+
+// release returns a page to the page cache and writes its packet to the
+// packet log once all of the packet's pages are released
+func (o *OrderedCoalesce) release(p *page) {
+	if entry := p.entry; entry != nil {
+		entry.pages -= 1
+		if entry.pages == 0 {
+			o.log.writePacketLogEntry(entry)
+		}
 	}
+	o.PageCache.replace(p)
 }
 
 func (o *OrderedCoalesce) insert(packetManifest *types.PacketManifest, nextSeq types.Sequence) (types.Sequence, bool) {
@@ -164,9 +192,11 @@ func (o *OrderedCoalesce) insert(packetManifest *types.PacketManifest, nextSeq t
 		panic("wtf")
 	}
 	// XXX for now we ignore zero size packets
-	if len(packetManifest.Payload) == 0 {
+	if packetManifest.SegmentLength() == 0 {
 		return nextSeq, false
 	}
+	// the connection learns its flows after building its coalesces
+	o.Flow = packetManifest.Flow
 	if o.pageCount < 0 {
 		panic("OrderedCoalesce.insert pageCount less than zero")
 	}
@@ -211,11 +241,19 @@ func (o *OrderedCoalesce) pagesFromTcp(p *types.PacketManifest) (*page, *page, i
 	count := 1
 	current := first
 	seq, bytes := types.Sequence(p.TCP.Seq), p.Payload
+	evidence := types.NewHeaderEvidence(p)
+	var entry *packetLogEntry
+	if o.log != nil {
+		entry = o.log.takePacketLogEntry(p)
+	}
 	for {
 		length := min(len(bytes), pageBytes)
 		current.Bytes = current.buf[:length]
 		copy(current.Bytes, bytes)
 		current.Seq = seq
+		current.TruncatedBytes = 0
+		current.Evidence = evidence
+		current.entry = entry
 		bytes = bytes[length:]
 		if len(bytes) == 0 {
 			break
@@ -227,6 +265,10 @@ func (o *OrderedCoalesce) pagesFromTcp(p *types.PacketManifest) (*page, *page, i
 		current = current.next
 	}
 	current.End = p.TCP.RST || p.TCP.FIN
+	current.TruncatedBytes = p.TruncatedBytes
+	if entry != nil {
+		entry.pages = count
+	}
 	return first, current, count
 }
 
@@ -277,7 +319,7 @@ func (o *OrderedCoalesce) freeNext() {
 		o.first = o.first.next
 		o.first.prev = nil
 	}
-	o.PageCache.replace(reclaim)
+	o.release(reclaim)
 	o.pageCount--
 	if o.pageCount < 0 {
 		// XXX wtf srsly
@@ -303,12 +345,12 @@ func (o *OrderedCoalesce) addNext(nextSeq types.Sequence) (types.Sequence, bool)
 		o.freeNext()
 		return -1, true // after closing the connection our Sequence return value doesn't matter
 	}
-	if len(o.first.Bytes) == 0 {
+	if len(o.first.Bytes)+o.first.TruncatedBytes == 0 {
 		o.freeNext()
 		return nextSeq, false
 	}
 	// ensure we do not add segments that end before nextSeq
-	diff = o.first.Seq.Add(len(o.first.Bytes)).Difference(nextSeq)
+	diff = o.first.Seq.Add(len(o.first.Bytes) + o.first.TruncatedBytes).Difference(nextSeq)
 	if diff > 0 {
 		o.freeNext()
 		return nextSeq, false
@@ -317,15 +359,18 @@ func (o *OrderedCoalesce) addNext(nextSeq types.Sequence) (types.Sequence, bool)
 		// XXX stream segment overlap condition
 		if diff < 0 {
 			p := types.PacketManifest{
-				Timestamp: o.first.Seen,
-				Payload:   o.first.Bytes,
+				Timestamp:      o.first.Seen,
+				Payload:        o.first.Bytes,
+				TruncatedBytes: o.first.TruncatedBytes,
 				TCP: layers.TCP{
 					Seq: uint32(o.first.Seq),
 				},
 			}
-			event := injectionInStreamRing(&p, o.Flow, o.StreamRing, "coalesce injection", 0)
+			event := injectionInStreamRing(&p, o.Flow, *o.StreamRing, types.EventCoalesceInjection, 0)
 			if event != nil {
-				o.log.Log(event)
+				// p only holds the bytes of the buffered segment
+				event.Evidence = o.first.Evidence
+				o.log.logBufferedEvent(event, o.first.entry)
 			} else {
 				log.Print("not an attack attempt; a normal TCP unordered stream segment coalesce\n")
 			}
@@ -334,11 +379,13 @@ func (o *OrderedCoalesce) addNext(nextSeq types.Sequence) (types.Sequence, bool)
 	bytes, seq := byteSpan(nextSeq, o.first.Seq, o.first.Bytes) // XXX injection happens here
 	if bytes != nil {
 		o.first.Bytes = bytes
-		nextSeq = seq
+		nextSeq = seq.Add(o.first.TruncatedBytes)
 		// append reassembly to the reassembly ring buffer
 		if len(o.first.Bytes) > 0 {
-			o.StreamRing.Reassembly = &o.first.Reassembly
-			o.StreamRing = o.StreamRing.Next()
+			// the page is reused once freed, so the ring keeps a copy
+			reassembly := o.first.Reassembly
+			reassembly.Bytes = append([]byte(nil), o.first.Bytes...)
+			*o.StreamRing = (*o.StreamRing).Add(&reassembly)
 		}
 	}
 	o.freeNext()
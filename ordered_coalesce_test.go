@@ -21,7 +21,7 @@ func TestOrderedCoalesceUsedPages(t *testing.T) {
 
 	var nextSeq types.Sequence = types.Sequence(1)
 
-	coalesce := NewOrderedCoalesce(nil, flow, PageCache, streamRing, maxBufferedPagesTotal, maxBufferedPagesPerFlow, false)
+	coalesce := NewOrderedCoalesce(nil, flow, PageCache, &streamRing, maxBufferedPagesTotal, maxBufferedPagesPerFlow, false)
 
 	ip := layers.IPv4{
 		SrcIP:    net.IP{1, 2, 3, 4},
@@ -51,5 +51,10 @@ func TestOrderedCoalesceUsedPages(t *testing.T) {
 		t.Fail()
 	}
 
+	coalesce.addNext(nextSeq)
+	if added := streamRing.Prev().Reassembly; added == nil || added.Seq != 3 {
+		t.Error("segment not added at the write position shared with the connection")
+	}
+
 	coalesce.Close()
 }
@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/david415/HoneyBadger/types"
+	"github.com/google/gopacket/layers"
 )
 
 type DummyPacketLogger struct {
@@ -22,7 +23,7 @@ func NewDummyPacketLogger(str string, flow *types.TcpIpFlow, pcapNum int, pcapSi
 type DummyPacketLoggerFactory struct {
 }
 
-func (f DummyPacketLoggerFactory) Build(flow *types.TcpIpFlow) types.PacketLogger {
+func (f DummyPacketLoggerFactory) Build(flow *types.TcpIpFlow, linkType layers.LinkType) types.PacketLogger {
 	return NewDummyPacketLogger("", flow, 10, 100)
 }
 
@@ -1,4 +1,4 @@
-// +build !linux
+// +build !linux !cgo
 
 /*
  *    HoneyBadger core library for detecting TCP injection attacks
@@ -22,24 +22,32 @@
 package pcap_sniffer
 
 import (
+	"errors"
 	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
 	"time"
+
+	"github.com/david415/HoneyBadger/types"
 )
 
 type PcapHandle struct {
 }
 
-func NewPcapFileSniffer(filename string) (*PcapHandle, error) {
-	return &PcapHandle{}, nil
-}
-
 func NewPcapWireSniffer(netDevice string, snaplen int32, wireDuration time.Duration, filter string) (*PcapHandle, error) {
-	return &PcapHandle{}, nil
+	return nil, errors.New("libpcap capture is only available in linux builds with cgo")
 }
 
 func (p *PcapHandle) ReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error) {
 	panic("libpcap only for linux...")
 }
 
+func (p *PcapHandle) LinkType() layers.LinkType {
+	return layers.LinkTypeEthernet
+}
+
+func (p *PcapHandle) CaptureStats() (types.CaptureStats, error) {
+	return types.CaptureStats{}, errors.New("libpcap capture is only available in linux builds with cgo")
+}
+
 func (p *PcapHandle) Close() {
 }
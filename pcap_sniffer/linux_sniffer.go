@@ -1,4 +1,4 @@
-// +build linux
+// +build linux,cgo
 
 /*
  *    HoneyBadger core library for detecting TCP injection attacks
@@ -23,22 +23,17 @@ package pcap_sniffer
 
 import (
 	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
 	"time"
+
+	"github.com/david415/HoneyBadger/types"
 )
 
 type PcapHandle struct {
 	handle *pcap.Handle
 }
 
-func NewPcapFileSniffer(filename string) (*PcapHandle, error) {
-	pcapFileHandle, err := pcap.OpenOffline(filename)
-	pcapHandle := PcapHandle{
-		handle: pcapFileHandle,
-	}
-	return &pcapHandle, err
-}
-
 func NewPcapWireSniffer(netDevice string, snaplen int32, wireDuration time.Duration, filter string) (*PcapHandle, error) {
 	pcapWireHandle, err := pcap.OpenLive(netDevice, snaplen, true, wireDuration)
 	pcapHandle := PcapHandle{
@@ -52,5 +47,23 @@ func (p *PcapHandle) ReadPacketData() (data []byte, ci gopacket.CaptureInfo, err
 	return p.handle.ReadPacketData()
 }
 
+// LinkType returns the link type of the capture
+func (p *PcapHandle) LinkType() layers.LinkType {
+	return p.handle.LinkType()
+}
+
+// CaptureStats returns the packet counters kept by libpcap
+func (p *PcapHandle) CaptureStats() (types.CaptureStats, error) {
+	stats, err := p.handle.Stats()
+	if err != nil {
+		return types.CaptureStats{}, err
+	}
+	return types.CaptureStats{
+		Received:  uint64(stats.PacketsReceived),
+		Dropped:   uint64(stats.PacketsDropped),
+		IfDropped: uint64(stats.PacketsIfDropped),
+	}, nil
+}
+
 func (p *PcapHandle) Close() {
 }
@@ -0,0 +1,226 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package pcapfile_sniffer
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// ExpandFilenames returns the capture files named by the given list of
+// file names, glob patterns and directories. Directories contribute
+// every regular file they contain which is not hidden, in name order.
+// Streams are refused since they cannot be merged, see IsStream.
+func ExpandFilenames(patterns []string) ([]string, error) {
+	var filenames []string
+	for _, pattern := range patterns {
+		var matches []string
+		if strings.ContainsAny(pattern, "*?[") {
+			var err error
+			matches, err = filepath.Glob(pattern)
+			if err != nil {
+				return nil, err
+			}
+			if matches == nil {
+				return nil, errors.New("no files match " + pattern)
+			}
+		} else if IsStream(pattern) {
+			return nil, fmt.Errorf("%s is a stream and can only be read on its own", pattern)
+		} else {
+			matches = []string{pattern}
+		}
+		for _, match := range matches {
+			info, err := os.Stat(match)
+			if err != nil {
+				return nil, err
+			}
+			if !info.IsDir() {
+				filenames = append(filenames, match)
+				continue
+			}
+			entries, err := ioutil.ReadDir(match)
+			if err != nil {
+				return nil, err
+			}
+			for _, entry := range entries {
+				if entry.Mode().IsRegular() && !strings.HasPrefix(entry.Name(), ".") {
+					filenames = append(filenames, filepath.Join(match, entry.Name()))
+				}
+			}
+		}
+	}
+	return filenames, nil
+}
+
+// mergedFile is a capture file of a MultiFileHandle along
+// with the next packet to be returned from it
+type mergedFile struct {
+	filename string
+	order    int
+	start    time.Time
+	handle   *PcapFileHandle
+	data     []byte
+	ci       gopacket.CaptureInfo
+	linkType layers.LinkType
+}
+
+// next reads the next packet of the file; it returns false
+// and closes the file once no more packets can be read
+func (f *mergedFile) next() bool {
+	var err error
+	f.data, f.ci, err = f.handle.ReadPacketData()
+	if err != nil {
+		if err != io.EOF {
+			log.Printf("%s: %s; skipping the rest of the file", f.filename, err)
+		}
+		f.handle.Close()
+		f.handle = nil
+		return false
+	}
+	f.linkType = f.handle.LinkType()
+	return true
+}
+
+// open opens the file and reads its first packet
+func (f *mergedFile) open() bool {
+	var err error
+	f.handle, err = NewPcapFileSniffer(f.filename)
+	if err != nil {
+		log.Printf("skipping %s", err)
+		return false
+	}
+	return f.next()
+}
+
+// fileHeap orders the open files by the timestamps of their next packets
+type fileHeap []*mergedFile
+
+func (h fileHeap) Len() int { return len(h) }
+func (h fileHeap) Less(i, j int) bool {
+	if h[i].ci.Timestamp.Equal(h[j].ci.Timestamp) {
+		return h[i].order < h[j].order
+	}
+	return h[i].ci.Timestamp.Before(h[j].ci.Timestamp)
+}
+func (h fileHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *fileHeap) Push(x interface{}) { *h = append(*h, x.(*mergedFile)) }
+func (h *fileHeap) Pop() interface{} {
+	old := *h
+	f := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return f
+}
+
+// byStart sorts files by the time of their first packet
+type byStart []*mergedFile
+
+func (s byStart) Len() int           { return len(s) }
+func (s byStart) Less(i, j int) bool { return s[i].start.Before(s[j].start) }
+func (s byStart) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// MultiFileHandle reads the packets of several pcap or pcapng files as
+// a single stream merged by capture timestamp, so that connections
+// spanning file boundaries are seen as they were captured. A file is
+// only kept open while the stream is within its time span, therefore
+// long series of rotated captures do not exhaust file descriptors.
+type MultiFileHandle struct {
+	pending  []*mergedFile // not yet opened, by first timestamp
+	open     fileHeap
+	linkType layers.LinkType
+}
+
+// NewMultiFileSniffer returns a MultiFileHandle for the capture files
+// named by the given file names, glob patterns and directories.
+// Files which cannot be read as captures are skipped.
+func NewMultiFileSniffer(patterns []string) (*MultiFileHandle, error) {
+	filenames, err := ExpandFilenames(patterns)
+	if err != nil {
+		return nil, err
+	}
+	m := MultiFileHandle{}
+	// peek at the first packet of each file to learn when it starts
+	for order, filename := range filenames {
+		f := &mergedFile{
+			filename: filename,
+			order:    order,
+		}
+		if !f.open() {
+			continue
+		}
+		f.start = f.ci.Timestamp
+		f.handle.Close()
+		f.handle = nil
+		m.pending = append(m.pending, f)
+	}
+	if len(m.pending) == 0 {
+		return nil, errors.New("no packets in the given capture files")
+	}
+	sort.Stable(byStart(m.pending))
+	m.linkType = m.pending[0].linkType
+	return &m, nil
+}
+
+// ReadPacketData returns the earliest packet not yet returned of all files
+func (m *MultiFileHandle) ReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error) {
+	for len(m.pending) > 0 && (len(m.open) == 0 || !m.pending[0].start.After(m.open[0].ci.Timestamp)) {
+		f := m.pending[0]
+		m.pending = m.pending[1:]
+		if f.open() {
+			heap.Push(&m.open, f)
+		}
+	}
+	if len(m.open) == 0 {
+		return nil, ci, io.EOF
+	}
+	f := m.open[0]
+	data, ci, m.linkType = f.data, f.ci, f.linkType
+	if f.next() {
+		heap.Fix(&m.open, 0)
+	} else {
+		heap.Pop(&m.open)
+	}
+	return data, ci, nil
+}
+
+// LinkType returns the link type of the most recently read packet
+func (m *MultiFileHandle) LinkType() layers.LinkType {
+	return m.linkType
+}
+
+// Close closes all open files
+func (m *MultiFileHandle) Close() {
+	for _, f := range m.open {
+		f.handle.Close()
+	}
+	m.open = nil
+	m.pending = nil
+}
@@ -0,0 +1,142 @@
+package pcapfile_sniffer
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+func writeTestPcap(t *testing.T, filename string, linkType layers.LinkType, packets []testPacket) {
+	file, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	writer := pcapgo.NewWriter(file)
+	writer.WriteFileHeader(65536, linkType)
+	for _, packet := range packets {
+		writer.WritePacket(gopacket.CaptureInfo{
+			Timestamp:     packet.timestamp,
+			CaptureLength: len(packet.data),
+			Length:        len(packet.data),
+		}, packet.data)
+	}
+}
+
+func TestMultiFileSniffer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pcapfile_sniffer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	start := time.Unix(1500000000, 0)
+	at := func(seconds int) time.Time {
+		return start.Add(time.Duration(seconds) * time.Second)
+	}
+	// one file per direction, interleaved in time
+	writeTestPcap(t, filepath.Join(dir, "b-inbound.pcap"), layers.LinkTypeEthernet, []testPacket{
+		{[]byte{1}, layers.LinkTypeEthernet, at(1)},
+		{[]byte{3}, layers.LinkTypeEthernet, at(3)},
+		{[]byte{5}, layers.LinkTypeEthernet, at(5)},
+	})
+	writeTestPcap(t, filepath.Join(dir, "a-outbound.pcap"), layers.LinkTypeEthernet, []testPacket{
+		{[]byte{2}, layers.LinkTypeEthernet, at(2)},
+		{[]byte{4}, layers.LinkTypeEthernet, at(4)},
+	})
+	// a later rotation chunk which must not be opened before its time
+	writeTestPcap(t, filepath.Join(dir, "c-rotated.pcap"), layers.LinkTypeLinuxSLL, []testPacket{
+		{[]byte{6}, layers.LinkTypeLinuxSLL, at(6)},
+		{[]byte{7}, layers.LinkTypeLinuxSLL, at(7)},
+	})
+	// neither hidden nor empty nor foreign files are packet sources
+	writeTestPcap(t, filepath.Join(dir, "d-empty.pcap"), layers.LinkTypeEthernet, nil)
+	ioutil.WriteFile(filepath.Join(dir, ".hidden.pcap"), []byte("not a capture file"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "notes.txt"), []byte("not a capture file"), 0644)
+
+	handle, err := NewMultiFileSniffer([]string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handle.Close()
+	if handle.LinkType() != layers.LinkTypeEthernet {
+		t.Errorf("link type %s before the first packet", handle.LinkType())
+	}
+	var previous []byte
+	for i := 1; i <= 7; i++ {
+		data, ci, err := handle.ReadPacketData()
+		if err != nil {
+			t.Fatalf("packet %d: %s", i, err)
+		}
+		if !bytes.Equal(data, []byte{byte(i)}) || !ci.Timestamp.Equal(at(i)) {
+			t.Errorf("packet %d: data %v timestamp %s", i, data, ci.Timestamp)
+		}
+		wantLinkType := layers.LinkTypeEthernet
+		if i > 5 {
+			wantLinkType = layers.LinkTypeLinuxSLL
+		}
+		if handle.LinkType() != wantLinkType {
+			t.Errorf("packet %d: link type %s != %s", i, handle.LinkType(), wantLinkType)
+		}
+		for _, f := range handle.open {
+			if i <= 5 && filepath.Base(f.filename) == "c-rotated.pcap" {
+				t.Errorf("packet %d: %s opened early", i, f.filename)
+			}
+		}
+		if previous != nil && previous[0] != byte(i-1) {
+			t.Errorf("packet %d overwrote the previous packet data %v", i, previous)
+		}
+		previous = data
+	}
+	if _, _, err := handle.ReadPacketData(); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+	if len(handle.open) != 0 {
+		t.Error("files left open at EOF")
+	}
+}
+
+func TestExpandFilenames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pcapfile_sniffer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"b.pcap", "a.pcap", "c.pcapng", ".hidden"} {
+		ioutil.WriteFile(filepath.Join(dir, name), nil, 0644)
+	}
+	os.Mkdir(filepath.Join(dir, "sub"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "sub", "d.pcap"), nil, 0644)
+
+	filenames, err := ExpandFilenames([]string{
+		filepath.Join(dir, "*.pcap"),
+		filepath.Join(dir, "sub"),
+		filepath.Join(dir, "c.pcapng"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"a.pcap", "b.pcap", filepath.Join("sub", "d.pcap"), "c.pcapng"}
+	if len(filenames) != len(want) {
+		t.Fatalf("expanded to %q", filenames)
+	}
+	for i, filename := range filenames {
+		if filename != filepath.Join(dir, want[i]) {
+			t.Errorf("filename %d: %s != %s", i, filename, want[i])
+		}
+	}
+
+	if _, err = ExpandFilenames([]string{filepath.Join(dir, "*.cap")}); err == nil {
+		t.Error("a glob without matches was accepted")
+	}
+	if _, err = ExpandFilenames([]string{filepath.Join(dir, "missing.pcap")}); err == nil {
+		t.Error("a missing file was accepted")
+	}
+}
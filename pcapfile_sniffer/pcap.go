@@ -0,0 +1,111 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package pcapfile_sniffer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// maxSnaplen bounds the snapshot length of pcap streams and thus the
+// packet buffer a stream can make the reader allocate
+const maxSnaplen = 256 * 1024
+
+// pcapReader reads packets from a classic pcap stream. Unlike pcapgo's
+// Reader it checks each record's capture length against the snapshot
+// length, so that corrupted or hostile streams are refused rather than
+// crashing the reader or exhausting memory.
+type pcapReader struct {
+	r              io.Reader
+	byteOrder      binary.ByteOrder
+	nanoSecsFactor uint32
+	snaplen        uint32
+	linkType       layers.LinkType
+	header         [24]byte
+	buf            []byte
+}
+
+func newPcapReader(r io.Reader) (*pcapReader, error) {
+	reader := pcapReader{r: r}
+	if _, err := io.ReadFull(r, reader.header[:24]); err != nil {
+		return nil, noEOF(err)
+	}
+	header := reader.header[:24]
+	switch {
+	case binary.LittleEndian.Uint32(header[0:4]) == pcapMagicMicroseconds:
+		reader.byteOrder, reader.nanoSecsFactor = binary.LittleEndian, 1000
+	case binary.LittleEndian.Uint32(header[0:4]) == pcapMagicNanoseconds:
+		reader.byteOrder, reader.nanoSecsFactor = binary.LittleEndian, 1
+	case binary.BigEndian.Uint32(header[0:4]) == pcapMagicMicroseconds:
+		reader.byteOrder, reader.nanoSecsFactor = binary.BigEndian, 1000
+	case binary.BigEndian.Uint32(header[0:4]) == pcapMagicNanoseconds:
+		reader.byteOrder, reader.nanoSecsFactor = binary.BigEndian, 1
+	default:
+		return nil, fmt.Errorf("unknown pcap magic number %x", header[0:4])
+	}
+	if major := reader.byteOrder.Uint16(header[4:6]); major != 2 {
+		return nil, fmt.Errorf("unsupported pcap major version %d", major)
+	}
+	reader.snaplen = reader.byteOrder.Uint32(header[16:20])
+	if reader.snaplen > maxSnaplen {
+		return nil, fmt.Errorf("pcap snapshot length %d exceeds %d", reader.snaplen, maxSnaplen)
+	}
+	if reader.snaplen == 0 {
+		// written by tools which do not truncate packets
+		reader.snaplen = maxSnaplen
+	}
+	reader.linkType = layers.LinkType(reader.byteOrder.Uint32(header[20:24]))
+	return &reader, nil
+}
+
+// ReadPacketData returns the data of the next packet record. The data
+// is only valid until the next call.
+func (r *pcapReader) ReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error) {
+	header := r.header[:16]
+	if _, err = io.ReadFull(r.r, header); err != nil {
+		return nil, ci, err
+	}
+	captureLength := r.byteOrder.Uint32(header[8:12])
+	if captureLength > r.snaplen {
+		return nil, ci, fmt.Errorf("pcap record of %d bytes exceeds the snapshot length %d", captureLength, r.snaplen)
+	}
+	fraction := int64(r.byteOrder.Uint32(header[4:8])) * int64(r.nanoSecsFactor)
+	ci.Timestamp = time.Unix(int64(r.byteOrder.Uint32(header[0:4])), fraction).UTC()
+	ci.CaptureLength = int(captureLength)
+	ci.Length = int(r.byteOrder.Uint32(header[12:16]))
+	if cap(r.buf) < ci.CaptureLength {
+		r.buf = make([]byte, ci.CaptureLength)
+	}
+	data = r.buf[:ci.CaptureLength]
+	if _, err = io.ReadFull(r.r, data); err != nil {
+		return nil, ci, noEOF(err)
+	}
+	return data, ci, nil
+}
+
+// LinkType returns the link type of the stream's packets
+func (r *pcapReader) LinkType() layers.LinkType {
+	return r.linkType
+}
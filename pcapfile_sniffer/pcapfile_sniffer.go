@@ -0,0 +1,122 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package pcapfile_sniffer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// magic numbers at the start of pcap and pcapng files
+const (
+	pcapMagicMicroseconds uint32 = 0xa1b2c3d4
+	pcapMagicNanoseconds  uint32 = 0xa1b23c4d
+	pcapngMagic           uint32 = 0x0a0d0d0a
+)
+
+// packetReader is implemented by both the pcap and pcapng readers
+type packetReader interface {
+	ReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+	LinkType() layers.LinkType
+}
+
+// PcapFileHandle reads packets from pcap or pcapng files without
+// libpcap, so that offline analysis works without cgo.
+type PcapFileHandle struct {
+	closer io.Closer
+	reader packetReader
+	stream bool
+}
+
+// NewPcapFileSniffer opens a pcap or pcapng file for reading
+func NewPcapFileSniffer(filename string) (*PcapFileHandle, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	handle, err := NewPcapReaderSniffer(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	handle.closer = file
+	return handle, nil
+}
+
+// NewPcapReaderSniffer reads a pcap or pcapng stream, telling the
+// formats apart by their magic number.
+func NewPcapReaderSniffer(r io.Reader) (*PcapFileHandle, error) {
+	buffered := bufio.NewReaderSize(r, 65536)
+	magic, err := buffered.Peek(4)
+	if err != nil {
+		return nil, err
+	}
+	handle := PcapFileHandle{}
+	switch binary.LittleEndian.Uint32(magic) {
+	case pcapngMagic:
+		handle.reader, err = newPcapngReader(buffered)
+	case pcapMagicMicroseconds, pcapMagicNanoseconds:
+		handle.reader, err = newPcapReader(buffered)
+	default:
+		switch binary.BigEndian.Uint32(magic) {
+		case pcapMagicMicroseconds, pcapMagicNanoseconds:
+			handle.reader, err = newPcapReader(buffered)
+		default:
+			err = fmt.Errorf("unknown capture file magic number %x", magic)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &handle, nil
+}
+
+// ReadPacketData returns the next packet of the file. The returned
+// data is not reused by later calls.
+func (p *PcapFileHandle) ReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error) {
+	data, ci, err = p.reader.ReadPacketData()
+	if err == io.ErrUnexpectedEOF && p.stream {
+		log.Print("capture stream ended in the middle of a packet")
+		err = io.EOF
+	}
+	if err != nil {
+		return nil, ci, err
+	}
+	return append([]byte(nil), data...), ci, nil
+}
+
+// LinkType returns the link type of the most recently read packet;
+// pcapng files may contain packets of several link types.
+func (p *PcapFileHandle) LinkType() layers.LinkType {
+	return p.reader.LinkType()
+}
+
+func (p *PcapFileHandle) Close() {
+	if p.closer != nil {
+		p.closer.Close()
+	}
+}
@@ -0,0 +1,257 @@
+package pcapfile_sniffer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// pcapngBlock returns a pcapng block with the body padded to 32 bits
+func pcapngBlock(order binary.ByteOrder, blockType uint32, body []byte) []byte {
+	for len(body)%4 != 0 {
+		body = append(body, 0)
+	}
+	block := make([]byte, 8, 12+len(body))
+	order.PutUint32(block[0:4], blockType)
+	order.PutUint32(block[4:8], uint32(12+len(body)))
+	block = append(block, body...)
+	return append(block, block[4:8]...)
+}
+
+func sectionHeader(order binary.ByteOrder) []byte {
+	body := make([]byte, 16)
+	order.PutUint32(body[0:4], byteOrderMagic)
+	order.PutUint16(body[4:6], 1)
+	binary.LittleEndian.PutUint64(body[8:16], 0xffffffffffffffff)
+	return pcapngBlock(order, blockTypeSectionHeader, body)
+}
+
+func interfaceDescription(order binary.ByteOrder, linkType layers.LinkType, tsresol byte) []byte {
+	body := make([]byte, 8)
+	order.PutUint16(body[0:2], uint16(linkType))
+	order.PutUint32(body[4:8], 65535)
+	if tsresol != 0 {
+		option := make([]byte, 8)
+		order.PutUint16(option[0:2], optionInterfaceTsResol)
+		order.PutUint16(option[2:4], 1)
+		option[4] = tsresol
+		body = append(body, option...)
+		body = append(body, 0, 0, 0, 0) // end of options
+	}
+	return pcapngBlock(order, blockTypeInterface, body)
+}
+
+func enhancedPacket(order binary.ByteOrder, iface uint32, ticks uint64, data []byte) []byte {
+	body := make([]byte, 20)
+	order.PutUint32(body[0:4], iface)
+	order.PutUint32(body[4:8], uint32(ticks>>32))
+	order.PutUint32(body[8:12], uint32(ticks))
+	order.PutUint32(body[12:16], uint32(len(data)))
+	order.PutUint32(body[16:20], uint32(len(data)))
+	return pcapngBlock(order, blockTypeEnhancedPacket, append(body, data...))
+}
+
+func simplePacket(order binary.ByteOrder, data []byte) []byte {
+	body := make([]byte, 4)
+	order.PutUint32(body[0:4], uint32(len(data)))
+	return pcapngBlock(order, blockTypeSimplePacket, append(body, data...))
+}
+
+type testPacket struct {
+	data      []byte
+	linkType  layers.LinkType
+	timestamp time.Time
+}
+
+func checkPackets(t *testing.T, handle *PcapFileHandle, want []testPacket) {
+	for i, packet := range want {
+		data, ci, err := handle.ReadPacketData()
+		if err != nil {
+			t.Fatalf("packet %d: %s", i, err)
+		}
+		if !bytes.Equal(data, packet.data) || ci.CaptureLength != len(packet.data) {
+			t.Errorf("packet %d: data %v != %v", i, data, packet.data)
+		}
+		if handle.LinkType() != packet.linkType {
+			t.Errorf("packet %d: link type %s != %s", i, handle.LinkType(), packet.linkType)
+		}
+		if !ci.Timestamp.Equal(packet.timestamp) {
+			t.Errorf("packet %d: timestamp %s != %s", i, ci.Timestamp, packet.timestamp)
+		}
+	}
+	if _, _, err := handle.ReadPacketData(); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+}
+
+func TestPcapngReader(t *testing.T) {
+	le, be := binary.LittleEndian, binary.BigEndian
+	var stream []byte
+	stream = append(stream, sectionHeader(le)...)
+	stream = append(stream, interfaceDescription(le, layers.LinkTypeEthernet, 0)...)
+	stream = append(stream, interfaceDescription(le, layers.LinkTypeRaw, 9)...)
+	stream = append(stream, enhancedPacket(le, 0, 1500000000123456, []byte{1, 2, 3})...)
+	stream = append(stream, pcapngBlock(le, 5, []byte{0, 0, 0, 0})...) // interface statistics
+	stream = append(stream, enhancedPacket(le, 1, 1500000000123456789, []byte{4, 5, 6, 7, 8})...)
+	stream = append(stream, simplePacket(le, []byte{9})...)
+	// a second section in the other byte order with binary timestamp resolution
+	stream = append(stream, sectionHeader(be)...)
+	stream = append(stream, interfaceDescription(be, layers.LinkTypeLinuxSLL, 0x80|10)...)
+	stream = append(stream, enhancedPacket(be, 0, 3*1024+512, []byte{10, 11})...)
+
+	handle, err := NewPcapReaderSniffer(bytes.NewReader(stream))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if handle.LinkType() != layers.LinkTypeEthernet {
+		t.Errorf("link type %s before the first packet", handle.LinkType())
+	}
+	checkPackets(t, handle, []testPacket{
+		{[]byte{1, 2, 3}, layers.LinkTypeEthernet, time.Unix(1500000000, 123456000)},
+		{[]byte{4, 5, 6, 7, 8}, layers.LinkTypeRaw, time.Unix(1500000000, 123456789)},
+		{[]byte{9}, layers.LinkTypeEthernet, time.Unix(1500000000, 123456789)},
+		{[]byte{10, 11}, layers.LinkTypeLinuxSLL, time.Unix(3, 500000000)},
+	})
+}
+
+func TestPcapngReaderErrors(t *testing.T) {
+	le := binary.LittleEndian
+	stream := append(sectionHeader(le), interfaceDescription(le, layers.LinkTypeEthernet, 0)...)
+	stream = append(stream, enhancedPacket(le, 3, 0, []byte{1})...)
+	handle, err := NewPcapReaderSniffer(bytes.NewReader(stream))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = handle.ReadPacketData(); err == nil {
+		t.Error("read a packet of an undescribed interface")
+	}
+
+	stream = append(sectionHeader(le), interfaceDescription(le, layers.LinkTypeEthernet, 0)...)
+	stream = append(stream, enhancedPacket(le, 0, 0, []byte{1, 2, 3, 4})...)
+	handle, err = NewPcapReaderSniffer(bytes.NewReader(stream[:len(stream)-6]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = handle.ReadPacketData(); err != io.ErrUnexpectedEOF {
+		t.Errorf("truncated block read with %v", err)
+	}
+
+	// a packet exceeding the snapshot length of its interface
+	stream = append(sectionHeader(le), interfaceDescription(le, layers.LinkTypeEthernet, 0)...)
+	stream = append(stream, enhancedPacket(le, 0, 0, make([]byte, 70000))...)
+	handle, err = NewPcapReaderSniffer(bytes.NewReader(stream))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = handle.ReadPacketData(); err == nil {
+		t.Error("read a packet exceeding the snapshot length")
+	}
+
+	if _, err = NewPcapReaderSniffer(bytes.NewReader([]byte("not a capture file"))); err == nil {
+		t.Error("accepted an unknown file format")
+	}
+}
+
+// pcapStream returns a little endian pcap stream header followed by the
+// given records
+func pcapStream(snaplen uint32, records ...[]byte) []byte {
+	stream := make([]byte, 24)
+	binary.LittleEndian.PutUint32(stream[0:4], pcapMagicMicroseconds)
+	binary.LittleEndian.PutUint16(stream[4:6], 2)
+	binary.LittleEndian.PutUint16(stream[6:8], 4)
+	binary.LittleEndian.PutUint32(stream[16:20], snaplen)
+	binary.LittleEndian.PutUint32(stream[20:24], uint32(layers.LinkTypeRaw))
+	for _, record := range records {
+		stream = append(stream, record...)
+	}
+	return stream
+}
+
+// pcapRecord returns a pcap record claiming captureLength bytes of data
+func pcapRecord(captureLength uint32, data []byte) []byte {
+	record := make([]byte, 16)
+	binary.LittleEndian.PutUint32(record[0:4], 1500000000)
+	binary.LittleEndian.PutUint32(record[8:12], captureLength)
+	binary.LittleEndian.PutUint32(record[12:16], captureLength)
+	return append(record, data...)
+}
+
+func TestPcapReaderErrors(t *testing.T) {
+	// a record longer than the snapshot length
+	stream := pcapStream(64, pcapRecord(3, []byte{1, 2, 3}), pcapRecord(1000, make([]byte, 1000)))
+	handle, err := NewPcapReaderSniffer(bytes.NewReader(stream))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _, err := handle.ReadPacketData(); err != nil || !bytes.Equal(data, []byte{1, 2, 3}) {
+		t.Fatalf("read %v, %v", data, err)
+	}
+	if _, _, err = handle.ReadPacketData(); err == nil || err == io.EOF {
+		t.Errorf("record exceeding the snapshot length read with %v", err)
+	}
+
+	stream = pcapStream(64, pcapRecord(4, []byte{1, 2}))
+	handle, err = NewPcapReaderSniffer(bytes.NewReader(stream))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = handle.ReadPacketData(); err != io.ErrUnexpectedEOF {
+		t.Errorf("truncated record read with %v", err)
+	}
+
+	if _, err = NewPcapReaderSniffer(bytes.NewReader(pcapStream(0xffffffff))); err == nil {
+		t.Error("accepted a snapshot length of 4 GiB")
+	}
+	if _, err = NewPcapReaderSniffer(bytes.NewReader(pcapStream(64)[:10])); err == nil {
+		t.Error("accepted a truncated pcap header")
+	}
+}
+
+func TestPcapFileSniffer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pcapfile_sniffer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "test.pcap")
+	file, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := pcapgo.NewWriter(file)
+	writer.WriteFileHeader(65536, layers.LinkTypeLinuxSLL)
+	timestamp := time.Unix(1500000000, 123456000)
+	for _, data := range [][]byte{{1, 2, 3}, {4, 5}} {
+		writer.WritePacket(gopacket.CaptureInfo{
+			Timestamp:     timestamp,
+			CaptureLength: len(data),
+			Length:        len(data),
+		}, data)
+	}
+	file.Close()
+
+	handle, err := NewPcapFileSniffer(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handle.Close()
+	first, _, err := handle.ReadPacketData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPackets(t, handle, []testPacket{
+		{[]byte{4, 5}, layers.LinkTypeLinuxSLL, timestamp},
+	})
+	if !bytes.Equal(first, []byte{1, 2, 3}) {
+		t.Errorf("packet data %v was overwritten by the next read", first)
+	}
+}
@@ -0,0 +1,318 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package pcapfile_sniffer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// pcapng block types, see https://github.com/pcapng/pcapng
+const (
+	blockTypeSectionHeader     uint32 = 0x0a0d0d0a
+	blockTypeInterface         uint32 = 1
+	blockTypeObsoletePacket    uint32 = 2
+	blockTypeSimplePacket      uint32 = 3
+	blockTypeEnhancedPacket    uint32 = 6
+	byteOrderMagic             uint32 = 0x1a2b3c4d
+	optionEndOfOptions         uint16 = 0
+	optionInterfaceTsResol     uint16 = 9
+	optionInterfaceTsOffset    uint16 = 14
+	maxBlockLength                    = 16 * 1024 * 1024
+	defaultTimestampResolution        = 1000000
+)
+
+// pcapngInterface holds the properties of one capture interface
+// described by an Interface Description Block
+type pcapngInterface struct {
+	linkType layers.LinkType
+	snaplen  uint32
+	// timestamps are counted in units of 1/unitsPerSecond seconds
+	unitsPerSecond uint64
+	offset         int64
+}
+
+// timestamp converts a pcapng timestamp of this interface to a time
+func (i *pcapngInterface) timestamp(high, low uint32) time.Time {
+	ticks := uint64(high)<<32 | uint64(low)
+	seconds := ticks / i.unitsPerSecond
+	remainder := ticks % i.unitsPerSecond
+	var nanoseconds uint64
+	if i.unitsPerSecond <= 1000000000 {
+		nanoseconds = remainder * 1000000000 / i.unitsPerSecond
+	} else {
+		nanoseconds = uint64(float64(remainder) * 1e9 / float64(i.unitsPerSecond))
+	}
+	return time.Unix(int64(seconds)+i.offset, int64(nanoseconds)).UTC()
+}
+
+// pcapngReader reads packets from a pcapng stream. Each section of the
+// stream may use its own byte order and each interface its own link
+// type and timestamp resolution.
+type pcapngReader struct {
+	r          io.Reader
+	byteOrder  binary.ByteOrder
+	interfaces []pcapngInterface
+	linkType   layers.LinkType
+	lastSeen   time.Time
+	header     [12]byte
+	buf        []byte
+}
+
+func newPcapngReader(r io.Reader) (*pcapngReader, error) {
+	reader := pcapngReader{
+		r:         r,
+		byteOrder: binary.LittleEndian,
+	}
+	blockType, body, err := reader.readBlock()
+	if err != nil {
+		return nil, err
+	}
+	if blockType != blockTypeSectionHeader {
+		return nil, errors.New("pcapng stream does not begin with a section header")
+	}
+	if err = reader.readSectionHeader(body); err != nil {
+		return nil, err
+	}
+	// read ahead to the first interface so that LinkType
+	// is known before the first packet is read
+	for len(reader.interfaces) == 0 {
+		blockType, body, err = reader.readBlock()
+		if err != nil {
+			return nil, noEOF(err)
+		}
+		switch blockType {
+		case blockTypeInterface:
+			err = reader.readInterface(body)
+		case blockTypeEnhancedPacket, blockTypeObsoletePacket, blockTypeSimplePacket:
+			err = errors.New("pcapng packet precedes all interface descriptions")
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	reader.linkType = reader.interfaces[0].linkType
+	return &reader, nil
+}
+
+// readBlock reads the next block and returns its type and body.
+// The body is only valid until the next call.
+func (r *pcapngReader) readBlock() (uint32, []byte, error) {
+	if _, err := io.ReadFull(r.r, r.header[:8]); err != nil {
+		return 0, nil, err
+	}
+	blockType := r.byteOrder.Uint32(r.header[0:4])
+	headerLength := 8
+	if blockType == blockTypeSectionHeader {
+		// a new section may switch byte order
+		if _, err := io.ReadFull(r.r, r.header[8:12]); err != nil {
+			return 0, nil, noEOF(err)
+		}
+		switch byteOrderMagic {
+		case binary.LittleEndian.Uint32(r.header[8:12]):
+			r.byteOrder = binary.LittleEndian
+		case binary.BigEndian.Uint32(r.header[8:12]):
+			r.byteOrder = binary.BigEndian
+		default:
+			return 0, nil, errors.New("invalid pcapng byte order magic")
+		}
+		headerLength = 12
+	}
+	length := int(r.byteOrder.Uint32(r.header[4:8]))
+	if length < headerLength+4 || length%4 != 0 || length > maxBlockLength {
+		return 0, nil, fmt.Errorf("invalid pcapng block length %d", length)
+	}
+	if cap(r.buf) < length-headerLength {
+		r.buf = make([]byte, length-headerLength)
+	}
+	block := r.buf[:length-headerLength]
+	if _, err := io.ReadFull(r.r, block); err != nil {
+		return 0, nil, noEOF(err)
+	}
+	// the block ends with a copy of its length
+	return blockType, block[:len(block)-4], nil
+}
+
+// noEOF reports a stream ending within a block as unexpected
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (r *pcapngReader) readSectionHeader(body []byte) error {
+	if len(body) < 12 {
+		return errors.New("pcapng section header too short")
+	}
+	if major := r.byteOrder.Uint16(body[0:2]); major != 1 {
+		return fmt.Errorf("unsupported pcapng major version %d", major)
+	}
+	r.interfaces = r.interfaces[:0]
+	return nil
+}
+
+func (r *pcapngReader) readInterface(body []byte) error {
+	if len(body) < 8 {
+		return errors.New("pcapng interface description too short")
+	}
+	iface := pcapngInterface{
+		linkType:       layers.LinkType(r.byteOrder.Uint16(body[0:2])),
+		snaplen:        r.byteOrder.Uint32(body[4:8]),
+		unitsPerSecond: defaultTimestampResolution,
+	}
+	if iface.snaplen > maxSnaplen {
+		return fmt.Errorf("pcapng snapshot length %d exceeds %d", iface.snaplen, maxSnaplen)
+	}
+	if iface.snaplen == 0 {
+		// the interface does not truncate packets
+		iface.snaplen = maxSnaplen
+	}
+	options := body[8:]
+	for len(options) >= 4 {
+		code := r.byteOrder.Uint16(options[0:2])
+		length := int(r.byteOrder.Uint16(options[2:4]))
+		if code == optionEndOfOptions || len(options) < 4+length {
+			break
+		}
+		value := options[4 : 4+length]
+		switch {
+		case code == optionInterfaceTsResol && length == 1:
+			exponent := uint(value[0] & 0x7f)
+			if value[0]&0x80 != 0 {
+				if exponent > 63 {
+					return fmt.Errorf("invalid pcapng timestamp resolution %x", value[0])
+				}
+				iface.unitsPerSecond = 1 << exponent
+			} else {
+				if exponent > 19 {
+					return fmt.Errorf("invalid pcapng timestamp resolution %x", value[0])
+				}
+				iface.unitsPerSecond = uint64(math.Pow10(int(exponent)))
+			}
+		case code == optionInterfaceTsOffset && length == 8:
+			iface.offset = int64(r.byteOrder.Uint64(value))
+		}
+		options = options[4+(length+3)&^3:]
+	}
+	r.interfaces = append(r.interfaces, iface)
+	return nil
+}
+
+// iface returns the interface with the given identifier
+func (r *pcapngReader) iface(id uint32) (*pcapngInterface, error) {
+	if id >= uint32(len(r.interfaces)) {
+		return nil, fmt.Errorf("pcapng packet of undescribed interface %d", id)
+	}
+	return &r.interfaces[id], nil
+}
+
+// packet returns captureLength bytes of packet data from body. Like
+// those of pcap streams, packets must not exceed the snapshot length
+// of their interface, which is bounded by maxSnaplen.
+func (i *pcapngInterface) packet(body []byte, captureLength, length uint32) ([]byte, gopacket.CaptureInfo, error) {
+	if uint64(captureLength) > uint64(len(body)) {
+		return nil, gopacket.CaptureInfo{}, errors.New("pcapng packet data exceeds its block")
+	}
+	if captureLength > i.snaplen {
+		return nil, gopacket.CaptureInfo{}, fmt.Errorf("pcapng packet of %d bytes exceeds the snapshot length %d", captureLength, i.snaplen)
+	}
+	ci := gopacket.CaptureInfo{
+		CaptureLength: int(captureLength),
+		Length:        int(length),
+	}
+	return body[:captureLength], ci, nil
+}
+
+// ReadPacketData returns the data of the next packet block, skipping
+// over all other blocks. The data is only valid until the next call.
+func (r *pcapngReader) ReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error) {
+	for {
+		blockType, body, err := r.readBlock()
+		if err != nil {
+			return nil, ci, err
+		}
+		var iface *pcapngInterface
+		switch blockType {
+		case blockTypeSectionHeader:
+			err = r.readSectionHeader(body)
+		case blockTypeInterface:
+			err = r.readInterface(body)
+		case blockTypeEnhancedPacket:
+			if len(body) < 20 {
+				return nil, ci, errors.New("pcapng enhanced packet block too short")
+			}
+			if iface, err = r.iface(r.byteOrder.Uint32(body[0:4])); err != nil {
+				return nil, ci, err
+			}
+			data, ci, err = iface.packet(body[20:], r.byteOrder.Uint32(body[12:16]), r.byteOrder.Uint32(body[16:20]))
+			ci.Timestamp = iface.timestamp(r.byteOrder.Uint32(body[4:8]), r.byteOrder.Uint32(body[8:12]))
+		case blockTypeObsoletePacket:
+			if len(body) < 20 {
+				return nil, ci, errors.New("pcapng packet block too short")
+			}
+			if iface, err = r.iface(uint32(r.byteOrder.Uint16(body[0:2]))); err != nil {
+				return nil, ci, err
+			}
+			data, ci, err = iface.packet(body[20:], r.byteOrder.Uint32(body[12:16]), r.byteOrder.Uint32(body[16:20]))
+			ci.Timestamp = iface.timestamp(r.byteOrder.Uint32(body[4:8]), r.byteOrder.Uint32(body[8:12]))
+		case blockTypeSimplePacket:
+			// simple packets belong to the first interface and carry no
+			// timestamp; they are given that of the previous packet
+			if len(body) < 4 {
+				return nil, ci, errors.New("pcapng simple packet block too short")
+			}
+			if iface, err = r.iface(0); err != nil {
+				return nil, ci, err
+			}
+			length := r.byteOrder.Uint32(body[0:4])
+			captureLength := uint32(len(body) - 4)
+			if length < captureLength {
+				captureLength = length
+			}
+			if iface.snaplen < captureLength {
+				captureLength = iface.snaplen
+			}
+			data, ci, err = iface.packet(body[4:], captureLength, length)
+			ci.Timestamp = r.lastSeen
+		}
+		if err != nil {
+			return nil, ci, err
+		}
+		if iface != nil {
+			r.linkType = iface.linkType
+			r.lastSeen = ci.Timestamp
+			return data, ci, nil
+		}
+	}
+}
+
+// LinkType returns the link type of the interface
+// which captured the most recently read packet
+func (r *pcapngReader) LinkType() layers.LinkType {
+	return r.linkType
+}
@@ -0,0 +1,122 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package pcapfile_sniffer
+
+import (
+	"io"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// replayLoopGap separates the end of one replay loop from the start of
+// the next in capture time
+const replayLoopGap = time.Second
+
+// ReplayHandle replays capture files, optionally paced at the timing
+// they were captured with and optionally more than once. The capture
+// timestamps of every loop are shifted past the end of the previous
+// loop so that capture time keeps moving forward.
+type ReplayHandle struct {
+	patterns     []string
+	speed        float64
+	loops        int
+	loop         int
+	handle       *MultiFileHandle
+	shift        time.Duration // added to the timestamps of the current loop
+	first, last  time.Time     // capture time span of the current loop
+	wallStart    time.Time
+	captureStart time.Time
+}
+
+// NewReplaySniffer returns a ReplayHandle for the capture files named by
+// the given file names, glob patterns and directories. A speed of 1
+// replays packets at the pace they were captured, 2 twice as fast and
+// so on; zero replays them as fast as they can be read. The files are
+// read loops times; zero reads them once and a negative count loops
+// until the handle is closed.
+func NewReplaySniffer(patterns []string, speed float64, loops int) (*ReplayHandle, error) {
+	handle, err := NewMultiFileSniffer(patterns)
+	if err != nil {
+		return nil, err
+	}
+	return &ReplayHandle{
+		patterns: patterns,
+		speed:    speed,
+		loops:    loops,
+		handle:   handle,
+	}, nil
+}
+
+// ReadPacketData returns the next packet once it is due
+func (r *ReplayHandle) ReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error) {
+	data, ci, err = r.handle.ReadPacketData()
+	for err == io.EOF && (r.loops < 0 || r.loop+1 < r.loops) {
+		r.handle.Close()
+		r.handle, err = NewMultiFileSniffer(r.patterns)
+		if err != nil {
+			return nil, ci, err
+		}
+		r.loop += 1
+		r.shift += r.last.Sub(r.first) + replayLoopGap
+		r.first, r.last = time.Time{}, time.Time{}
+		data, ci, err = r.handle.ReadPacketData()
+	}
+	if err != nil {
+		return nil, ci, err
+	}
+	if r.first.IsZero() {
+		r.first = ci.Timestamp
+	}
+	if ci.Timestamp.After(r.last) {
+		r.last = ci.Timestamp
+	}
+	ci.Timestamp = ci.Timestamp.Add(r.shift)
+	r.pace(ci.Timestamp)
+	return data, ci, nil
+}
+
+// pace waits until the packet with the given timestamp is due. Packets
+// are due relative to the first packet, thus reading delays do not add
+// up over the course of the replay.
+func (r *ReplayHandle) pace(timestamp time.Time) {
+	if r.speed <= 0 {
+		return
+	}
+	if r.wallStart.IsZero() {
+		r.wallStart, r.captureStart = time.Now(), timestamp
+		return
+	}
+	due := r.wallStart.Add(time.Duration(float64(timestamp.Sub(r.captureStart)) / r.speed))
+	if wait := due.Sub(time.Now()); wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// LinkType returns the link type of the most recently read packet
+func (r *ReplayHandle) LinkType() layers.LinkType {
+	return r.handle.LinkType()
+}
+
+// Close closes the capture files
+func (r *ReplayHandle) Close() {
+	r.handle.Close()
+}
@@ -0,0 +1,59 @@
+package pcapfile_sniffer
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestReplaySniffer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pcapfile_sniffer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	start := time.Unix(1500000000, 0)
+	filename := filepath.Join(dir, "test.pcap")
+	writeTestPcap(t, filename, layers.LinkTypeEthernet, []testPacket{
+		{[]byte{1}, layers.LinkTypeEthernet, start},
+		{[]byte{2}, layers.LinkTypeEthernet, start.Add(100 * time.Millisecond)},
+		{[]byte{3}, layers.LinkTypeEthernet, start.Add(200 * time.Millisecond)},
+	})
+
+	handle, err := NewReplaySniffer([]string{filename}, 2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handle.Close()
+	began := time.Now()
+	var timestamps []time.Time
+	for {
+		_, ci, err := handle.ReadPacketData()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		timestamps = append(timestamps, ci.Timestamp)
+	}
+	// two loops of 200ms of capture time each, one replay loop gap apart, at twice the speed
+	elapsed := time.Since(began)
+	if elapsed < (400*time.Millisecond+replayLoopGap)/2 {
+		t.Errorf("replay was not paced: took %s", elapsed)
+	}
+	if len(timestamps) != 6 {
+		t.Fatalf("replayed %d packets rather than 6", len(timestamps))
+	}
+	second := start.Add(200*time.Millisecond + replayLoopGap)
+	for i, want := range []time.Time{second, second.Add(100 * time.Millisecond), second.Add(200 * time.Millisecond)} {
+		if !timestamps[3+i].Equal(want) {
+			t.Errorf("packet %d of the second loop: timestamp %s != %s", i, timestamps[3+i], want)
+		}
+	}
+}
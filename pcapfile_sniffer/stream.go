@@ -0,0 +1,63 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package pcapfile_sniffer
+
+import (
+	"fmt"
+	"os"
+)
+
+// StdinFilename names the standard input as capture file
+const StdinFilename = "-"
+
+// IsStream returns true if filename names the standard input or a named
+// pipe. Streams can be read only once and only from start to end, thus
+// they cannot be merged with other capture files nor replayed.
+func IsStream(filename string) bool {
+	if filename == StdinFilename {
+		return true
+	}
+	info, err := os.Stat(filename)
+	return err == nil && info.Mode()&os.ModeNamedPipe != 0
+}
+
+// NewPcapStreamSniffer reads a pcap or pcapng stream from the standard
+// input or from a named pipe, as written by "tcpdump -w -". Opening a
+// named pipe blocks until its writer opens it. The stream ends when
+// the writer closes it; a stream cut off in the middle of a packet
+// ends there as well.
+func NewPcapStreamSniffer(filename string) (*PcapFileHandle, error) {
+	file := os.Stdin
+	if filename != StdinFilename {
+		var err error
+		file, err = os.Open(filename)
+		if err != nil {
+			return nil, err
+		}
+	}
+	handle, err := NewPcapReaderSniffer(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	handle.closer = file
+	handle.stream = true
+	return handle, nil
+}
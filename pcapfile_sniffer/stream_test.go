@@ -0,0 +1,74 @@
+// +build !windows
+
+package pcapfile_sniffer
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+func TestPcapStreamSniffer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pcapfile_sniffer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fifo := filepath.Join(dir, "capture.fifo")
+	if err = syscall.Mkfifo(fifo, 0600); err != nil {
+		t.Skip("cannot create a named pipe: ", err)
+	}
+	if !IsStream(fifo) || !IsStream("-") {
+		t.Error("named pipe or standard input not recognized as streams")
+	}
+	if _, err = ExpandFilenames([]string{fifo}); err == nil {
+		t.Error("ExpandFilenames accepted a stream")
+	}
+	regular := filepath.Join(dir, "capture.pcap")
+	writeTestPcap(t, regular, layers.LinkTypeEthernet, nil)
+	if IsStream(regular) {
+		t.Error("regular file recognized as a stream")
+	}
+
+	start := time.Unix(1400000000, 0).UTC()
+	want := []testPacket{
+		{[]byte{1, 2, 3}, layers.LinkTypeEthernet, start},
+		{[]byte{4, 5, 6}, layers.LinkTypeEthernet, start.Add(time.Second)},
+	}
+	// the writer goes away after a partial packet, as if it was killed
+	var buf bytes.Buffer
+	writer := pcapgo.NewWriter(&buf)
+	writer.WriteFileHeader(65536, layers.LinkTypeEthernet)
+	for _, packet := range want {
+		writer.WritePacket(gopacket.CaptureInfo{
+			Timestamp:     packet.timestamp,
+			CaptureLength: len(packet.data),
+			Length:        len(packet.data),
+		}, packet.data)
+	}
+	writer.WritePacket(gopacket.CaptureInfo{Timestamp: start, CaptureLength: 100, Length: 100}, make([]byte, 100))
+	stream := buf.Bytes()[:buf.Len()-50]
+	go func() {
+		file, err := os.OpenFile(fifo, os.O_WRONLY, 0)
+		if err != nil {
+			return
+		}
+		file.Write(stream)
+		file.Close()
+	}()
+
+	handle, err := NewPcapStreamSniffer(fifo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handle.Close()
+	checkPackets(t, handle, want)
+}
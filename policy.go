@@ -0,0 +1,260 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package HoneyBadger
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+// PolicyAction tells the dispatcher what to do with a new connection
+type PolicyAction int
+
+const (
+	// PolicyTrack tracks the connection
+	PolicyTrack PolicyAction = iota
+	// PolicyIgnore does not track the connection
+	PolicyIgnore
+	// PolicyTrackWithoutPayloads tracks the connection but neither
+	// logs its packets nor includes its payloads in attack reports
+	PolicyTrackWithoutPayloads
+)
+
+var policyActionNames = map[PolicyAction]string{
+	PolicyTrack:                "track",
+	PolicyIgnore:               "ignore",
+	PolicyTrackWithoutPayloads: "track-without-payload-logging",
+}
+
+func (a PolicyAction) String() string {
+	if name, ok := policyActionNames[a]; ok {
+		return name
+	}
+	return strconv.Itoa(int(a))
+}
+
+// policyEndpoint matches the addresses of a network and a port range;
+// a nil network matches any address
+type policyEndpoint struct {
+	network          *net.IPNet
+	minPort, maxPort uint16
+}
+
+func (e policyEndpoint) matches(ip net.IP, port uint16) bool {
+	if e.network != nil && !e.network.Contains(ip) {
+		return false
+	}
+	return port >= e.minPort && port <= e.maxPort
+}
+
+// PolicyRule applies its action to the connections between its
+// endpoints. Unless the rule is bidirectional, the first endpoint must
+// be the client of the connection; see policyClientFlow.
+type PolicyRule struct {
+	Action        PolicyAction
+	Bidirectional bool
+	client        policyEndpoint
+	server        policyEndpoint
+}
+
+// Matches returns true if the rule applies to the connection of the
+// given client flow
+func (r PolicyRule) Matches(clientFlow *types.TcpIpFlow) bool {
+	srcIP, srcPort, dstIP, dstPort := clientFlow.Endpoints()
+	if r.client.matches(srcIP, srcPort) && r.server.matches(dstIP, dstPort) {
+		return true
+	}
+	return r.Bidirectional && r.client.matches(dstIP, dstPort) && r.server.matches(srcIP, srcPort)
+}
+
+// FlowPolicy decides which connections the dispatcher tracks. The
+// first rule matching a connection applies; connections matching no
+// rule are tracked.
+//
+// A policy is read from text with one rule per line, in the form
+//
+//	<action> <client> <direction> <server>
+//
+// where action is track, ignore or track-without-payload-logging and
+// direction is -> to only match connections initiated by the client
+// or <-> to match both ways. The endpoints are "any", an address or
+// a CIDR network, optionally followed by a port or port range, e.g.
+//
+//	# keep SSH out of the reports
+//	ignore any -> 10.0.0.0/8:22
+//	track-without-payload-logging [2001:db8::/32]:1-1023 <-> any
+//
+// Blank lines and everything following a # are skipped.
+type FlowPolicy struct {
+	Rules []PolicyRule
+}
+
+// Action returns the action to apply to the connection of the given
+// client flow
+func (p *FlowPolicy) Action(clientFlow *types.TcpIpFlow) PolicyAction {
+	if p == nil {
+		return PolicyTrack
+	}
+	for _, rule := range p.Rules {
+		if rule.Matches(clientFlow) {
+			return rule.Action
+		}
+	}
+	return PolicyTrack
+}
+
+// policyClientFlow returns the flow from the client to the server of
+// the connection the given packet is the first seen packet of. The
+// client is the sender of that packet unless it is a SYN/ACK.
+func policyClientFlow(p *types.PacketManifest) *types.TcpIpFlow {
+	if p.TCP.SYN && p.TCP.ACK {
+		return p.Flow.Reverse()
+	}
+	return p.Flow
+}
+
+// LoadFlowPolicy reads the FlowPolicy from the given file
+func LoadFlowPolicy(filename string) (*FlowPolicy, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	policy, err := ParseFlowPolicy(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	return policy, nil
+}
+
+// ParseFlowPolicy reads a FlowPolicy from the given reader
+func ParseFlowPolicy(r io.Reader) (*FlowPolicy, error) {
+	policy := &FlowPolicy{}
+	scanner := bufio.NewScanner(r)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i != -1 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		rule, err := parsePolicyRule(fields)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineNumber, err)
+		}
+		policy.Rules = append(policy.Rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+func parsePolicyRule(fields []string) (PolicyRule, error) {
+	rule := PolicyRule{}
+	if len(fields) != 4 {
+		return rule, fmt.Errorf("expected <action> <client> <direction> <server> rather than %d fields", len(fields))
+	}
+	found := false
+	for action, name := range policyActionNames {
+		if fields[0] == name {
+			rule.Action, found = action, true
+		}
+	}
+	if !found {
+		return rule, fmt.Errorf("unknown action %q", fields[0])
+	}
+	switch fields[2] {
+	case "->":
+	case "<->":
+		rule.Bidirectional = true
+	default:
+		return rule, fmt.Errorf("unknown direction %q", fields[2])
+	}
+	var err error
+	rule.client, err = parsePolicyEndpoint(fields[1])
+	if err != nil {
+		return rule, err
+	}
+	rule.server, err = parsePolicyEndpoint(fields[3])
+	return rule, err
+}
+
+// parsePolicyEndpoint parses "any", an address or a CIDR network,
+// optionally followed by a colon and a port or port range. IPv6
+// addresses must be enclosed in square brackets to be followed by ports.
+func parsePolicyEndpoint(s string) (policyEndpoint, error) {
+	endpoint := policyEndpoint{minPort: 0, maxPort: 65535}
+	host, ports := s, ""
+	if strings.HasPrefix(s, "[") {
+		end := strings.Index(s, "]")
+		if end == -1 {
+			return endpoint, fmt.Errorf("missing ] in %q", s)
+		}
+		host, ports = s[1:end], s[end+1:]
+		if ports != "" && !strings.HasPrefix(ports, ":") {
+			return endpoint, fmt.Errorf("bad endpoint %q", s)
+		}
+		ports = strings.TrimPrefix(ports, ":")
+	} else if strings.Count(s, ":") == 1 {
+		i := strings.Index(s, ":")
+		host, ports = s[:i], s[i+1:]
+	}
+	if host != "any" {
+		if !strings.Contains(host, "/") {
+			if strings.Contains(host, ":") {
+				host += "/128"
+			} else {
+				host += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(host)
+		if err != nil {
+			return endpoint, fmt.Errorf("bad address %q", s)
+		}
+		endpoint.network = network
+	}
+	if ports == "" {
+		return endpoint, nil
+	}
+	low, high := ports, ports
+	if i := strings.Index(ports, "-"); i != -1 {
+		low, high = ports[:i], ports[i+1:]
+	}
+	minPort, err := strconv.ParseUint(low, 10, 16)
+	if err != nil {
+		return endpoint, fmt.Errorf("bad port range %q", ports)
+	}
+	maxPort, err := strconv.ParseUint(high, 10, 16)
+	if err != nil || maxPort < minPort {
+		return endpoint, fmt.Errorf("bad port range %q", ports)
+	}
+	endpoint.minPort, endpoint.maxPort = uint16(minPort), uint16(maxPort)
+	return endpoint, nil
+}
@@ -0,0 +1,150 @@
+package HoneyBadger
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/david415/HoneyBadger/types"
+	"github.com/google/gopacket/layers"
+)
+
+func makeTestEndpointsFlow(t *testing.T, src string, srcPort uint16, dst string, dstPort uint16) *types.TcpIpFlow {
+	flow, err := types.NewTcpIpFlowFromEndpoints(net.ParseIP(src), srcPort, net.ParseIP(dst), dstPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return flow
+}
+
+func TestFlowPolicy(t *testing.T) {
+	policy, err := ParseFlowPolicy(strings.NewReader(`
+# comment
+ignore any -> 10.0.0.0/8:22
+track 10.1.2.3 -> any:22 # never reached for 10.0.0.0/8 servers
+track-without-payload-logging [2001:db8::/32]:1-1023 <-> any
+ignore 192.168.1.1:1024-65535 -> 192.168.1.2
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(policy.Rules) != 4 {
+		t.Fatalf("parsed %d rules", len(policy.Rules))
+	}
+	tests := []struct {
+		flow   *types.TcpIpFlow
+		action PolicyAction
+	}{
+		{makeTestEndpointsFlow(t, "1.2.3.4", 5000, "10.9.8.7", 22), PolicyIgnore},
+		{makeTestEndpointsFlow(t, "1.2.3.4", 5000, "10.9.8.7", 23), PolicyTrack},
+		// the direction matters
+		{makeTestEndpointsFlow(t, "10.9.8.7", 22, "1.2.3.4", 5000), PolicyTrack},
+		{makeTestEndpointsFlow(t, "2001:db8::1", 80, "2001:db9::1", 5000), PolicyTrackWithoutPayloads},
+		{makeTestEndpointsFlow(t, "2001:db9::1", 5000, "2001:db8::1", 80), PolicyTrackWithoutPayloads},
+		{makeTestEndpointsFlow(t, "2001:db8::1", 5000, "2001:db9::1", 80), PolicyTrack},
+		{makeTestEndpointsFlow(t, "192.168.1.1", 1024, "192.168.1.2", 80), PolicyIgnore},
+		{makeTestEndpointsFlow(t, "192.168.1.1", 1023, "192.168.1.2", 80), PolicyTrack},
+	}
+	for _, test := range tests {
+		if action := policy.Action(test.flow); action != test.action {
+			t.Errorf("%s: action %s rather than %s", test.flow, action, test.action)
+		}
+	}
+
+	var none *FlowPolicy
+	if none.Action(tests[0].flow) != PolicyTrack {
+		t.Error("a nil policy must track all connections")
+	}
+
+	for _, line := range []string{
+		"drop any -> any",
+		"ignore any any",
+		"ignore any => any",
+		"ignore 10.0.0.0/33 -> any",
+		"ignore any -> any:80-22",
+		"ignore any -> any:65536",
+		"ignore [2001:db8::1 -> any",
+	} {
+		if _, err := ParseFlowPolicy(strings.NewReader(line)); err == nil {
+			t.Errorf("parsed bad rule %q", line)
+		}
+	}
+}
+
+func TestDispatcherFlowPolicy(t *testing.T) {
+	policy, err := ParseFlowPolicy(strings.NewReader("ignore any -> any:22\ntrack-without-payload-logging any -> any:80"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dispatcherOptions := DispatcherOptions{
+		TcpIdleTimeout: time.Minute,
+		MaxRingPackets: 40,
+		Logger:         NewDummyAttackLogger(),
+		Policy:         policy,
+	}
+	dispatcher := NewDispatcher(dispatcherOptions, &DefaultConnFactory{}, MockPacketLoggerFactory{})
+	connsChan := dispatcher.GetObservedConnectionsChan(2)
+	dispatcher.Start()
+
+	ip := layers.IPv4{
+		SrcIP:    net.IP{1, 2, 3, 4},
+		DstIP:    net.IP{2, 3, 4, 5},
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolTCP,
+	}
+	receive := func(flow *types.TcpIpFlow, tcp layers.TCP) {
+		dispatcher.ReceivePacket(&types.PacketManifest{
+			Timestamp: time.Now(),
+			Flow:      flow,
+			IP:        ip,
+			TCP:       tcp,
+		})
+	}
+	receive(makeTestPortFlow(ip, 1000, 22), layers.TCP{Seq: 3, SYN: true})
+	// the client of a connection first seen by its SYN/ACK is the receiver
+	receive(makeTestPortFlow(ip, 80, 1001), layers.TCP{Seq: 3, SYN: true, ACK: true})
+	receive(makeTestPortFlow(ip, 1002, 443), layers.TCP{Seq: 3, SYN: true})
+	<-connsChan
+	dispatcher.shards[0].stopDispatchChan <- true
+
+	conns := dispatcher.Connections()
+	if len(conns) != 2 {
+		t.Fatalf("%d connections tracked rather than 2", len(conns))
+	}
+	omitted := 0
+	for _, conn := range conns {
+		if conn.(*Connection).OmitPayloads {
+			omitted += 1
+		}
+	}
+	if omitted != 1 {
+		t.Errorf("payloads omitted for %d connections rather than 1", omitted)
+	}
+
+	dir, err := ioutil.TempDir("", "policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dispatcher.options.PolicyFile = filepath.Join(dir, "policy")
+	if err := dispatcher.ReloadFlowPolicy(); err == nil {
+		t.Error("reloaded a missing policy file")
+	}
+	if dispatcher.flowPolicy() != policy {
+		t.Error("failed reload replaced the policy")
+	}
+	if err := ioutil.WriteFile(dispatcher.options.PolicyFile, []byte("ignore any <-> any\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := dispatcher.ReloadFlowPolicy(); err != nil {
+		t.Fatal(err)
+	}
+	if dispatcher.flowPolicy().Action(makeTestPortFlow(ip, 1002, 443)) != PolicyIgnore {
+		t.Error("reloaded policy not applied")
+	}
+}
@@ -25,7 +25,6 @@ import (
 	"fmt"
 	"github.com/david415/HoneyBadger/types"
 	"log"
-	"time"
 )
 
 func displayRingSummary(ringHeadPtr *types.Ring) {
@@ -43,7 +42,7 @@ func displayRingSummary(ringHeadPtr *types.Ring) {
 	}
 }
 
-func injectionInStreamRing(p *types.PacketManifest, flow *types.TcpIpFlow, ringPtr *types.Ring, eventType string, packetCount uint64) *types.Event {
+func injectionInStreamRing(p *types.PacketManifest, flow *types.TcpIpFlow, ringPtr *types.Ring, kind types.EventKind, packetCount uint64) *types.Event {
 	start := types.Sequence(p.TCP.Seq)
 	end := start.Add(len(p.Payload) - 1)
 	head, tail := getOverlapRings(p, flow, ringPtr)
@@ -86,16 +85,18 @@ func injectionInStreamRing(p *types.PacketManifest, flow *types.TcpIpFlow, ringP
 		log.Print(hex.Dump(p.Payload[startOffset:endOffset]))
 
 		e := &types.Event{
-			Type:          eventType,
-			PacketCount:   packetCount,
-			Time:          time.Now(),
-			Flow:          flow,
-			Payload:       p.Payload,
-			Overlap:       overlapBytes,
-			StartSequence: start,
-			EndSequence:   end,
-			OverlapStart:  startOffset,
-			OverlapEnd:    endOffset,
+			Kind:            kind,
+			PacketCount:     packetCount,
+			Flow:            flow,
+			Payload:         p.Payload,
+			Overlap:         overlapBytes,
+			StartSequence:   start,
+			EndSequence:     end,
+			OverlapStart:    startOffset,
+			OverlapEnd:      endOffset,
+			Truncated:       p.TruncatedBytes != 0 || tail.Reassembly.TruncatedBytes != 0,
+			Evidence:        types.NewHeaderEvidence(p),
+			OverlapEvidence: overlapEvidence(head, tail),
 		}
 		copy(e.Overlap, overlapBytes)
 
@@ -105,6 +106,22 @@ func injectionInStreamRing(p *types.PacketManifest, flow *types.TcpIpFlow, ringP
 	}
 }
 
+// overlapEvidence returns the HeaderEvidence of the segments of the
+// ring elements from head to tail, once per segment
+func overlapEvidence(head, tail *types.Ring) []*types.HeaderEvidence {
+	var evidence []*types.HeaderEvidence
+	for current := head; ; current = current.Next() {
+		e := current.Reassembly.Evidence
+		if e != nil && (len(evidence) == 0 || evidence[len(evidence)-1] != e) {
+			evidence = append(evidence, e)
+		}
+		if current == tail {
+			break
+		}
+	}
+	return evidence
+}
+
 // getOverlapBytes takes several arguments:
 // head and tail - ring pointers used to indentify a list of ring elements.
 // start and end - sequence numbers representing locations in head and tail respectively.
@@ -271,7 +288,10 @@ func getHeadFromRing(ringPtr *types.Ring, start, end types.Sequence) *types.Ring
 func getTailFromRing(head *types.Ring, end types.Sequence) *types.Ring {
 	var ret *types.Ring
 
-	for r := head; r != head.Prev(); r = r.Next() {
+	// the empty write position of a bounded ring precedes its oldest
+	// segment, hence the loop includes head.Prev()
+	last := head.Prev()
+	for r := head; ; r = r.Next() {
 		if r.Reassembly == nil {
 			ret = r.Prev()
 			break
@@ -290,6 +310,15 @@ func getTailFromRing(head *types.Ring, end types.Sequence) *types.Ring {
 		if diff < 0 {
 			return r.Prev()
 		}
+		if r.Reassembly.TruncatedBytes != 0 {
+			// the following segments are not contiguous with the captured bytes
+			log.Print("getTailFromRing: truncated segment encountered.")
+			ret = r
+			break
+		}
+		if r == last {
+			break
+		}
 	}
 
 	// XXX
@@ -23,7 +23,8 @@ type TestOverlapBytesWant struct {
 }
 
 type DummyAttackLogger struct {
-	Count int
+	Count     int
+	LastEvent *types.Event
 }
 
 func NewDummyAttackLogger() *DummyAttackLogger {
@@ -35,6 +36,7 @@ func NewDummyAttackLogger() *DummyAttackLogger {
 
 func (d *DummyAttackLogger) Log(event *types.Event) {
 	d.Count += 1
+	d.LastEvent = event
 }
 
 func (d *DummyAttackLogger) Archive() {
@@ -58,8 +60,7 @@ func TestInjectionDetector(t *testing.T) {
 		Seq:   types.Sequence(5),
 		Bytes: []byte{1, 2, 3, 4, 5},
 	}
-	conn.ClientStreamRing.Reassembly = &reassembly
-	conn.ClientStreamRing = conn.ClientStreamRing.Next()
+	conn.ClientStreamRing = conn.ClientStreamRing.Add(&reassembly)
 
 	p := types.PacketManifest{
 		IP: layers.IPv4{
@@ -149,8 +150,7 @@ func TestGetRingSlice(t *testing.T) {
 			Bytes: []byte{1, 2, 3, 4, 5},
 		}
 
-		conn.ClientStreamRing.Reassembly = &reassembly
-		conn.ClientStreamRing = conn.ClientStreamRing.Next()
+		conn.ClientStreamRing = conn.ClientStreamRing.Add(&reassembly)
 	}
 	var startSeq uint32 = 5
 	p := types.PacketManifest{
@@ -477,8 +477,7 @@ func TestGetOverlapBytes(t *testing.T) {
 			Seq:   types.Sequence(j),
 			Bytes: []byte{byte(j + 1), byte(j + 2), byte(j + 3), byte(j + 4), byte(j + 5)},
 		}
-		conn.ClientStreamRing.Reassembly = &reassembly
-		conn.ClientStreamRing = conn.ClientStreamRing.Next()
+		conn.ClientStreamRing = conn.ClientStreamRing.Add(&reassembly)
 	}
 	for i := 0; i < len(overlapBytesTests); i++ {
 		var startSeq uint32 = overlapBytesTests[i].in.Seq
@@ -755,8 +754,7 @@ func TestGetOverlapRings(t *testing.T) {
 			Seq:   types.Sequence(j),
 			Bytes: []byte{1, 2, 3, 4, 5},
 		}
-		conn.ClientStreamRing.Reassembly = &reassembly
-		conn.ClientStreamRing = conn.ClientStreamRing.Next()
+		conn.ClientStreamRing = conn.ClientStreamRing.Add(&reassembly)
 	}
 
 	for i := 0; i < len(overlapTests); i++ {
@@ -0,0 +1,301 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package HoneyBadger
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/david415/HoneyBadger/pcapfile_sniffer"
+	"github.com/david415/HoneyBadger/types"
+)
+
+const (
+	// sensorGreeting starts the line a remote sensor introduces itself with
+	sensorGreeting = "HONEYBADGER-SENSOR "
+	// maxSensorIDLength bounds the length of sensor IDs
+	maxSensorIDLength = 64
+	// sensorGreetingTimeout is how long a remote sensor may take to
+	// introduce itself after connecting
+	sensorGreetingTimeout = 10 * time.Second
+)
+
+// ValidSensorID returns an error unless id is usable as sensor ID.
+// Sensor IDs become part of flow names and thus of log file names,
+// therefore they are restricted to letters, digits, dots, dashes and
+// underscores.
+func ValidSensorID(id string) error {
+	if id == "" || len(id) > maxSensorIDLength {
+		return fmt.Errorf("sensor ID must be 1 to %d characters long", maxSensorIDLength)
+	}
+	for _, r := range id {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+		default:
+			return fmt.Errorf("invalid character %q in sensor ID %q", r, id)
+		}
+	}
+	return nil
+}
+
+// ReadSensorSecret returns the secret shared by a SensorListener and its
+// sensors, which is the first line of the given file. Secrets must not
+// contain white space.
+func ReadSensorSecret(filename string) (string, error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+	secret := strings.TrimSpace(strings.SplitN(string(contents), "\n", 2)[0])
+	if secret == "" || strings.ContainsAny(secret, " \t\r") {
+		return "", fmt.Errorf("%s: sensor secret must be a single word", filename)
+	}
+	return secret, nil
+}
+
+// WriteSensorGreeting introduces a remote sensor with the given ID to a
+// SensorListener, proving with the secret, unless empty, that it is
+// allowed to. It must be followed by a pcap or pcapng stream of the
+// sensor's packets.
+func WriteSensorGreeting(w io.Writer, id, secret string) error {
+	if err := ValidSensorID(id); err != nil {
+		return err
+	}
+	line := sensorGreeting + id
+	if secret != "" {
+		line += " " + secret
+	}
+	_, err := io.WriteString(w, line+"\n")
+	return err
+}
+
+// readSensorGreeting returns the sensor ID of a sensor's greeting line
+// if it carries the given secret; lines longer than the reader's buffer
+// are refused.
+func readSensorGreeting(r *bufio.Reader, secret string) (string, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(string(line), sensorGreeting) {
+		return "", errors.New("not a HoneyBadger sensor")
+	}
+	fields := strings.SplitN(strings.TrimSuffix(string(line[len(sensorGreeting):]), "\n"), " ", 2)
+	given := ""
+	if len(fields) == 2 {
+		given = fields[1]
+	}
+	if subtle.ConstantTimeCompare([]byte(given), []byte(secret)) != 1 {
+		return "", errors.New("wrong sensor secret")
+	}
+	return fields[0], ValidSensorID(fields[0])
+}
+
+// loopbackOnly returns true if only local processes can connect to the
+// given socket
+func loopbackOnly(network, address string) bool {
+	if network == "unix" {
+		return true
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// SensorListener is a types.PacketSource receiving the packets of
+// remote sensors, which connect to its TCP or Unix socket. Each sensor
+// introduces itself with WriteSensorGreeting and then sends a pcap or
+// pcapng stream of the packets it captured. Sensors must know the
+// SensorSecret of the options, without which the listener only accepts
+// connections of the local host. The secret is sent in the clear, thus
+// sensors on untrusted networks should connect through a VPN or TLS
+// tunnel. The flows of each sensor
+// are bound to its sensor ID, thus identical flows seen by different
+// sensors are tracked as separate connections. Every sensor connection
+// is decoded by its own goroutine.
+type SensorListener struct {
+	options     SnifferOptions
+	supervisor  types.Supervisor
+	listener    net.Listener
+	mutex       sync.Mutex
+	conns       map[net.Conn]string
+	stopped     bool
+	startedChan chan bool
+}
+
+// NewSensorListener returns a SensorListener which listens on the
+// SensorAddress of the given options once started.
+func NewSensorListener(options SnifferOptions) types.PacketSource {
+	return &SensorListener{
+		options:     options,
+		conns:       make(map[net.Conn]string),
+		startedChan: make(chan bool, 1),
+	}
+}
+
+func (s *SensorListener) SetSupervisor(supervisor types.Supervisor) {
+	s.supervisor = supervisor
+}
+
+// GetStartedChan returns a channel which receives a value once the
+// listener is listening
+func (s *SensorListener) GetStartedChan() chan bool {
+	return s.startedChan
+}
+
+// Start listens on the socket and accepts remote sensors
+func (s *SensorListener) Start() {
+	network := s.options.SensorNetwork
+	if network == "" {
+		network = "tcp"
+	}
+	if s.options.SensorSecret == "" && !loopbackOnly(network, s.options.SensorAddress) {
+		log.Fatalf("remote sensors on %s %s must be authenticated by a sensor secret", network, s.options.SensorAddress)
+	}
+	if network == "unix" {
+		// a stale socket of a previous run would prevent listening
+		os.Remove(s.options.SensorAddress)
+	}
+	listener, err := net.Listen(network, s.options.SensorAddress)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("listening for remote sensors on %s %s", network, listener.Addr())
+	s.listener = listener
+	s.startedChan <- true
+	go s.acceptSensors()
+}
+
+// Stop closes the listening socket and the connections of all sensors
+func (s *SensorListener) Stop() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.stopped = true
+	s.listener.Close()
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// Addr returns the address the listener listens on
+func (s *SensorListener) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+func (s *SensorListener) acceptSensors() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			s.mutex.Lock()
+			stopped := s.stopped
+			s.mutex.Unlock()
+			if stopped {
+				return
+			}
+			log.Printf("accepting remote sensor: %s", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		go s.receivePackets(conn)
+	}
+}
+
+// receivePackets decodes and dispatches the packets of one remote
+// sensor until it disconnects or the listener is stopped. A sensor
+// whose packets crash the decoding is disconnected rather than taking
+// down the whole process.
+func (s *SensorListener) receivePackets(conn net.Conn) {
+	defer conn.Close()
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("disconnecting remote sensor %s: %v", conn.RemoteAddr(), r)
+		}
+	}()
+	defer func() {
+		s.mutex.Lock()
+		delete(s.conns, conn)
+		s.mutex.Unlock()
+	}()
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(sensorGreetingTimeout))
+	id, err := readSensorGreeting(reader, s.options.SensorSecret)
+	if err != nil {
+		log.Printf("rejecting remote sensor %s: %s", conn.RemoteAddr(), err)
+		return
+	}
+	handle, err := pcapfile_sniffer.NewPcapReaderSniffer(reader)
+	if err != nil {
+		log.Printf("rejecting remote sensor %s from %s: %s", id, conn.RemoteAddr(), err)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	s.mutex.Lock()
+	if s.stopped {
+		s.mutex.Unlock()
+		return
+	}
+	for _, other := range s.conns {
+		if other == id {
+			log.Printf("WARNING: remote sensor %s is connected more than once", id)
+		}
+	}
+	s.conns[conn] = id
+	s.mutex.Unlock()
+	log.Printf("remote sensor %s connected from %s", id, conn.RemoteAddr())
+
+	decoder := newPacketDecoder(s.options)
+	decoder.sensor = id
+	for {
+		rawPacket, captureInfo, err := handle.ReadPacketData()
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("remote sensor %s: %s", id, err)
+			}
+			break
+		}
+		packetManifest := decoder.Decode(TimedRawPacket{
+			Timestamp: captureInfo.Timestamp,
+			LinkType:  handle.LinkType(),
+			RawPacket: rawPacket,
+		})
+		if packetManifest == nil {
+			continue
+		}
+		s.options.Dispatcher.ReceivePacket(packetManifest)
+	}
+	log.Printf("remote sensor %s disconnected", id)
+}
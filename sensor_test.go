@@ -0,0 +1,150 @@
+package HoneyBadger
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+// channelDispatcher hands the received packets to a channel
+type channelDispatcher struct {
+	packets chan *types.PacketManifest
+}
+
+func (d *channelDispatcher) ReceivePacket(p *types.PacketManifest) {
+	d.packets <- p
+}
+
+func (d *channelDispatcher) GetObservedConnectionsChan(int) chan bool {
+	return make(chan bool)
+}
+
+func (d *channelDispatcher) Connections() []ConnectionInterface {
+	return nil
+}
+
+func sendTestSensorPacket(t *testing.T, address net.Addr, sensor, secret string, packet []byte) net.Conn {
+	conn, err := net.Dial(address.Network(), address.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	buffered := bufio.NewWriter(conn)
+	if err = WriteSensorGreeting(buffered, sensor, secret); err != nil {
+		t.Fatal(err)
+	}
+	writer := pcapgo.NewWriter(buffered)
+	writer.WriteFileHeader(65536, layers.LinkTypeRaw)
+	writer.WritePacket(gopacket.CaptureInfo{
+		Timestamp:     time.Now(),
+		CaptureLength: len(packet),
+		Length:        len(packet),
+	}, packet)
+	if err = buffered.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func TestSensorListener(t *testing.T) {
+	dispatcher := &channelDispatcher{packets: make(chan *types.PacketManifest)}
+	source := NewSensorListener(SnifferOptions{
+		SensorAddress: "127.0.0.1:0",
+		SensorSecret:  "s3cret",
+		Dispatcher:    dispatcher,
+	})
+	source.Start()
+	defer source.Stop()
+	<-source.GetStartedChan()
+	address := source.(*SensorListener).Addr()
+
+	// a client which is no sensor is disconnected
+	conn, err := net.Dial(address.Network(), address.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("GET / HTTP/1.0\n\n"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = conn.Read(make([]byte, 1)); err == nil {
+		t.Error("connection of a non-sensor was not closed")
+	}
+	conn.Close()
+
+	packet := makeTestTcpIpPacket(t, false)
+	flows := make(map[string]bool)
+	for _, sensor := range []string{"edge1", "edge2"} {
+		conn := sendTestSensorPacket(t, address, sensor, "s3cret", packet)
+		defer conn.Close()
+		select {
+		case p := <-dispatcher.packets:
+			if p.Flow.Sensor() != sensor {
+				t.Errorf("packet of sensor %s attributed to sensor %q", sensor, p.Flow.Sensor())
+			}
+			flows[p.Flow.String()] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no packet received from sensor %s", sensor)
+		}
+	}
+	if !flows["1.2.3.4:1-2.3.4.5:2@edge1"] || !flows["1.2.3.4:1-2.3.4.5:2@edge2"] {
+		t.Errorf("sensors not kept apart: %v", flows)
+	}
+
+	// neither sensors without the secret nor malformed streams are
+	// accepted, and the listener keeps serving the other sensors
+	for _, secret := range []string{"", "wrong"} {
+		conn := sendTestSensorPacket(t, address, "edge3", secret, packet)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err = conn.Read(make([]byte, 1)); err == nil {
+			t.Errorf("sensor with secret %q was not disconnected", secret)
+		}
+		conn.Close()
+	}
+	conn = sendTestSensorPacket(t, address, "edge3", "s3cret", make([]byte, 70000))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = conn.Read(make([]byte, 1)); err == nil {
+		t.Error("sensor sending a packet beyond its snapshot length was not disconnected")
+	}
+	conn.Close()
+	conn = sendTestSensorPacket(t, address, "edge3", "s3cret", packet)
+	defer conn.Close()
+	select {
+	case <-dispatcher.packets:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no packet received after a malformed stream")
+	}
+}
+
+func TestLoopbackOnly(t *testing.T) {
+	for _, address := range []string{"127.0.0.1:4242", "[::1]:4242", "localhost:4242"} {
+		if !loopbackOnly("tcp", address) {
+			t.Errorf("%s is not considered local", address)
+		}
+	}
+	for _, address := range []string{":4242", "0.0.0.0:4242", "10.0.0.1:4242"} {
+		if loopbackOnly("tcp", address) {
+			t.Errorf("%s is considered local", address)
+		}
+	}
+	if !loopbackOnly("unix", "/run/honeybadger.sock") {
+		t.Error("Unix sockets are not considered local")
+	}
+}
+
+func TestValidSensorID(t *testing.T) {
+	for _, id := range []string{"edge1", "dc-2.rack_3"} {
+		if err := ValidSensorID(id); err != nil {
+			t.Errorf("valid sensor ID %q refused: %s", id, err)
+		}
+	}
+	for _, id := range []string{"", "a/b", "edge 1", "edge1\n", string(make([]byte, 65))} {
+		if err := ValidSensorID(id); err == nil {
+			t.Errorf("invalid sensor ID %q accepted", id)
+		}
+	}
+}
@@ -20,8 +20,11 @@
 package HoneyBadger
 
 import (
+	"errors"
 	"io"
 	"log"
+	"os"
+	"sync"
 	"time"
 
 	"github.com/google/gopacket"
@@ -30,6 +33,7 @@ import (
 	"github.com/david415/HoneyBadger/afpacket_sniffer"
 	"github.com/david415/HoneyBadger/bpf_sniffer"
 	"github.com/david415/HoneyBadger/pcap_sniffer"
+	"github.com/david415/HoneyBadger/pcapfile_sniffer"
 	"github.com/david415/HoneyBadger/types"
 )
 
@@ -45,6 +49,56 @@ type SnifferOptions struct {
 	Supervisor   types.Supervisor
 	UseAfPacket  bool
 	UseBpf       bool
+	TrackVLAN    bool
+	// Filenames are further pcap or pcapng files, glob patterns or
+	// directories whose packets are merged by capture timestamp
+	// with those of Filename. A single file named "-" or a named pipe
+	// is read as an unbounded stream instead.
+	Filenames []string
+	// ReplaySpeed paces the replay of capture files at the given
+	// multiple of their captured timing; zero replays them as fast as
+	// possible. ReplayLoops is the number of times the files are
+	// replayed; zero replays them once and a negative count forever.
+	ReplaySpeed float64
+	ReplayLoops int
+	// AfpacketWorkers is the number of AF_PACKET sockets joined in a
+	// fanout group, each read and decoded by its own goroutine; values
+	// below 2 capture with a single socket.
+	AfpacketWorkers int
+	// AfpacketFrameSize, AfpacketBlockSize and AfpacketNumBlocks size
+	// the AF_PACKET ring; zero values select the defaults. AF_PACKET
+	// sockets also apply Filter, Snaplen and WireDuration, which is
+	// the longest a read waits for a packet.
+	AfpacketFrameSize int
+	AfpacketBlockSize int
+	AfpacketNumBlocks int
+	// SensorNetwork and SensorAddress are the "tcp" or "unix" socket a
+	// SensorListener accepts remote sensors on. SensorSecret is the
+	// secret remote sensors must know; without it only local
+	// connections are accepted.
+	SensorNetwork string
+	SensorAddress string
+	SensorSecret  string
+	// SkipChecksums disables the validation of IPv4 and TCP checksums,
+	// which fails for packets sent by the capturing host itself if
+	// its network interface computes their checksums.
+	SkipChecksums bool
+	// StatsInterval is how often the statistics of live captures are
+	// logged; zero disables the periodic report.
+	StatsInterval time.Duration
+	// FragmentTimeout and MaxFragmentBytes bound the reassembly of
+	// fragmented IPv4 datagrams; zero values select the defaults.
+	// Conflicting overlaps of datagrams dropped before all their
+	// fragments arrived are reported to AttackLogger, as no connection
+	// sees them.
+	FragmentTimeout  time.Duration
+	MaxFragmentBytes int
+	AttackLogger     types.Logger
+	// DecapGRE, DecapIPIP and VXLANPorts select the tunnels whose
+	// encapsulated TCP/IP packets are analyzed instead.
+	DecapGRE   bool
+	DecapIPIP  bool
+	VXLANPorts []uint16
 }
 
 // Sniffer sets up the connection pool and is an abstraction layer for dealing
@@ -57,8 +111,16 @@ type Sniffer struct {
 	supervisor       types.Supervisor
 	packetDataSource gopacket.PacketDataSource
 	pcapHandle       *pcap_sniffer.PcapHandle
+	pcapFileHandle   *pcapfile_sniffer.ReplayHandle
+	pcapStreamHandle *pcapfile_sniffer.PcapFileHandle
 	afpacketHandle   *afpacket_sniffer.AfpacketHandle
+	afpacketHandles  []*afpacket_sniffer.AfpacketHandle
+	stopWorkersChan  chan bool
+	stopStatsChan    chan bool
 	bpfHandle        *bpf_sniffer.BpfSniffer
+	// stopOnce shuts the sniffer down once, as Stop may be called
+	// more than once, e.g. by a signal racing the end of a file
+	stopOnce sync.Once
 }
 
 // NewSniffer creates a new Sniffer struct
@@ -68,6 +130,8 @@ func NewSniffer(options SnifferOptions) types.PacketSource {
 		stopCaptureChan:  make(chan bool),
 		decodePacketChan: make(chan TimedRawPacket),
 		stopDecodeChan:   make(chan bool),
+		stopWorkersChan:  make(chan bool),
+		stopStatsChan:    make(chan bool),
 	}
 	return &i
 }
@@ -81,19 +145,46 @@ func (i *Sniffer) GetStartedChan() chan bool {
 
 // Start... starts the TCP attack inquisition!
 func (i *Sniffer) Start() {
-	if i.pcapHandle == nil && i.afpacketHandle == nil {
+	if i.packetDataSource == nil && i.afpacketHandles == nil {
 		i.setupHandle()
 	}
+	if i.options.StatsInterval > 0 && len(i.captureStatsSources()) > 0 {
+		go i.logCaptureStats()
+	}
+	if i.afpacketHandles != nil {
+		for _, handle := range i.afpacketHandles {
+			go i.captureWorker(handle)
+		}
+		return
+	}
 	go i.capturePackets()
 	go i.decodePackets()
 }
 
+// Stop stops capturing and closes the capture handle. Calls after the
+// first one return once the sniffer is stopped.
 func (i *Sniffer) Stop() {
+	i.stopOnce.Do(i.stop)
+}
+
+func (i *Sniffer) stop() {
+	close(i.stopStatsChan)
+	close(i.stopWorkersChan)
+	if i.afpacketHandles != nil {
+		for _, handle := range i.afpacketHandles {
+			handle.Close()
+		}
+		return
+	}
 	i.stopCaptureChan <- true
 	i.stopDecodeChan <- true
 	if i.pcapHandle != nil {
 		i.pcapHandle.Close()
-	} else {
+	} else if i.pcapFileHandle != nil {
+		i.pcapFileHandle.Close()
+	} else if i.pcapStreamHandle != nil {
+		i.pcapStreamHandle.Close()
+	} else if i.afpacketHandle != nil {
 		i.afpacketHandle.Close()
 	}
 }
@@ -104,14 +195,26 @@ func (i *Sniffer) setupHandle() {
 		i.bpfHandle = bpf_sniffer.NewBpfSniffer()
 		err = i.bpfHandle.Init(i.options.Interface)
 		i.packetDataSource = i.bpfHandle
+	} else if i.options.UseAfPacket && i.options.AfpacketWorkers > 1 { // sniff AF_PACKET fanout group
+		log.Printf("Starting AF_PACKET capture on interface %s with %d fanout workers", i.options.Interface, i.options.AfpacketWorkers)
+		// the fanout group identifier is shared system wide
+		i.afpacketHandles, err = afpacket_sniffer.NewAfpacketFanoutHandles(i.options.Interface, i.afpacketOptions(), i.options.AfpacketWorkers, uint16(os.Getpid()))
+		if err == nil {
+			log.Printf("capturing packets with link type %s", i.afpacketHandles[0].LinkType())
+			return
+		}
 	} else if i.options.UseAfPacket { // sniff AF_PACKET
 		log.Printf("Starting AF_PACKET capture on interface %s", i.options.Interface)
-		i.afpacketHandle, err = afpacket_sniffer.NewAfpacketHandle(i.options.Interface)
+		i.afpacketHandle, err = afpacket_sniffer.NewAfpacketHandle(i.options.Interface, i.afpacketOptions())
 		i.packetDataSource = i.afpacketHandle
-	} else if i.options.Filename != "" { // sniff pcap file
-		log.Printf("Reading from pcap file %q", i.options.Filename)
-		i.pcapHandle, err = pcap_sniffer.NewPcapFileSniffer(i.options.Filename)
-		i.packetDataSource = i.pcapHandle
+	} else if filenames := i.filenames(); len(filenames) == 1 && pcapfile_sniffer.IsStream(filenames[0]) { // sniff pcap or pcapng stream
+		log.Printf("Reading from pcap stream %q", filenames[0])
+		i.pcapStreamHandle, err = pcapfile_sniffer.NewPcapStreamSniffer(filenames[0])
+		i.packetDataSource = i.pcapStreamHandle
+	} else if len(filenames) > 0 { // sniff pcap or pcapng files
+		log.Printf("Reading from pcap files %q", filenames)
+		i.pcapFileHandle, err = pcapfile_sniffer.NewReplaySniffer(filenames, i.options.ReplaySpeed, i.options.ReplayLoops)
+		i.packetDataSource = i.pcapFileHandle
 	} else { // sniff pcap wire interface
 		log.Printf("Starting pcap capture on interface %q", i.options.Interface)
 		i.pcapHandle, err = pcap_sniffer.NewPcapWireSniffer(i.options.Interface, i.options.Snaplen, i.options.WireDuration, i.options.Filter)
@@ -120,6 +223,100 @@ func (i *Sniffer) setupHandle() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	log.Printf("capturing packets with link type %s", i.linkType())
+}
+
+// afpacketOptions returns the ring and filter options of AF_PACKET sockets
+func (i *Sniffer) afpacketOptions() afpacket_sniffer.AfpacketOptions {
+	return afpacket_sniffer.AfpacketOptions{
+		FrameSize:   i.options.AfpacketFrameSize,
+		BlockSize:   i.options.AfpacketBlockSize,
+		NumBlocks:   i.options.AfpacketNumBlocks,
+		PollTimeout: i.options.WireDuration,
+		Filter:      i.options.Filter,
+		Snaplen:     int(i.options.Snaplen),
+	}
+}
+
+// filenames returns the capture files, glob patterns and directories to read
+func (i *Sniffer) filenames() []string {
+	if i.options.Filename == "" {
+		return i.options.Filenames
+	}
+	return append([]string{i.options.Filename}, i.options.Filenames...)
+}
+
+// linkTypeSource is implemented by packet data sources which know
+// the link layer type of the packets they return.
+type linkTypeSource interface {
+	LinkType() layers.LinkType
+}
+
+// linkType returns the link type of the most recently read packet.
+// Sources which cannot tell are assumed to capture Ethernet frames.
+func (i *Sniffer) linkType() layers.LinkType {
+	if source, ok := i.packetDataSource.(linkTypeSource); ok {
+		return source.LinkType()
+	}
+	return layers.LinkTypeEthernet
+}
+
+// captureStatsSources returns the handles of the live capture
+// which can report capture statistics
+func (i *Sniffer) captureStatsSources() []types.CaptureStatsSource {
+	var sources []types.CaptureStatsSource
+	for _, handle := range i.afpacketHandles {
+		sources = append(sources, handle)
+	}
+	if source, ok := i.packetDataSource.(types.CaptureStatsSource); ok {
+		sources = append(sources, source)
+	}
+	return sources
+}
+
+// CaptureStats returns the statistics of the live capture, summed
+// over all AF_PACKET fanout workers. Capture files have none.
+func (i *Sniffer) CaptureStats() (types.CaptureStats, error) {
+	sources := i.captureStatsSources()
+	if len(sources) == 0 {
+		return types.CaptureStats{}, errors.New("packet source has no capture statistics")
+	}
+	var total types.CaptureStats
+	for _, source := range sources {
+		stats, err := source.CaptureStats()
+		if err != nil {
+			return types.CaptureStats{}, err
+		}
+		total = total.Add(stats)
+	}
+	return total, nil
+}
+
+// logCaptureStats logs the capture statistics every StatsInterval
+// until the sniffer is stopped and warns of packets dropped since the
+// previous report.
+func (i *Sniffer) logCaptureStats() {
+	ticker := time.NewTicker(i.options.StatsInterval)
+	defer ticker.Stop()
+	var last types.CaptureStats
+	for {
+		select {
+		case <-i.stopStatsChan:
+			return
+		case <-ticker.C:
+		}
+		stats, err := i.CaptureStats()
+		if err != nil {
+			log.Printf("failed to read capture statistics: %s", err)
+			continue
+		}
+		log.Printf("capture statistics: %s", stats)
+		// libpcap's counters may wrap around
+		if stats.Dropped+stats.IfDropped > last.Dropped+last.IfDropped {
+			log.Printf("WARNING: %d packets dropped by the capture in the last %s", stats.Dropped+stats.IfDropped-last.Dropped-last.IfDropped, i.options.StatsInterval)
+		}
+		last = stats
+	}
 }
 
 func (i *Sniffer) capturePackets() {
@@ -141,6 +338,7 @@ func (i *Sniffer) capturePackets() {
 			}
 			tchan <- TimedRawPacket{
 				Timestamp: captureInfo.Timestamp,
+				LinkType:  i.linkType(),
 				RawPacket: rawPacket,
 			}
 		}
@@ -156,36 +354,44 @@ func (i *Sniffer) capturePackets() {
 	}
 }
 
-func (i *Sniffer) decodePackets() {
-	var eth layers.Ethernet
-	var ip layers.IPv4
-	var tcp layers.TCP
-	var payload gopacket.Payload
-
-	parser := gopacket.NewDecodingLayerParser(layers.LayerTypeEthernet, &eth, &ip, &tcp, &payload)
-	decoded := make([]gopacket.LayerType, 0, 4)
+// captureWorker reads and decodes the packets of one member of an
+// AF_PACKET fanout group until the sniffer is stopped
+func (i *Sniffer) captureWorker(handle *afpacket_sniffer.AfpacketHandle) {
+	decoder := newPacketDecoder(i.options)
+	for {
+		select {
+		case <-i.stopWorkersChan:
+			return
+		default:
+		}
+		rawPacket, captureInfo, err := handle.ReadPacketData()
+		if err != nil {
+			continue
+		}
+		packetManifest := decoder.Decode(TimedRawPacket{
+			Timestamp: captureInfo.Timestamp,
+			LinkType:  handle.LinkType(),
+			RawPacket: rawPacket,
+		})
+		if packetManifest == nil {
+			continue
+		}
+		i.options.Dispatcher.ReceivePacket(packetManifest)
+	}
+}
 
+func (i *Sniffer) decodePackets() {
+	decoder := newPacketDecoder(i.options)
 	for {
 		select {
 		case <-i.stopDecodeChan:
 			return
 		case timedRawPacket := <-i.decodePacketChan:
-			newPayload := new(gopacket.Payload)
-			payload = *newPayload
-			err := parser.DecodeLayers(timedRawPacket.RawPacket, &decoded)
-			if err != nil {
+			packetManifest := decoder.Decode(timedRawPacket)
+			if packetManifest == nil {
 				continue
 			}
-			flow := types.NewTcpIpFlowFromFlows(ip.NetworkFlow(), tcp.TransportFlow())
-			packetManifest := types.PacketManifest{
-				Timestamp: timedRawPacket.Timestamp,
-				Flow:      flow,
-				RawPacket: timedRawPacket.RawPacket,
-				IP:        ip,
-				TCP:       tcp,
-				Payload:   payload,
-			}
-			i.options.Dispatcher.ReceivePacket(&packetManifest)
+			i.options.Dispatcher.ReceivePacket(packetManifest)
 		}
 	}
 }
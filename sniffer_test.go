@@ -0,0 +1,54 @@
+package HoneyBadger
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+)
+
+// blockingDataSource returns EOF once released
+type blockingDataSource struct {
+	release chan bool
+}
+
+func (s *blockingDataSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	<-s.release
+	return nil, gopacket.CaptureInfo{}, io.EOF
+}
+
+// stoppedSupervisor records that its packet source stopped
+type stoppedSupervisor struct {
+	stopped chan bool
+}
+
+func (s *stoppedSupervisor) Stopped() {
+	close(s.stopped)
+}
+
+func (s *stoppedSupervisor) Run() {}
+
+func TestSnifferStopTwice(t *testing.T) {
+	source := &blockingDataSource{release: make(chan bool)}
+	supervisor := &stoppedSupervisor{stopped: make(chan bool)}
+	sniffer := NewSniffer(SnifferOptions{}).(*Sniffer)
+	sniffer.packetDataSource = source
+	sniffer.SetSupervisor(supervisor)
+	sniffer.Start()
+
+	stopped := make(chan bool)
+	go func() {
+		sniffer.Stop()
+		// the end of the capture stops the sniffer again
+		close(source.release)
+		<-supervisor.stopped
+		sniffer.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stopping the sniffer twice blocks")
+	}
+}
@@ -20,6 +20,7 @@
 package HoneyBadger
 
 import (
+	"errors"
 	"log"
 	"os"
 	"os/signal"
@@ -32,14 +33,21 @@ type BadgerSupervisor struct {
 	sniffer          types.PacketSource
 	childStoppedChan chan bool
 	forceQuitChan    chan os.Signal
+	statusChan       chan os.Signal
+	reloadChan       chan os.Signal
 }
 
 func NewBadgerSupervisor(snifferOptions SnifferOptions, dispatcherOptions DispatcherOptions, snifferFactoryFunc func(SnifferOptions) types.PacketSource, connectionFactory ConnectionFactory, packetLoggerFactory types.PacketLoggerFactory) *BadgerSupervisor {
 	dispatcher := NewDispatcher(dispatcherOptions, connectionFactory, packetLoggerFactory)
 	snifferOptions.Dispatcher = dispatcher
+	if snifferOptions.AttackLogger == nil {
+		snifferOptions.AttackLogger = dispatcherOptions.Logger
+	}
 	sniffer := snifferFactoryFunc(snifferOptions)
 	supervisor := BadgerSupervisor{
 		forceQuitChan:    make(chan os.Signal, 1),
+		statusChan:       make(chan os.Signal, 1),
+		reloadChan:       make(chan os.Signal, 1),
 		childStoppedChan: make(chan bool, 0),
 		dispatcher:       dispatcher,
 		sniffer:          sniffer,
@@ -57,6 +65,29 @@ func (b BadgerSupervisor) GetSniffer() types.PacketSource {
 	return b.sniffer
 }
 
+// CaptureStats returns the statistics of the packet source's live capture
+func (b BadgerSupervisor) CaptureStats() (types.CaptureStats, error) {
+	source, ok := b.sniffer.(types.CaptureStatsSource)
+	if !ok {
+		return types.CaptureStats{}, errors.New("packet source has no capture statistics")
+	}
+	return source.CaptureStats()
+}
+
+// LogStatus logs the number of tracked connections, the memory held
+// by their stream rings if budgeted and, for live captures, the
+// capture statistics
+func (b BadgerSupervisor) LogStatus() {
+	log.Printf("status: tracking %d connection(s)", b.dispatcher.ConnectionCount())
+	if budget := b.dispatcher.ringBudget; budget != nil {
+		log.Printf("status: stream rings hold %d of %d budgeted bytes", budget.Used(), b.dispatcher.options.RingMemoryBudget)
+	}
+	stats, err := b.CaptureStats()
+	if err == nil {
+		log.Printf("status: capture %s", stats)
+	}
+}
+
 func (b BadgerSupervisor) Stopped() {
 	log.Print("BadgerSupervisor.Stopped()")
 	b.childStoppedChan <- true
@@ -68,13 +99,31 @@ func (b BadgerSupervisor) Run() {
 	b.sniffer.Start()
 
 	signal.Notify(b.forceQuitChan, os.Interrupt)
+	if len(statusSignals) > 0 {
+		signal.Notify(b.statusChan, statusSignals...)
+	}
+	if len(reloadSignals) > 0 && b.dispatcher.options.PolicyFile != "" {
+		signal.Notify(b.reloadChan, reloadSignals...)
+	}
 
-	select {
-	case <-b.forceQuitChan:
-		log.Print("graceful shutdown: user force quit")
-		b.dispatcher.Stop()
-		b.sniffer.Stop()
-	case <-b.childStoppedChan:
-		log.Print("graceful shutdown: packet-source stopped")
+	for {
+		select {
+		case <-b.statusChan:
+			b.LogStatus()
+		case <-b.reloadChan:
+			err := b.dispatcher.ReloadFlowPolicy()
+			if err != nil {
+				log.Printf("failed to reload flow policy: %s", err)
+			}
+		case <-b.forceQuitChan:
+			log.Print("graceful shutdown: user force quit")
+			b.LogStatus()
+			b.dispatcher.Stop()
+			b.sniffer.Stop()
+			return
+		case <-b.childStoppedChan:
+			log.Print("graceful shutdown: packet-source stopped")
+			return
+		}
 	}
 }
@@ -0,0 +1,224 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package HoneyBadger
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/david415/HoneyBadger/types"
+)
+
+const (
+	// maxTunnelDepth limits how many nested tunnels are decapsulated
+	maxTunnelDepth = 4
+
+	vxlanHeaderLength   = 8
+	erspan2HeaderLength = 8
+	erspan3HeaderLength = 12
+
+	// ipProtocolIPv4 is IPv4 encapsulated in IP, unknown to gopacket
+	ipProtocolIPv4 layers.IPProtocol = 4
+
+	// EtherTypes of GRE payloads not known to gopacket
+	greTypeTransparentEthernet layers.EthernetType = 0x6558
+	greTypeERSPAN2             layers.EthernetType = 0x88be
+	greTypeERSPAN3             layers.EthernetType = 0x22eb
+)
+
+// gre is a gopacket.DecodingLayer for GRE headers as described in
+// RFC 2784 and RFC 2890. Decoding always ends with the GRE header since
+// the packetDecoder decapsulates tunnels itself; gopacket's layers.GRE
+// cannot be used as it expects every optional field to be present.
+type gre struct {
+	layers.BaseLayer
+	Protocol layers.EthernetType
+	Key      uint32
+}
+
+// DecodeFromBytes decodes a GRE header with its optional checksum, key
+// and sequence number fields.
+func (g *gre) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	if len(data) < 4 {
+		return errors.New("GRE packet too small")
+	}
+	if version := data[1] & 0x7; version != 0 {
+		return fmt.Errorf("unsupported GRE version %d", version)
+	}
+	if data[0]&0x40 != 0 {
+		return errors.New("unsupported GRE source routing")
+	}
+	g.Protocol = layers.EthernetType(binary.BigEndian.Uint16(data[2:4]))
+	g.Key = 0
+	length := 4
+	if data[0]&0x80 != 0 { // checksum present
+		length += 4
+	}
+	if data[0]&0x20 != 0 { // key present
+		if len(data) >= length+4 {
+			g.Key = binary.BigEndian.Uint32(data[length : length+4])
+		}
+		length += 4
+	}
+	if data[0]&0x10 != 0 { // sequence number present
+		length += 4
+	}
+	if len(data) < length {
+		return errors.New("GRE header truncated")
+	}
+	g.BaseLayer = layers.BaseLayer{Contents: data[:length], Payload: data[length:]}
+	return nil
+}
+
+func (g *gre) CanDecode() gopacket.LayerClass {
+	return layers.LayerTypeGRE
+}
+
+func (g *gre) NextLayerType() gopacket.LayerType {
+	return gopacket.LayerTypeZero
+}
+
+// isIPIPProtocol returns true if the IP protocol carries IPv4 or IPv6 packets
+func isIPIPProtocol(protocol layers.IPProtocol) bool {
+	return protocol == ipProtocolIPv4 || protocol == layers.IPProtocolIPv6 || protocol == layers.IPProtocolIPIP
+}
+
+// tunnelIPv4 is a layers.IPv4 which ends decoding with its own header
+// if its payload is an IP-in-IP tunneled packet to be decapsulated.
+type tunnelIPv4 struct {
+	layers.IPv4
+	decapIPIP bool
+}
+
+// Tunneled returns true if the payload is a packet to decapsulate
+func (ip *tunnelIPv4) Tunneled() bool {
+	return ip.decapIPIP && !isIPv4Fragment(&ip.IPv4) && isIPIPProtocol(ip.Protocol)
+}
+
+func (ip *tunnelIPv4) NextLayerType() gopacket.LayerType {
+	if ip.Tunneled() {
+		return gopacket.LayerTypeZero
+	}
+	return ip.IPv4.NextLayerType()
+}
+
+// tunnelIPv6 is a layers.IPv6 which ends decoding with its own header
+// if its payload is an IP-in-IP tunneled packet to be decapsulated.
+// Tunnels following IPv6 extension headers are not recognized.
+type tunnelIPv6 struct {
+	layers.IPv6
+	decapIPIP bool
+}
+
+// Tunneled returns true if the payload is a packet to decapsulate
+func (ip *tunnelIPv6) Tunneled() bool {
+	return ip.decapIPIP && isIPIPProtocol(ip.NextHeader)
+}
+
+func (ip *tunnelIPv6) NextLayerType() gopacket.LayerType {
+	if ip.Tunneled() {
+		return gopacket.LayerTypeZero
+	}
+	return ip.IPv6.NextLayerType()
+}
+
+// ipIPLayerType returns the layer type of packets tunneled in the given IP protocol
+func ipIPLayerType(protocol layers.IPProtocol) gopacket.LayerType {
+	if protocol == layers.IPProtocolIPv6 {
+		return layers.LayerTypeIPv6
+	}
+	return layers.LayerTypeIPv4
+}
+
+// greLayerType returns the layer type and bytes of the packet
+// carried in a GRE payload of the given protocol type
+func greLayerType(protocol layers.EthernetType, payload []byte) (gopacket.LayerType, []byte) {
+	switch protocol {
+	case layers.EthernetTypeIPv4:
+		return layers.LayerTypeIPv4, payload
+	case layers.EthernetTypeIPv6:
+		return layers.LayerTypeIPv6, payload
+	case greTypeTransparentEthernet:
+		return layers.LayerTypeEthernet, payload
+	case greTypeERSPAN2:
+		if len(payload) >= erspan2HeaderLength {
+			return layers.LayerTypeEthernet, payload[erspan2HeaderLength:]
+		}
+	case greTypeERSPAN3:
+		length := erspan3HeaderLength
+		if len(payload) >= length && payload[length-1]&0x1 != 0 { // platform specific subheader
+			length += 8
+		}
+		if len(payload) >= length {
+			return layers.LayerTypeEthernet, payload[length:]
+		}
+	}
+	return gopacket.LayerTypeZero, nil
+}
+
+// tunneledPacket returns the first layer type and the bytes of the
+// packet carried by the tunnel which the last decoded frame ended in,
+// along with a description of that tunnel. It returns
+// gopacket.LayerTypeZero if the frame did not end in a tunnel which
+// is to be decapsulated.
+func (d *packetDecoder) tunneledPacket() (gopacket.LayerType, []byte, *types.Tunnel) {
+	var tunnel types.Tunnel
+	next, payload := gopacket.LayerTypeZero, []byte(nil)
+	for _, typ := range d.decoded {
+		switch typ {
+		case layers.LayerTypeIPv4:
+			tunnel.Src, tunnel.Dst = d.ip.SrcIP, d.ip.DstIP
+			if d.ip.Tunneled() {
+				tunnel.Type = types.TunnelTypeIPIP
+				next, payload = ipIPLayerType(d.ip.Protocol), d.ip.Payload
+			}
+		case layers.LayerTypeIPv6:
+			tunnel.Src, tunnel.Dst = d.ip6.SrcIP, d.ip6.DstIP
+			if d.ip6.Tunneled() {
+				tunnel.Type = types.TunnelTypeIPIP
+				next, payload = ipIPLayerType(d.ip6.NextHeader), d.ip6.Payload
+			}
+		case layers.LayerTypeGRE:
+			if d.decapGRE {
+				tunnel.Type = types.TunnelTypeGRE
+				tunnel.Key = d.gre.Key
+				next, payload = greLayerType(d.gre.Protocol, d.gre.Payload)
+			}
+		case layers.LayerTypeUDP:
+			if d.vxlanPorts[d.udp.DstPort] && len(d.udp.Payload) >= vxlanHeaderLength && d.udp.Payload[0]&0x08 != 0 {
+				tunnel.Type = types.TunnelTypeVXLAN
+				tunnel.Key = binary.BigEndian.Uint32(d.udp.Payload[4:8]) >> 8
+				next, payload = layers.LayerTypeEthernet, d.udp.Payload[vxlanHeaderLength:]
+			}
+		}
+	}
+	if next == gopacket.LayerTypeZero {
+		return next, nil, nil
+	}
+	// the decoding layers are reused for the tunneled packet
+	tunnel.Src = append(net.IP(nil), tunnel.Src...)
+	tunnel.Dst = append(net.IP(nil), tunnel.Dst...)
+	return next, payload, &tunnel
+}
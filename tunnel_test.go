@@ -0,0 +1,140 @@
+package HoneyBadger
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/david415/HoneyBadger/types"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// makeTestOuterFrame returns an Ethernet frame carrying an IPv4 packet
+// of the given protocol from 10.0.0.1 to 10.0.0.2 with the given layers
+func makeTestOuterFrame(t *testing.T, protocol layers.IPProtocol, l ...gopacket.SerializableLayer) []byte {
+	eth := layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0xde, 0xad, 0xbe, 0xee, 0xee, 0xff},
+		DstMAC:       net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := layers.IPv4{
+		SrcIP:    net.IP{10, 0, 0, 1},
+		DstIP:    net.IP{10, 0, 0, 2},
+		Version:  4,
+		TTL:      64,
+		Protocol: protocol,
+	}
+	for _, layer := range l {
+		if udp, ok := layer.(*layers.UDP); ok {
+			udp.SetNetworkLayerForChecksum(&ip)
+		}
+	}
+	return serializeTestLayers(t, append([]gopacket.SerializableLayer{&eth, &ip}, l...)...)
+}
+
+func makeTestVXLANFrame(t *testing.T, port layers.UDPPort, vni uint32) []byte {
+	eth := layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0xde, 0xad, 0xbe, 0xee, 0xee, 0xff},
+		DstMAC:       net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	inner := serializeTestLayers(t, &eth, gopacket.Payload(makeTestTcpIpPacket(t, false)))
+	vxlan := make([]byte, 8)
+	vxlan[0] = 0x08
+	binary.BigEndian.PutUint32(vxlan[4:], vni<<8)
+	udp := layers.UDP{
+		SrcPort: 12345,
+		DstPort: port,
+	}
+	return makeTestOuterFrame(t, layers.IPProtocolUDP, &udp, gopacket.Payload(append(vxlan, inner...)))
+}
+
+func checkTestTunnel(t *testing.T, p *types.PacketManifest, typ string, key uint32) {
+	if p == nil {
+		t.Fatalf("failed to decapsulate %s tunnel", typ)
+	}
+	checkTestManifest(t, p, false, "1.2.3.4:1-2.3.4.5:2")
+	tunnel := p.Tunnel
+	if tunnel == nil {
+		t.Fatal("tunnel not recorded")
+	}
+	if tunnel.Type != typ || !tunnel.Src.Equal(net.IP{10, 0, 0, 1}) || !tunnel.Dst.Equal(net.IP{10, 0, 0, 2}) || tunnel.Key != key {
+		t.Errorf("bad tunnel %s", tunnel)
+	}
+}
+
+func TestDecapVXLAN(t *testing.T) {
+	frame := makeTestVXLANFrame(t, 4789, 42)
+	timedRawPacket := TimedRawPacket{
+		Timestamp: time.Now(),
+		LinkType:  layers.LinkTypeEthernet,
+		RawPacket: frame,
+	}
+	if p := newPacketDecoder(SnifferOptions{}).Decode(timedRawPacket); p != nil {
+		t.Error("decapsulated VXLAN without being configured to")
+	}
+	if p := newPacketDecoder(SnifferOptions{VXLANPorts: []uint16{8472}}).Decode(timedRawPacket); p != nil {
+		t.Error("decapsulated VXLAN on an unconfigured port")
+	}
+	decoder := newPacketDecoder(SnifferOptions{VXLANPorts: []uint16{8472, 4789}})
+	p := decoder.Decode(timedRawPacket)
+	checkTestTunnel(t, p, types.TunnelTypeVXLAN, 42)
+	if &p.RawPacket[0] != &frame[0] {
+		t.Error("RawPacket is not the encapsulating frame")
+	}
+}
+
+func TestDecapGRE(t *testing.T) {
+	// GRE with checksum and key fields carrying IPv4
+	header := make([]byte, 12)
+	header[0] = 0xa0
+	binary.BigEndian.PutUint16(header[2:4], uint16(layers.EthernetTypeIPv4))
+	binary.BigEndian.PutUint32(header[8:12], 7)
+	frame := makeTestOuterFrame(t, layers.IPProtocolGRE, gopacket.Payload(append(header, makeTestTcpIpPacket(t, false)...)))
+	timedRawPacket := TimedRawPacket{
+		Timestamp: time.Now(),
+		LinkType:  layers.LinkTypeEthernet,
+		RawPacket: frame,
+	}
+	if p := newPacketDecoder(SnifferOptions{}).Decode(timedRawPacket); p != nil {
+		t.Error("decapsulated GRE without being configured to")
+	}
+	decoder := newPacketDecoder(SnifferOptions{DecapGRE: true})
+	checkTestTunnel(t, decoder.Decode(timedRawPacket), types.TunnelTypeGRE, 7)
+
+	// ERSPAN type II mirrored Ethernet frame
+	eth := layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0xde, 0xad, 0xbe, 0xee, 0xee, 0xff},
+		DstMAC:       net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	header = make([]byte, 8+8)
+	header[0] = 0x10
+	binary.BigEndian.PutUint16(header[2:4], uint16(greTypeERSPAN2))
+	inner := serializeTestLayers(t, &eth, gopacket.Payload(makeTestTcpIpPacket(t, false)))
+	timedRawPacket.RawPacket = makeTestOuterFrame(t, layers.IPProtocolGRE, gopacket.Payload(append(header, inner...)))
+	checkTestTunnel(t, decoder.Decode(timedRawPacket), types.TunnelTypeGRE, 0)
+}
+
+func TestDecapIPIP(t *testing.T) {
+	timedRawPacket := TimedRawPacket{
+		Timestamp: time.Now(),
+		LinkType:  layers.LinkTypeEthernet,
+		RawPacket: makeTestOuterFrame(t, ipProtocolIPv4, gopacket.Payload(makeTestTcpIpPacket(t, false))),
+	}
+	if p := newPacketDecoder(SnifferOptions{}).Decode(timedRawPacket); p != nil {
+		t.Error("decapsulated IP-in-IP without being configured to")
+	}
+	decoder := newPacketDecoder(SnifferOptions{DecapIPIP: true})
+	checkTestTunnel(t, decoder.Decode(timedRawPacket), types.TunnelTypeIPIP, 0)
+
+	// IPv6 in IPv4
+	timedRawPacket.RawPacket = makeTestOuterFrame(t, layers.IPProtocolIPv6, gopacket.Payload(makeTestTcpIpPacket(t, true)))
+	p := decoder.Decode(timedRawPacket)
+	if p == nil || p.Tunnel == nil {
+		t.Fatal("failed to decapsulate IPv6 in IPv4")
+	}
+	checkTestManifest(t, p, true, "[2001:db8::1]:1-[2001:db8::2]:2")
+}
@@ -0,0 +1,55 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package types
+
+import (
+	"fmt"
+)
+
+// CaptureStats are the packet counters of a live capture since it was
+// opened. Received counts the packets seen by the capture, Dropped those
+// it dropped for lack of buffer space and IfDropped those dropped by the
+// network interface or its driver. Counters a capture does not keep are
+// left zero.
+type CaptureStats struct {
+	Received  uint64
+	Dropped   uint64
+	IfDropped uint64
+}
+
+// Add returns the sum of both statistics
+func (s CaptureStats) Add(other CaptureStats) CaptureStats {
+	return CaptureStats{
+		Received:  s.Received + other.Received,
+		Dropped:   s.Dropped + other.Dropped,
+		IfDropped: s.IfDropped + other.IfDropped,
+	}
+}
+
+func (s CaptureStats) String() string {
+	return fmt.Sprintf("received %d dropped %d if-dropped %d", s.Received, s.Dropped, s.IfDropped)
+}
+
+// CaptureStatsSource is implemented by packet sources which can report
+// the statistics of their capture. Sources without a live capture, such
+// as capture file readers, return an error.
+type CaptureStatsSource interface {
+	CaptureStats() (CaptureStats, error)
+}
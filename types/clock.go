@@ -0,0 +1,69 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package types
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the current time to connection idle timeouts and
+// attack reports.
+type Clock interface {
+	Now() time.Time
+}
+
+// WallClock is the Clock of live captures; it tells the system time.
+type WallClock struct{}
+
+// Now returns the system time
+func (WallClock) Now() time.Time {
+	return time.Now()
+}
+
+// PacketClock is the Clock of offline replays; its time is the latest
+// packet capture timestamp it was advanced to, therefore timeouts and
+// reports follow the time of the capture no matter how fast it is read.
+type PacketClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+// NewPacketClock returns a PacketClock which has not seen a packet yet
+func NewPacketClock() *PacketClock {
+	return &PacketClock{}
+}
+
+// Now returns the latest packet timestamp seen
+func (c *PacketClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+// Advance moves the clock to the given packet timestamp; the clock
+// never goes backwards, thus out of order packets leave it unchanged.
+func (c *PacketClock) Advance(timestamp time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.now.Before(timestamp) {
+		c.now = timestamp
+	}
+}
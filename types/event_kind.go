@@ -0,0 +1,158 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package types
+
+import (
+	"strconv"
+)
+
+// EventSchemaVersion is the version of the attack report format.
+// Version 1 reports only carry the event type string; version 2
+// reports add the category, subtype and severity of the event.
+const EventSchemaVersion = 2
+
+// EventSeverity rates how likely an event is an actual attack
+// which the receiver of the packets was exposed to
+type EventSeverity int
+
+const (
+	SeverityUnknown EventSeverity = iota
+	SeverityLow
+	SeverityMedium
+	SeverityHigh
+)
+
+var severityNames = []string{"unknown", "low", "medium", "high"}
+
+func (s EventSeverity) String() string {
+	if s < 0 || int(s) >= len(severityNames) {
+		return strconv.Itoa(int(s))
+	}
+	return severityNames[s]
+}
+
+// Event categories
+const (
+	CategoryInjection       = "injection"
+	CategoryHijack          = "hijack"
+	CategoryCensorInjection = "censor-injection"
+	CategoryEvasion         = "evasion"
+	CategoryAnomaly         = "anomaly"
+)
+
+// EventKind enumerates the events the detectors report
+type EventKind int
+
+const (
+	EventUnknown EventKind = iota
+	// EventOrderedInjection is a segment conflicting with stream
+	// data received before it
+	EventOrderedInjection
+	// EventCoalesceInjection is a buffered out of order segment
+	// conflicting with stream data received before it was coalesced
+	EventCoalesceInjection
+	// EventBadChecksumInjection is a segment with a bad checksum,
+	// which its receiver discards, conflicting with stream data
+	EventBadChecksumInjection
+	// EventHandshakeHijack is a second SYN/ACK of a different
+	// sequence acknowledging the SYN
+	EventHandshakeHijack
+	// EventCensorInjectionRST, EventCensorInjectionFIN and
+	// EventCensorInjectionCoalesce are data sent at the sequence of
+	// the RST, the FIN or the end of stream closing the connection
+	EventCensorInjectionRST
+	EventCensorInjectionFIN
+	EventCensorInjectionCoalesce
+	// EventIPFragmentOverlap is an IP datagram reassembled from
+	// fragments which overlapped with conflicting contents
+	EventIPFragmentOverlap
+	// EventTTLAnomaly and EventIPIDAnomaly are packets whose TTL or
+	// IP ID deviates from those of the other packets of their flow
+	EventTTLAnomaly
+	EventIPIDAnomaly
+)
+
+type eventKindInfo struct {
+	category string
+	subtype  string
+	severity EventSeverity
+	// legacy is the event type string of version 1 reports
+	legacy string
+}
+
+var eventKinds = map[EventKind]eventKindInfo{
+	EventOrderedInjection:        {CategoryInjection, "ordered", SeverityHigh, "ordered injection"},
+	EventCoalesceInjection:       {CategoryInjection, "coalesce", SeverityHigh, "coalesce injection"},
+	EventBadChecksumInjection:    {CategoryInjection, "bad-checksum", SeverityLow, "bad-checksum injection"},
+	EventHandshakeHijack:         {CategoryHijack, "handshake", SeverityHigh, "handshake-hijack"},
+	EventCensorInjectionRST:      {CategoryCensorInjection, "rst", SeverityHigh, "censor-injection-RST_closing-sequence-overlap"},
+	EventCensorInjectionFIN:      {CategoryCensorInjection, "fin", SeverityHigh, "censor-injection-FIN_closing-sequence-overlap"},
+	EventCensorInjectionCoalesce: {CategoryCensorInjection, "coalesce", SeverityHigh, "censor-injection-coalesce_closing-sequence-overlap"},
+	EventIPFragmentOverlap:       {CategoryEvasion, "ip-fragment-overlap", SeverityMedium, "ip-fragment-overlap"},
+	EventTTLAnomaly:              {CategoryAnomaly, "ttl", SeverityLow, "ttl anomaly"},
+	EventIPIDAnomaly:             {CategoryAnomaly, "ip-id", SeverityLow, "ip-id anomaly"},
+}
+
+// Category returns the category of the event kind, e.g. "injection"
+func (k EventKind) Category() string {
+	return eventKinds[k].category
+}
+
+// Subtype returns the subtype of the event kind within its
+// category, e.g. "ordered"
+func (k EventKind) Subtype() string {
+	return eventKinds[k].subtype
+}
+
+// Severity returns the severity of events of the kind
+func (k EventKind) Severity() EventSeverity {
+	return eventKinds[k].severity
+}
+
+// String returns the event type string used by version 1 reports,
+// e.g. "ordered injection"
+func (k EventKind) String() string {
+	if info, ok := eventKinds[k]; ok {
+		return info.legacy
+	}
+	return "unknown"
+}
+
+// EventKindOf returns the event kind of the given category and
+// subtype, or EventUnknown if there is none
+func EventKindOf(category, subtype string) EventKind {
+	for kind, info := range eventKinds {
+		if info.category == category && info.subtype == subtype {
+			return kind
+		}
+	}
+	return EventUnknown
+}
+
+// ParseEventKind returns the event kind of the given version 1 event
+// type string, or EventUnknown if there is none
+func ParseEventKind(s string) EventKind {
+	for kind, info := range eventKinds {
+		if info.legacy == s {
+			return kind
+		}
+	}
+	return EventUnknown
+}
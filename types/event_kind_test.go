@@ -0,0 +1,52 @@
+package types
+
+import (
+	"testing"
+)
+
+func TestEventKind(t *testing.T) {
+	for kind := range eventKinds {
+		if kind.Category() == "" || kind.Subtype() == "" || kind.Severity() == SeverityUnknown {
+			t.Errorf("%s is not fully described", kind)
+		}
+		if EventKindOf(kind.Category(), kind.Subtype()) != kind {
+			t.Errorf("%s/%s does not identify %s", kind.Category(), kind.Subtype(), kind)
+		}
+		if ParseEventKind(kind.String()) != kind {
+			t.Errorf("type string %q does not identify its kind", kind)
+		}
+	}
+	// the type strings of version 1 reports
+	for s, kind := range map[string]EventKind{
+		"ordered injection":                                  EventOrderedInjection,
+		"coalesce injection":                                 EventCoalesceInjection,
+		"handshake-hijack":                                   EventHandshakeHijack,
+		"censor-injection-RST_closing-sequence-overlap":      EventCensorInjectionRST,
+		"censor-injection-coalesce_closing-sequence-overlap": EventCensorInjectionCoalesce,
+		"ip-fragment-overlap":                                EventIPFragmentOverlap,
+	} {
+		if ParseEventKind(s) != kind {
+			t.Errorf("%q parsed as %s", s, ParseEventKind(s))
+		}
+	}
+	if ParseEventKind("no such event") != EventUnknown || EventKindOf(CategoryInjection, "") != EventUnknown {
+		t.Error("unknown event kind parsed")
+	}
+	if EventBadChecksumInjection.Severity() >= EventOrderedInjection.Severity() {
+		t.Error("bad-checksum injections must be less severe than ordered injections")
+	}
+}
+
+func TestEventResolveKind(t *testing.T) {
+	// events of consumers predating Kind only have a type string
+	event := Event{Type: "coalesce injection"}
+	event.ResolveKind()
+	if event.Kind != EventCoalesceInjection {
+		t.Errorf("kind %s parsed from type %q", event.Kind, event.Type)
+	}
+	event = Event{Kind: EventHandshakeHijack}
+	event.ResolveKind()
+	if event.Type != "handshake-hijack" {
+		t.Errorf("type %q set from kind %s", event.Type, event.Kind)
+	}
+}
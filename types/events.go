@@ -20,7 +20,10 @@
 package types
 
 import (
+	"fmt"
 	"time"
+
+	"github.com/google/gopacket/layers"
 )
 
 type Logger interface {
@@ -35,12 +38,21 @@ type PacketLogger interface {
 	Archive()
 }
 
+// AnnotatingPacketLogger is a PacketLogger which can attach comments,
+// such as descriptions of attack events, to the packets it logs
+type AnnotatingPacketLogger interface {
+	PacketLogger
+	WriteAnnotatedPacket(rawPacket []byte, timestamp time.Time, comments []string)
+}
+
+// PacketLoggerFactory builds a PacketLogger for a flow whose raw
+// packets are framed according to the given link type
 type PacketLoggerFactory interface {
-	Build(*TcpIpFlow) PacketLogger
+	Build(*TcpIpFlow, layers.LinkType) PacketLogger
 }
 
 type Event struct {
-	Type          string
+	Kind          EventKind
 	PacketCount   uint64
 	Flow          *TcpIpFlow
 	Time          time.Time
@@ -52,4 +64,54 @@ type Event struct {
 	EndSequence   Sequence
 	OverlapStart  int
 	OverlapEnd    int
+	Tunnel        *Tunnel
+	// Truncated is set if the capture cut off the end of the
+	// packet or of the stream segment it was compared with; only
+	// the captured bytes were compared.
+	Truncated bool
+	// Evidence records the headers of the packet the event was
+	// detected for, and OverlapEvidence those of the stream segments
+	// it conflicted with, in sequence order. For header anomalies
+	// OverlapEvidence holds the headers of the flow's last regular packet.
+	Evidence        *HeaderEvidence
+	OverlapEvidence []*HeaderEvidence
+	// Type is the event type string of Kind, see ResolveKind.
+	//
+	// Deprecated: use Kind. Type is kept for one more release.
+	Type string
+}
+
+// ResolveKind sets the Kind of events built with only the deprecated
+// Type, and sets Type from Kind for consumers still reading it.
+func (e *Event) ResolveKind() {
+	if e.Kind == EventUnknown && e.Type != "" {
+		e.Kind = ParseEventKind(e.Type)
+	}
+	if e.Type == "" {
+		e.Type = e.Kind.String()
+	}
+}
+
+// String returns a one line description of the event, for example
+// "ordered injection: packet 12, sequence 1000-1010, overlap bytes 3-7"
+func (e *Event) String() string {
+	s := fmt.Sprintf("%s: packet %d", e.Kind, e.PacketCount)
+	if e.HijackSeq != 0 || e.HijackAck != 0 {
+		s += fmt.Sprintf(", hijack seq %d ack %d", e.HijackSeq, e.HijackAck)
+	}
+	if e.EndSequence != 0 {
+		s += fmt.Sprintf(", sequence %d-%d", e.StartSequence, e.EndSequence)
+	} else if e.StartSequence != 0 {
+		s += fmt.Sprintf(", sequence %d", e.StartSequence)
+	}
+	if e.OverlapStart != 0 || e.OverlapEnd != 0 {
+		s += fmt.Sprintf(", overlap bytes %d-%d", e.OverlapStart, e.OverlapEnd)
+	}
+	if e.Tunnel != nil {
+		s += fmt.Sprintf(", tunnel %s", e.Tunnel)
+	}
+	if e.Truncated {
+		s += ", truncated capture"
+	}
+	return s
 }
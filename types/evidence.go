@@ -0,0 +1,104 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package types
+
+import (
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// HeaderEvidence records the IP and TCP header fields of a segment
+// which tell apart the hosts and stacks that sent it. An injected
+// segment whose headers differ from those of the segments it
+// conflicts with is likely to have been sent by another host.
+//
+// IPID is zero for IPv6 packets, whose TTL is the hop limit and whose
+// DSCP is taken from the traffic class. TCPOptions lists the options
+// in the order they were sent, e.g. "MSS:05b4,NOP,WS:07".
+// SrcMAC is empty unless the packet was captured with a link header
+// carrying it.
+type HeaderEvidence struct {
+	Seq        Sequence
+	Seen       time.Time
+	TTL        uint8
+	IPID       uint16
+	DSCP       uint8
+	Window     uint16
+	TCPOptions string
+	SrcMAC     string
+}
+
+// NewHeaderEvidence returns the HeaderEvidence of the given packet
+func NewHeaderEvidence(p *PacketManifest) *HeaderEvidence {
+	e := &HeaderEvidence{
+		Seq:        Sequence(p.TCP.Seq),
+		Seen:       p.Timestamp,
+		Window:     p.TCP.Window,
+		TCPOptions: formatTCPOptions(p.TCP.Options),
+	}
+	if p.IsIPv6() {
+		e.TTL = p.IPv6.HopLimit
+		e.DSCP = p.IPv6.TrafficClass >> 2
+	} else {
+		e.TTL = p.IP.TTL
+		e.IPID = p.IP.Id
+		e.DSCP = p.IP.TOS >> 2
+	}
+	if len(p.SrcMAC) != 0 {
+		e.SrcMAC = p.SrcMAC.String()
+	}
+	return e
+}
+
+// tcpOptionNames are the names of the common TCP option kinds
+var tcpOptionNames = map[uint8]string{
+	0:  "EOL",
+	1:  "NOP",
+	2:  "MSS",
+	3:  "WS",
+	4:  "SACKOK",
+	5:  "SACK",
+	8:  "TS",
+	19: "MD5",
+	29: "AO",
+	30: "MPTCP",
+	34: "TFO",
+}
+
+// formatTCPOptions returns the kinds of the given TCP options, each
+// followed by its data in hex if it has any
+func formatTCPOptions(options []layers.TCPOption) string {
+	formatted := make([]string, 0, len(options))
+	for _, option := range options {
+		s, ok := tcpOptionNames[option.OptionType]
+		if !ok {
+			s = strconv.Itoa(int(option.OptionType))
+		}
+		if len(option.OptionData) != 0 {
+			s += ":" + hex.EncodeToString(option.OptionData)
+		}
+		formatted = append(formatted, s)
+	}
+	return strings.Join(formatted, ",")
+}
@@ -20,19 +20,57 @@
 package types
 
 import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 )
 
-// SequenceFromPacket returns a Sequence number and nil error if the given
-// packet is able to be parsed. Otherwise returns 0 and an error.
-func SequenceFromPacket(packet []byte) (uint32, error) {
-	var ip layers.IPv4
+// decodeTcpIpPacket parses a raw IPv4 or IPv6 packet, skipping over any
+// IPv6 extension headers, and returns the IP flow and TCP layer.
+func decodeTcpIpPacket(packet []byte) (gopacket.Flow, *layers.TCP, error) {
+	var ip4 layers.IPv4
+	var ip6 layers.IPv6
+	var ip6extensions layers.IPv6ExtensionSkipper
 	var tcp layers.TCP
+	var payload gopacket.Payload
+	var parser *gopacket.DecodingLayerParser
+
+	if len(packet) == 0 {
+		return gopacket.Flow{}, nil, errors.New("empty packet")
+	}
+	if packet[0]>>4 == 6 {
+		parser = gopacket.NewDecodingLayerParser(layers.LayerTypeIPv6, &ip6, &ip6extensions, &tcp, &payload)
+	} else {
+		parser = gopacket.NewDecodingLayerParser(layers.LayerTypeIPv4, &ip4, &tcp, &payload)
+	}
 	decoded := []gopacket.LayerType{}
-	parser := gopacket.NewDecodingLayerParser(layers.LayerTypeIPv4, &ip, &tcp)
 	err := parser.DecodeLayers(packet, &decoded)
+	if err != nil {
+		return gopacket.Flow{}, nil, err
+	}
+	for _, typ := range decoded {
+		if typ != layers.LayerTypeTCP {
+			continue
+		}
+		if decoded[0] == layers.LayerTypeIPv6 {
+			return ip6.NetworkFlow(), &tcp, nil
+		}
+		return ip4.NetworkFlow(), &tcp, nil
+	}
+	return gopacket.Flow{}, nil, errors.New("not a TCP packet")
+}
+
+// SequenceFromPacket returns a Sequence number and nil error if the given
+// packet is able to be parsed. Otherwise returns 0 and an error.
+func SequenceFromPacket(packet []byte) (uint32, error) {
+	_, tcp, err := decodeTcpIpPacket(packet)
 	if err != nil {
 		return 0, err
 	}
@@ -44,14 +82,58 @@ func SequenceFromPacket(packet []byte) (uint32, error) {
 // which guarantees collisions of a flow's reverse:
 // A->B == B->A
 // https://github.com/google/gopacket/blob/master/flows.go
+//
+// Distinct connections may collide as well, e.g. A:1->B:2 and
+// A:2->B:1, therefore it is only used to spread connections
+// over dispatcher shards; ConnectionKey identifies a connection.
+//
+// VLANTags is only set if the flow was created with VLAN tracking
+// so that identical 4-tuples on different VLANs do not collide;
+// likewise Sensor keeps apart the flows of different remote sensors.
 type ConnectionHash struct {
 	IpFlowHash, TcpFlowHash uint64
+	VLANTags                VLANTags
+	Sensor                  string
+}
+
+// VLANTags identifies the stack of 802.1Q tags a flow was observed on,
+// outermost tag first. Zero entries mean no tag.
+type VLANTags [2]uint16
+
+// NewVLANTags returns the VLANTags for the given VLAN identifiers which
+// are ordered outermost first. Only the outermost two tags are kept.
+func NewVLANTags(ids ...uint16) VLANTags {
+	var tags VLANTags
+	copy(tags[:], ids)
+	return tags
+}
+
+// depth returns the number of tags in the stack, including outer tags
+// with the identifier zero such as priority tags
+func (v VLANTags) depth() int {
+	for n := len(v); n > 0; n-- {
+		if v[n-1] != 0 {
+			return n
+		}
+	}
+	return 0
+}
+
+// String returns the string representation of VLANTags, e.g. vlan100
+// for a single tag or vlan100.200 for a QinQ tag stack.
+func (v VLANTags) String() string {
+	if v[1] != 0 {
+		return fmt.Sprintf("vlan%d.%d", v[0], v[1])
+	}
+	return fmt.Sprintf("vlan%d", v[0])
 }
 
 // TcpIpFlow is used for tracking unidirectional TCP flows
 type TcpIpFlow struct {
 	ipFlow  gopacket.Flow
 	tcpFlow gopacket.Flow
+	vlans   VLANTags
+	sensor  string
 }
 
 // NewTcpIpFlowFromLayers given IPv4 and TCP layers it returns a TcpIpFlow
@@ -62,6 +144,14 @@ func NewTcpIpFlowFromLayers(ipLayer layers.IPv4, tcpLayer layers.TCP) *TcpIpFlow
 	}
 }
 
+// NewTcpIpFlowFromIPv6Layers given IPv6 and TCP layers it returns a TcpIpFlow
+func NewTcpIpFlowFromIPv6Layers(ipLayer layers.IPv6, tcpLayer layers.TCP) *TcpIpFlow {
+	return &TcpIpFlow{
+		ipFlow:  ipLayer.NetworkFlow(),
+		tcpFlow: tcpLayer.TransportFlow(),
+	}
+}
+
 // NewTcpIpFlowFromFlows given an IP flow and TCP flow returns a TcpIpFlow
 func NewTcpIpFlowFromFlows(ipFlow gopacket.Flow, tcpFlow gopacket.Flow) *TcpIpFlow {
 	// XXX todo: check that the flow types are correct
@@ -71,6 +161,16 @@ func NewTcpIpFlowFromFlows(ipFlow gopacket.Flow, tcpFlow gopacket.Flow) *TcpIpFl
 	}
 }
 
+// NewTcpIpFlowWithVLANTags given an IP flow, TCP flow and the VLAN tags
+// the packet was received on returns a TcpIpFlow
+func NewTcpIpFlowWithVLANTags(ipFlow gopacket.Flow, tcpFlow gopacket.Flow, vlans VLANTags) *TcpIpFlow {
+	return &TcpIpFlow{
+		ipFlow:  ipFlow,
+		tcpFlow: tcpFlow,
+		vlans:   vlans,
+	}
+}
+
 // ConnectionHash returns a hash of the flow A->B such
 // that it is guaranteed to collide with flow B->A
 //
@@ -80,43 +180,251 @@ func (t *TcpIpFlow) ConnectionHash() ConnectionHash {
 	return ConnectionHash{
 		IpFlowHash:  t.ipFlow.FastHash(),
 		TcpFlowHash: t.tcpFlow.FastHash(),
+		VLANTags:    t.vlans,
+		Sensor:      t.sensor,
+	}
+}
+
+// ConnectionKey identifies a TCP connection by the full endpoints of
+// its flows. Both directions of a connection have the same key, with
+// the lesser IP and port pair first, and distinct connections never do.
+type ConnectionKey struct {
+	LowIP, HighIP     gopacket.Endpoint
+	LowPort, HighPort gopacket.Endpoint
+	VLANTags          VLANTags
+	Sensor            string
+}
+
+// ConnectionKey returns the direction independent key of the
+// connection the flow belongs to
+func (t *TcpIpFlow) ConnectionKey() ConnectionKey {
+	key := ConnectionKey{
+		LowIP:    t.ipFlow.Src(),
+		HighIP:   t.ipFlow.Dst(),
+		LowPort:  t.tcpFlow.Src(),
+		HighPort: t.tcpFlow.Dst(),
+		VLANTags: t.vlans,
+		Sensor:   t.sensor,
+	}
+	if key.HighIP.LessThan(key.LowIP) || (key.HighIP == key.LowIP && key.HighPort.LessThan(key.LowPort)) {
+		key.LowIP, key.HighIP = key.HighIP, key.LowIP
+		key.LowPort, key.HighPort = key.HighPort, key.LowPort
 	}
+	return key
 }
 
-// String returns the string representation of a TcpIpFlow
+// String returns the string representation of a TcpIpFlow.
+// IPv6 addresses are enclosed in square brackets, e.g.
+// [2001:db8::1]:80-[2001:db8::2]:1234
+// and VLAN tags, if any, are appended e.g. 1.2.3.4:80-5.6.7.8:1234-vlan100
+// followed by the remote sensor, if any, e.g. 1.2.3.4:80-5.6.7.8:1234@edge1
 func (t TcpIpFlow) String() string {
-	return fmt.Sprintf("%s:%s-%s:%s", t.ipFlow.Src().String(), t.tcpFlow.Src().String(), t.ipFlow.Dst().String(), t.tcpFlow.Dst().String())
+	s := fmt.Sprintf("%s:%s-%s:%s", hostString(t.ipFlow.Src()), t.tcpFlow.Src().String(), hostString(t.ipFlow.Dst()), t.tcpFlow.Dst().String())
+	if t.vlans != (VLANTags{}) {
+		s += "-" + t.vlans.String()
+	}
+	if t.sensor != "" {
+		s += "@" + t.sensor
+	}
+	return s
+}
+
+// hostString returns the string form of an IP endpoint, bracketing
+// IPv6 addresses so that the port separator remains unambiguous.
+func hostString(e gopacket.Endpoint) string {
+	ip := net.IP(e.Raw())
+	if len(ip) == net.IPv6len && ip.To4() == nil {
+		return "[" + ip.String() + "]"
+	}
+	return e.String()
 }
 
 // Reverse returns a reversed TcpIpFlow, that is to say the resulting
 // TcpIpFlow flow will be made up of a reversed IP flow and a reversed
 // TCP flow.
 func (t *TcpIpFlow) Reverse() *TcpIpFlow {
-	return NewTcpIpFlowFromFlows(t.ipFlow.Reverse(), t.tcpFlow.Reverse())
+	return NewTcpIpFlowWithVLANTags(t.ipFlow.Reverse(), t.tcpFlow.Reverse(), t.vlans).WithSensor(t.sensor)
 }
 
 // Equal returns true if TcpIpFlow structs t and s are equal. False otherwise.
 func (t *TcpIpFlow) Equal(s *TcpIpFlow) bool {
-	return t.ipFlow == s.ipFlow && t.tcpFlow == s.tcpFlow
+	return t.ipFlow == s.ipFlow && t.tcpFlow == s.tcpFlow && t.vlans == s.vlans && t.sensor == s.sensor
 }
 
-// getPacketFlow returns a TcpIpFlow struct given a byte array packet
+// NewTcpIpFlowFromPacket returns a TcpIpFlow struct given a byte array
+// containing an IPv4 or IPv6 packet
 func NewTcpIpFlowFromPacket(packet []byte) (*TcpIpFlow, error) {
-	var ip layers.IPv4
-	var tcp layers.TCP
-	decoded := []gopacket.LayerType{}
-	parser := gopacket.NewDecodingLayerParser(layers.LayerTypeIPv4, &ip, &tcp)
-	err := parser.DecodeLayers(packet, &decoded)
+	ipFlow, tcp, err := decodeTcpIpPacket(packet)
 	if err != nil {
 		return &TcpIpFlow{}, err
 	}
 	return &TcpIpFlow{
-		ipFlow:  ip.NetworkFlow(),
+		ipFlow:  ipFlow,
 		tcpFlow: tcp.TransportFlow(),
 	}, nil
 }
 
-// Flows returns the component flow structs IPv4, TCP
+// Flows returns the component flow structs IP, TCP
 func (t *TcpIpFlow) Flows() (gopacket.Flow, gopacket.Flow) {
 	return t.ipFlow, t.tcpFlow
 }
+
+// VLANTags returns the VLAN tags this flow is bound to
+func (t *TcpIpFlow) VLANTags() VLANTags {
+	return t.vlans
+}
+
+// WithSensor returns a copy of the flow bound to the given remote
+// sensor, which observed it.
+func (t *TcpIpFlow) WithSensor(sensor string) *TcpIpFlow {
+	flow := *t
+	flow.sensor = sensor
+	return &flow
+}
+
+// Sensor returns the ID of the remote sensor which observed this
+// flow or an empty string for locally captured flows
+func (t *TcpIpFlow) Sensor() string {
+	return t.sensor
+}
+
+// NewTcpIpFlowFromEndpoints returns the TcpIpFlow from srcIP:srcPort to
+// dstIP:dstPort. Both addresses must be of the same IP version.
+func NewTcpIpFlowFromEndpoints(srcIP net.IP, srcPort uint16, dstIP net.IP, dstPort uint16) (*TcpIpFlow, error) {
+	if srcIP == nil || dstIP == nil {
+		return nil, errors.New("invalid IP address")
+	}
+	// flows decoded from IPv4 packets hold 4 byte addresses
+	if srcIP.To4() != nil && dstIP.To4() != nil {
+		srcIP, dstIP = srcIP.To4(), dstIP.To4()
+	}
+	src, dst := layers.NewIPEndpoint(srcIP), layers.NewIPEndpoint(dstIP)
+	ipFlow, err := gopacket.FlowFromEndpoints(src, dst)
+	if err != nil || (srcIP.To4() == nil) != (dstIP.To4() == nil) {
+		return nil, errors.New("IP addresses of different versions")
+	}
+	tcpFlow, _ := gopacket.FlowFromEndpoints(layers.NewTCPPortEndpoint(layers.TCPPort(srcPort)), layers.NewTCPPortEndpoint(layers.TCPPort(dstPort)))
+	return NewTcpIpFlowFromFlows(ipFlow, tcpFlow), nil
+}
+
+// Endpoints returns the source and destination addresses and ports of the flow
+func (t *TcpIpFlow) Endpoints() (srcIP net.IP, srcPort uint16, dstIP net.IP, dstPort uint16) {
+	srcIP, dstIP = net.IP(t.ipFlow.Src().Raw()), net.IP(t.ipFlow.Dst().Raw())
+	if src, dst := t.tcpFlow.Src().Raw(), t.tcpFlow.Dst().Raw(); len(src) == 2 && len(dst) == 2 {
+		srcPort, dstPort = binary.BigEndian.Uint16(src), binary.BigEndian.Uint16(dst)
+	}
+	return srcIP, srcPort, dstIP, dstPort
+}
+
+// ParseTcpIpFlow parses the string representation of a TcpIpFlow
+// as returned by TcpIpFlow.String
+func ParseTcpIpFlow(s string) (*TcpIpFlow, error) {
+	flowString := s
+	var sensor string
+	if i := strings.LastIndex(s, "@"); i != -1 {
+		s, sensor = s[:i], s[i+1:]
+		if sensor == "" {
+			return nil, fmt.Errorf("invalid flow %q: empty sensor", flowString)
+		}
+	}
+	var vlans VLANTags
+	if i := strings.LastIndex(s, "-vlan"); i != -1 {
+		ids := strings.Split(s[i+len("-vlan"):], ".")
+		if len(ids) > len(vlans) {
+			return nil, fmt.Errorf("invalid flow %q: too many VLAN tags", flowString)
+		}
+		for n, id := range ids {
+			vlan, err := strconv.ParseUint(id, 10, 12)
+			if err != nil {
+				return nil, fmt.Errorf("invalid flow %q: bad VLAN identifier %q", flowString, id)
+			}
+			vlans[n] = uint16(vlan)
+		}
+		s = s[:i]
+	}
+	hosts := strings.Split(s, "-")
+	if len(hosts) != 2 {
+		return nil, fmt.Errorf("invalid flow %q", flowString)
+	}
+	var ips [2]net.IP
+	var ports [2]uint16
+	for n, hostPort := range hosts {
+		host, port, err := net.SplitHostPort(hostPort)
+		if err != nil {
+			return nil, fmt.Errorf("invalid flow %q: %s", flowString, err)
+		}
+		ips[n] = net.ParseIP(host)
+		// IPv6 addresses must be bracketed so that they can be told apart
+		if ips[n] == nil || (ips[n].To4() == nil) != strings.HasPrefix(hostPort, "[") {
+			return nil, fmt.Errorf("invalid flow %q: bad IP address %q", flowString, host)
+		}
+		number, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid flow %q: bad port %q", flowString, port)
+		}
+		ports[n] = uint16(number)
+	}
+	flow, err := NewTcpIpFlowFromEndpoints(ips[0], ports[0], ips[1], ports[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid flow %q: %s", flowString, err)
+	}
+	flow.vlans = vlans
+	flow.sensor = sensor
+	return flow, nil
+}
+
+// tcpIpFlowJSON is the JSON representation of a TcpIpFlow
+type tcpIpFlowJSON struct {
+	SrcIP   string
+	SrcPort uint16
+	DstIP   string
+	DstPort uint16
+	VLANs   []uint16 `json:",omitempty"`
+	Sensor  string   `json:",omitempty"`
+}
+
+// MarshalJSON encodes the flow as an object with the addresses and
+// ports of its endpoints
+func (t TcpIpFlow) MarshalJSON() ([]byte, error) {
+	srcIP, srcPort, dstIP, dstPort := t.Endpoints()
+	flow := tcpIpFlowJSON{
+		SrcIP:   srcIP.String(),
+		SrcPort: srcPort,
+		DstIP:   dstIP.String(),
+		DstPort: dstPort,
+		Sensor:  t.sensor,
+	}
+	if depth := t.vlans.depth(); depth > 0 {
+		flow.VLANs = t.vlans[:depth]
+	}
+	return json.Marshal(flow)
+}
+
+// UnmarshalJSON decodes a flow encoded by MarshalJSON or the JSON string
+// of its string representation
+func (t *TcpIpFlow) UnmarshalJSON(data []byte) error {
+	var s string
+	if json.Unmarshal(data, &s) == nil {
+		flow, err := ParseTcpIpFlow(s)
+		if err != nil {
+			return err
+		}
+		*t = *flow
+		return nil
+	}
+	var encoded tcpIpFlowJSON
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return err
+	}
+	if len(encoded.VLANs) > len(t.vlans) {
+		return errors.New("too many VLAN tags in flow")
+	}
+	flow, err := NewTcpIpFlowFromEndpoints(net.ParseIP(encoded.SrcIP), encoded.SrcPort, net.ParseIP(encoded.DstIP), encoded.DstPort)
+	if err != nil {
+		return err
+	}
+	flow.vlans = NewVLANTags(encoded.VLANs...)
+	flow.sensor = encoded.Sensor
+	*t = *flow
+	return nil
+}
@@ -1,6 +1,7 @@
 package types
 
 import (
+	"encoding/json"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"net"
@@ -130,3 +131,276 @@ func TestNewTcpIpFlowFromPacket(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func makeTestIPv6Packet(t *testing.T, seq uint32, withExtension bool) []byte {
+	ip6 := layers.IPv6{
+		SrcIP:      net.ParseIP("2001:db8::1"),
+		DstIP:      net.ParseIP("2001:db8::2"),
+		Version:    6,
+		HopLimit:   64,
+		NextHeader: layers.IPProtocolTCP,
+	}
+	tcp := layers.TCP{
+		SYN:     true,
+		SrcPort: 1,
+		DstPort: 2,
+		Seq:     seq,
+	}
+	tcp.SetNetworkLayerForChecksum(&ip6)
+	opts := gopacket.SerializeOptions{
+		FixLengths:       true,
+		ComputeChecksums: true,
+	}
+	tcpBuf := gopacket.NewSerializeBuffer()
+	err := gopacket.SerializeLayers(tcpBuf, opts, &tcp, gopacket.Payload([]byte{1, 2, 3}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip6Payload := tcpBuf.Bytes()
+	if withExtension {
+		// an empty destination options header: next header TCP, length 0, PadN
+		ip6.NextHeader = layers.IPProtocolIPv6Destination
+		ext := []byte{byte(layers.IPProtocolTCP), 0, 1, 4, 0, 0, 0, 0}
+		ip6Payload = append(ext, ip6Payload...)
+	}
+	buf := gopacket.NewSerializeBuffer()
+	err = gopacket.SerializeLayers(buf, opts, &ip6, gopacket.Payload(ip6Payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestSequenceFromIPv6Packet(t *testing.T) {
+	var testSeq uint32 = 12345
+	for _, withExtension := range []bool{false, true} {
+		seq, err := SequenceFromPacket(makeTestIPv6Packet(t, testSeq, withExtension))
+		if err != nil || seq != testSeq {
+			t.Errorf("SequenceFromPacket failed for IPv6 packet (extension header %v): %d %v", withExtension, seq, err)
+		}
+	}
+}
+
+func TestNewTcpIpFlowFromIPv6Packet(t *testing.T) {
+	ipFlow, _ := gopacket.FlowFromEndpoints(layers.NewIPEndpoint(net.ParseIP("2001:db8::1")), layers.NewIPEndpoint(net.ParseIP("2001:db8::2")))
+	tcpFlow, _ := gopacket.FlowFromEndpoints(layers.NewTCPPortEndpoint(layers.TCPPort(1)), layers.NewTCPPortEndpoint(layers.TCPPort(2)))
+	want := NewTcpIpFlowFromFlows(ipFlow, tcpFlow)
+
+	for _, withExtension := range []bool{false, true} {
+		flow, err := NewTcpIpFlowFromPacket(makeTestIPv6Packet(t, 1, withExtension))
+		if err != nil || !flow.Equal(want) {
+			t.Errorf("NewTcpIpFlowFromPacket failed for IPv6 packet (extension header %v): %s %v", withExtension, flow, err)
+		}
+	}
+}
+
+func TestFlowStringIPv6(t *testing.T) {
+	ipFlow, _ := gopacket.FlowFromEndpoints(layers.NewIPEndpoint(net.ParseIP("2001:db8::1")), layers.NewIPEndpoint(net.ParseIP("2001:db8::2")))
+	tcpFlow, _ := gopacket.FlowFromEndpoints(layers.NewTCPPortEndpoint(layers.TCPPort(80)), layers.NewTCPPortEndpoint(layers.TCPPort(1234)))
+	tcpIpFlow := NewTcpIpFlowFromFlows(ipFlow, tcpFlow)
+	if tcpIpFlow.String() != "[2001:db8::1]:80-[2001:db8::2]:1234" {
+		t.Errorf("TcpIpFlow.String() fail: %s", tcpIpFlow.String())
+	}
+	if tcpIpFlow.Reverse().String() != "[2001:db8::2]:1234-[2001:db8::1]:80" {
+		t.Errorf("TcpIpFlow.String() fail: %s", tcpIpFlow.Reverse().String())
+	}
+}
+
+func TestFlowVLANTags(t *testing.T) {
+	ipFlow, _ := gopacket.FlowFromEndpoints(layers.NewIPEndpoint(net.IPv4(1, 2, 3, 4)), layers.NewIPEndpoint(net.IPv4(2, 3, 4, 5)))
+	tcpFlow, _ := gopacket.FlowFromEndpoints(layers.NewTCPPortEndpoint(layers.TCPPort(1)), layers.NewTCPPortEndpoint(layers.TCPPort(2)))
+	untagged := NewTcpIpFlowFromFlows(ipFlow, tcpFlow)
+	vlan100 := NewTcpIpFlowWithVLANTags(ipFlow, tcpFlow, NewVLANTags(100))
+	vlan200 := NewTcpIpFlowWithVLANTags(ipFlow, tcpFlow, NewVLANTags(200))
+	qinq := NewTcpIpFlowWithVLANTags(ipFlow, tcpFlow, NewVLANTags(100, 200))
+
+	if untagged.Equal(vlan100) || vlan100.Equal(vlan200) || vlan100.Equal(qinq) {
+		t.Error("TcpIpFlow.Equal must distinguish VLAN tags")
+	}
+	if vlan100.ConnectionHash() == vlan200.ConnectionHash() || untagged.ConnectionHash() == vlan100.ConnectionHash() {
+		t.Error("ConnectionHash must distinguish VLAN tags")
+	}
+	if vlan100.ConnectionHash() != vlan100.Reverse().ConnectionHash() {
+		t.Error("ConnectionHash of reversed VLAN flow must collide")
+	}
+	if !vlan100.Reverse().Reverse().Equal(vlan100) {
+		t.Error("Reverse must preserve VLAN tags")
+	}
+	if vlan100.String() != "1.2.3.4:1-2.3.4.5:2-vlan100" {
+		t.Errorf("TcpIpFlow.String() fail: %s", vlan100.String())
+	}
+	if qinq.String() != "1.2.3.4:1-2.3.4.5:2-vlan100.200" {
+		t.Errorf("TcpIpFlow.String() fail: %s", qinq.String())
+	}
+	if untagged.String() != "1.2.3.4:1-2.3.4.5:2" {
+		t.Errorf("TcpIpFlow.String() fail: %s", untagged.String())
+	}
+}
+
+func TestFlowSensor(t *testing.T) {
+	ipFlow, _ := gopacket.FlowFromEndpoints(layers.NewIPEndpoint(net.IPv4(1, 2, 3, 4)), layers.NewIPEndpoint(net.IPv4(2, 3, 4, 5)))
+	tcpFlow, _ := gopacket.FlowFromEndpoints(layers.NewTCPPortEndpoint(layers.TCPPort(1)), layers.NewTCPPortEndpoint(layers.TCPPort(2)))
+	local := NewTcpIpFlowFromFlows(ipFlow, tcpFlow)
+	edge1 := local.WithSensor("edge1")
+	edge2 := local.WithSensor("edge2")
+
+	if local.Sensor() != "" || edge1.Sensor() != "edge1" {
+		t.Error("WithSensor must not modify the original flow")
+	}
+	if local.Equal(edge1) || edge1.Equal(edge2) {
+		t.Error("TcpIpFlow.Equal must distinguish sensors")
+	}
+	if local.ConnectionHash() == edge1.ConnectionHash() || edge1.ConnectionHash() == edge2.ConnectionHash() {
+		t.Error("ConnectionHash must distinguish sensors")
+	}
+	if edge1.ConnectionHash() != edge1.Reverse().ConnectionHash() {
+		t.Error("ConnectionHash of reversed sensor flow must collide")
+	}
+	if edge1.String() != "1.2.3.4:1-2.3.4.5:2@edge1" {
+		t.Errorf("TcpIpFlow.String() fail: %s", edge1.String())
+	}
+}
+
+func TestParseTcpIpFlow(t *testing.T) {
+	for _, s := range []string{
+		"1.2.3.4:80-5.6.7.8:1234",
+		"[2001:db8::1]:80-[2001:db8::2]:1234",
+		"1.2.3.4:80-5.6.7.8:1234-vlan100",
+		"[2001:db8::1]:80-[2001:db8::2]:1234-vlan100.200",
+		"1.2.3.4:80-5.6.7.8:1234-vlan100@edge-1",
+	} {
+		flow, err := ParseTcpIpFlow(s)
+		if err != nil {
+			t.Errorf("%s: %s", s, err)
+			continue
+		}
+		if flow.String() != s {
+			t.Errorf("parsed flow %s != %s", flow, s)
+		}
+		if reverse, err := ParseTcpIpFlow(flow.Reverse().String()); err != nil || !reverse.Reverse().Equal(flow) {
+			t.Errorf("%s: reverse flow does not round trip", s)
+		}
+	}
+
+	ip := layers.IPv4{SrcIP: net.IP{1, 2, 3, 4}, DstIP: net.IP{5, 6, 7, 8}}
+	// the transport flow of a TCP layer is only set by decoding it
+	var tcp layers.TCP
+	buf := gopacket.NewSerializeBuffer()
+	gopacket.SerializeLayers(buf, gopacket.SerializeOptions{}, &layers.TCP{SrcPort: 80, DstPort: 1234})
+	tcp.DecodeFromBytes(buf.Bytes(), gopacket.NilDecodeFeedback)
+	decoded := NewTcpIpFlowFromLayers(ip, tcp)
+	if parsed, err := ParseTcpIpFlow("1.2.3.4:80-5.6.7.8:1234"); err != nil || !parsed.Equal(decoded) {
+		t.Errorf("parsed flow %v does not equal decoded flow %s", parsed, decoded)
+	}
+	srcIP, srcPort, dstIP, dstPort := decoded.Endpoints()
+	if !srcIP.Equal(net.IP{1, 2, 3, 4}) || srcPort != 80 || !dstIP.Equal(net.IP{5, 6, 7, 8}) || dstPort != 1234 {
+		t.Errorf("bad endpoints %s:%d %s:%d", srcIP, srcPort, dstIP, dstPort)
+	}
+
+	for _, s := range []string{
+		"",
+		"1.2.3.4:80",
+		"1.2.3.4-5.6.7.8",
+		"1.2.3.4:80-5.6.7.8:65536",
+		"1.2.3.4:80-[2001:db8::2]:1234",
+		"2001:db8::1:80-2001:db8::2:1234",
+		"1.2.3.4:80-5.6.7.8:1234-vlan",
+		"1.2.3.4:80-5.6.7.8:1234-vlan1.2.3",
+		"1.2.3.4:80-5.6.7.8:1234@",
+	} {
+		if flow, err := ParseTcpIpFlow(s); err == nil {
+			t.Errorf("invalid flow %q parsed as %s", s, flow)
+		}
+	}
+}
+
+func TestTcpIpFlowJSON(t *testing.T) {
+	flow, err := ParseTcpIpFlow("[2001:db8::1]:80-[2001:db8::2]:1234-vlan100@edge1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(flow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"SrcIP":"2001:db8::1","SrcPort":80,"DstIP":"2001:db8::2","DstPort":1234,"VLANs":[100],"Sensor":"edge1"}`
+	if string(b) != want {
+		t.Errorf("JSON %s != %s", b, want)
+	}
+	var decoded TcpIpFlow
+	if err = json.Unmarshal(b, &decoded); err != nil || !decoded.Equal(flow) {
+		t.Errorf("JSON did not round trip: %s %v", decoded, err)
+	}
+
+	// an outer tag of VLAN 0 keeps its position in the stack
+	flow, err = ParseTcpIpFlow("1.2.3.4:80-5.6.7.8:1234-vlan0.200")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err = json.Marshal(flow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = `{"SrcIP":"1.2.3.4","SrcPort":80,"DstIP":"5.6.7.8","DstPort":1234,"VLANs":[0,200]}`
+	if string(b) != want {
+		t.Errorf("JSON %s != %s", b, want)
+	}
+	decoded = TcpIpFlow{}
+	if err = json.Unmarshal(b, &decoded); err != nil || decoded.VLANTags() != NewVLANTags(0, 200) {
+		t.Errorf("JSON did not round trip: %s %v", decoded, err)
+	}
+
+	decoded = TcpIpFlow{}
+	if err = json.Unmarshal([]byte(`"1.2.3.4:80-5.6.7.8:1234"`), &decoded); err != nil || decoded.String() != "1.2.3.4:80-5.6.7.8:1234" {
+		t.Errorf("string form not decoded: %s %v", decoded, err)
+	}
+	if err = json.Unmarshal([]byte(`{"SrcIP":"1.2.3.4","SrcPort":80,"DstIP":"2001:db8::2","DstPort":1234}`), &decoded); err == nil {
+		t.Error("flow of mixed IP versions decoded")
+	}
+}
+
+func TestConnectionKey(t *testing.T) {
+	a, b := net.ParseIP("1.2.3.4"), net.ParseIP("1.2.3.5")
+	flow := func(srcIP net.IP, srcPort uint16, dstIP net.IP, dstPort uint16) *TcpIpFlow {
+		f, err := NewTcpIpFlowFromEndpoints(srcIP, srcPort, dstIP, dstPort)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+
+	// FastHash is symmetric in the ports, so these distinct connections collide
+	ab12, ab21 := flow(a, 1, b, 2), flow(a, 2, b, 1)
+	if ab12.ConnectionHash() != ab21.ConnectionHash() {
+		t.Fatal("expected a ConnectionHash collision")
+	}
+	if ab12.ConnectionKey() == ab21.ConnectionKey() {
+		t.Error("distinct connections share a ConnectionKey")
+	}
+
+	// every pair of flows over a small address and port space has the
+	// same key if and only if the flows are of the same connection
+	var flows []*TcpIpFlow
+	for _, srcIP := range []net.IP{a, b} {
+		for _, dstIP := range []net.IP{a, b} {
+			for srcPort := uint16(1); srcPort <= 3; srcPort++ {
+				for dstPort := uint16(1); dstPort <= 3; dstPort++ {
+					flows = append(flows, flow(srcIP, srcPort, dstIP, dstPort))
+				}
+			}
+		}
+	}
+	flows = append(flows, flow(net.ParseIP("2001:db8::1"), 1, net.ParseIP("2001:db8::2"), 2))
+	flows = append(flows, flows[0].WithSensor("edge1"))
+	for _, f := range flows {
+		if f.ConnectionKey() != f.Reverse().ConnectionKey() {
+			t.Errorf("the directions of %s have different keys", f)
+		}
+		for _, g := range flows {
+			same := f.Equal(g) || f.Equal(g.Reverse())
+			if (f.ConnectionKey() == g.ConnectionKey()) != same {
+				t.Errorf("%s and %s: same key %v, same connection %v", f, g, !same, same)
+			}
+		}
+	}
+}
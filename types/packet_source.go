@@ -20,9 +20,11 @@
 package types
 
 import (
+	"net"
+	"time"
+
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"time"
 )
 
 type Supervisor interface {
@@ -37,12 +39,56 @@ type PacketSource interface {
 	GetStartedChan() chan bool // used for unit tests
 }
 
-// PacketManifest is used to send parsed packets via channels to other goroutines
+// PacketManifest is used to send parsed packets via channels to other goroutines.
+// LinkType describes the framing of RawPacket.
+// IP holds the network layer of IPv4 packets and IPv6 that of IPv6 packets;
+// only one of them is populated, see IsIPv6.
+// FragmentOverlap is set if the packet was reassembled from IP fragments
+// which overlapped each other with conflicting contents.
+// Tunnel is set if the packet was decapsulated from a tunnel, in which
+// case RawPacket still holds the encapsulated frame.
+// TruncatedBytes is the number of bytes at the end of the TCP payload
+// which were cut off by the capture's snaplen; Payload only holds the
+// captured bytes.
+// BadChecksum is set if the IPv4 header or TCP checksum of the packet is
+// wrong, thus its receiver discards it; it is never set if checksums are
+// not validated.
+// SrcMAC is the source hardware address of the captured frame, if its
+// link header has one.
 type PacketManifest struct {
-	Timestamp time.Time
-	Flow      *TcpIpFlow
-	RawPacket []byte
-	IP        layers.IPv4
-	TCP       layers.TCP
-	Payload   gopacket.Payload
+	Timestamp       time.Time
+	Flow            *TcpIpFlow
+	LinkType        layers.LinkType
+	RawPacket       []byte
+	IP              layers.IPv4
+	IPv6            layers.IPv6
+	TCP             layers.TCP
+	Payload         gopacket.Payload
+	FragmentOverlap *FragmentOverlap
+	Tunnel          *Tunnel
+	TruncatedBytes  int
+	BadChecksum     bool
+	SrcMAC          net.HardwareAddr
+}
+
+// FragmentOverlap describes the first conflicting overlap between the
+// fragments of a reassembled IP datagram. Offset is relative to the
+// start of the IP payload. Original holds the bytes of the fragment
+// received first, which are the ones kept in the reassembled datagram,
+// and Conflict holds the differing bytes of the later fragment.
+type FragmentOverlap struct {
+	Offset   int
+	Original []byte
+	Conflict []byte
+}
+
+// SegmentLength returns the length of the TCP payload as sent,
+// including the bytes which were not captured
+func (p *PacketManifest) SegmentLength() int {
+	return len(p.Payload) + p.TruncatedBytes
+}
+
+// IsIPv6 returns true if the packet was carried over IPv6
+func (p *PacketManifest) IsIPv6() bool {
+	return p.IPv6.Version == 6
 }
@@ -34,6 +34,13 @@ type Reassembly struct {
 	End bool
 	// Seen is the timestamp this set of bytes was pulled off the wire.
 	Seen time.Time
+	// TruncatedBytes is the number of bytes of the segment following
+	// Bytes which were not captured, thus Bytes is not contiguous with
+	// the next Reassembly if it is non-zero.
+	TruncatedBytes int
+	// Evidence records the headers of the segment the bytes were
+	// received in; it is shared by the Reassemblies of a segment.
+	Evidence *HeaderEvidence
 }
 
 // String returns a string representation of Reassembly
@@ -17,6 +17,9 @@ package types
 type Ring struct {
 	next, prev *Ring
 	Reassembly *Reassembly
+	// window and size are only set for the elements of bounded rings
+	window *ringWindow
+	size   int
 }
 
 func (r *Ring) init() *Ring {
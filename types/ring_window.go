@@ -0,0 +1,178 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package types
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// RingBudget limits the payload bytes held by the bounded rings of all
+// connections together. Each ring holding segments is entitled to an
+// equal share of the budget. Once the budget is exceeded, a ring above
+// its share drops its oldest segments as it adds new ones, thus a busy
+// connection cannot starve the others. It is safe for concurrent use.
+type RingBudget struct {
+	max   int64
+	used  int64
+	rings int64
+}
+
+// NewRingBudget returns a RingBudget of the given number of bytes
+func NewRingBudget(maxBytes int) *RingBudget {
+	return &RingBudget{max: int64(maxBytes)}
+}
+
+// Used returns the number of bytes held by the rings of the budget
+func (b *RingBudget) Used() int {
+	return int(atomic.LoadInt64(&b.used))
+}
+
+func (b *RingBudget) add(n int) {
+	atomic.AddInt64(&b.used, int64(n))
+}
+
+// addRings changes the number of rings holding segments
+func (b *RingBudget) addRings(n int) {
+	atomic.AddInt64(&b.rings, int64(n))
+}
+
+// exceeded returns true if the budget is exceeded and a ring holding
+// the given number of bytes is above its share
+func (b *RingBudget) exceeded(bytes int) bool {
+	if atomic.LoadInt64(&b.used) <= b.max {
+		return false
+	}
+	rings := atomic.LoadInt64(&b.rings)
+	return rings < 1 || int64(bytes) > b.max/rings
+}
+
+// RingLimits bound the stream segments a bounded ring retains: the
+// number of segments, the payload bytes they hold, and the time
+// between the oldest and the newest segment being seen. Zero values
+// impose no bound. Budget, if set, is shared with other rings.
+type RingLimits struct {
+	MaxPackets int
+	MaxBytes   int
+	MaxAge     time.Duration
+	Budget     *RingBudget
+}
+
+// ringWindow is the state shared by the elements of a bounded ring
+type ringWindow struct {
+	RingLimits
+	oldest, newest *Ring
+	packets, bytes int
+	// spare is an element dropped from the ring for reuse
+	spare *Ring
+}
+
+// NewBoundedRing returns the write position of an empty ring which
+// grows as segments are added to it and drops its oldest segments to
+// stay within the given limits. The newest segment is always kept.
+func NewBoundedRing(limits RingLimits) *Ring {
+	r := new(Ring).init()
+	r.window = &ringWindow{RingLimits: limits}
+	return r
+}
+
+// Add stores the given Reassembly in the ring element r, the write
+// position of its ring, and returns the next write position. A ring
+// made by NewRing thus overwrites its oldest element, whereas the
+// write position of a bounded ring is always an empty element between
+// its newest and oldest segments.
+func (r *Ring) Add(reassembly *Reassembly) *Ring {
+	w := r.window
+	r.Reassembly = reassembly
+	if w == nil {
+		return r.Next()
+	}
+	r.size = len(reassembly.Bytes)
+	w.packets += 1
+	w.bytes += r.size
+	if w.Budget != nil {
+		w.Budget.add(r.size)
+	}
+	if w.oldest == nil {
+		w.oldest = r
+		if w.Budget != nil {
+			w.Budget.addRings(1)
+		}
+	}
+	w.newest = r
+	for w.oldest != w.newest && w.exceeded() {
+		w.dropOldest()
+	}
+	if r.next.Reassembly == nil {
+		return r.next
+	}
+	next := w.spare
+	if next == nil {
+		next = &Ring{window: w}
+	}
+	w.spare = nil
+	next.prev, next.next = r, r.next
+	r.next.prev = next
+	r.next = next
+	return next
+}
+
+// Release drops all segments of a bounded ring, returning their bytes
+// to its budget
+func (r *Ring) Release() {
+	w := r.window
+	if w == nil {
+		return
+	}
+	for w.oldest != nil {
+		w.dropOldest()
+	}
+}
+
+func (w *ringWindow) exceeded() bool {
+	return (w.MaxPackets > 0 && w.packets > w.MaxPackets) ||
+		(w.MaxBytes > 0 && w.bytes > w.MaxBytes) ||
+		(w.MaxAge > 0 && w.newest.Reassembly.Seen.Sub(w.oldest.Reassembly.Seen) > w.MaxAge) ||
+		(w.Budget != nil && w.Budget.exceeded(w.bytes))
+}
+
+// dropOldest removes the oldest segment's element from the ring
+func (w *ringWindow) dropOldest() {
+	r := w.oldest
+	w.packets -= 1
+	w.bytes -= r.size
+	if w.Budget != nil {
+		w.Budget.add(-r.size)
+	}
+	if r == w.newest {
+		// the ring keeps an element to write to
+		w.oldest, w.newest = nil, nil
+		r.Reassembly, r.size = nil, 0
+		if w.Budget != nil {
+			w.Budget.addRings(-1)
+		}
+		return
+	}
+	w.oldest = r.next
+	r.prev.next = r.next
+	r.next.prev = r.prev
+	r.next, r.prev, r.Reassembly, r.size = nil, nil, nil, 0
+	w.spare = r
+}
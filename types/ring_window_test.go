@@ -0,0 +1,140 @@
+package types
+
+import (
+	"testing"
+	"time"
+)
+
+// addTestSegments adds segments of the given sizes, seen a second apart,
+// to the ring at r and returns the next write position
+func addTestSegments(r *Ring, seq int, sizes ...int) *Ring {
+	start := time.Unix(1, 0)
+	for _, size := range sizes {
+		r = r.Add(&Reassembly{
+			Seq:   Sequence(seq),
+			Bytes: make([]byte, size),
+			Seen:  start.Add(time.Duration(seq) * time.Second),
+		})
+		seq += 1
+	}
+	return r
+}
+
+// ringSeqs returns the sequence numbers of the segments before the
+// write position r, oldest first
+func ringSeqs(r *Ring) []int {
+	var seqs []int
+	for current := r.Prev(); current != r && current.Reassembly != nil; current = current.Prev() {
+		seqs = append([]int{int(current.Reassembly.Seq)}, seqs...)
+	}
+	return seqs
+}
+
+func checkRingSeqs(t *testing.T, name string, r *Ring, want ...int) {
+	got := ringSeqs(r)
+	if len(got) != len(want) {
+		t.Errorf("%s: ring holds %v rather than %v", name, got, want)
+		return
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Errorf("%s: ring holds %v rather than %v", name, got, want)
+			return
+		}
+	}
+	if r.Reassembly != nil || r.Next().Reassembly == nil && len(want) > 0 {
+		t.Errorf("%s: write position is not between the newest and oldest segment", name)
+	}
+}
+
+func TestBoundedRing(t *testing.T) {
+	r := NewBoundedRing(RingLimits{})
+	checkRingSeqs(t, "empty", r)
+	r = addTestSegments(r, 0, 10, 10, 10, 10, 10)
+	checkRingSeqs(t, "unbounded", r, 0, 1, 2, 3, 4)
+	if r.Prev().Count() != 5 || r.Len() != 6 {
+		t.Errorf("unbounded: count %d len %d", r.Prev().Count(), r.Len())
+	}
+
+	r = NewBoundedRing(RingLimits{MaxPackets: 3})
+	r = addTestSegments(r, 0, 10, 10, 10, 10, 10)
+	checkRingSeqs(t, "packets", r, 2, 3, 4)
+	if r.Len() != 4 {
+		t.Errorf("packets: ring of %d elements", r.Len())
+	}
+
+	r = NewBoundedRing(RingLimits{MaxBytes: 25})
+	r = addTestSegments(r, 0, 10, 10, 10, 5, 5)
+	checkRingSeqs(t, "bytes", r, 2, 3, 4)
+	// the newest segment is kept however large it is
+	r = addTestSegments(r, 5, 100)
+	checkRingSeqs(t, "large segment", r, 5)
+	r = addTestSegments(r, 6, 10)
+	checkRingSeqs(t, "after large segment", r, 6)
+
+	r = NewBoundedRing(RingLimits{MaxAge: 2 * time.Second})
+	r = addTestSegments(r, 0, 1, 1, 1, 1, 1)
+	checkRingSeqs(t, "age", r, 2, 3, 4)
+}
+
+func TestRingBudget(t *testing.T) {
+	budget := NewRingBudget(50)
+	r1 := NewBoundedRing(RingLimits{Budget: budget})
+	r2 := NewBoundedRing(RingLimits{Budget: budget, MaxPackets: 2})
+
+	r1 = addTestSegments(r1, 0, 10, 10, 10)
+	r2 = addTestSegments(r2, 0, 10, 10, 10)
+	checkRingSeqs(t, "r2", r2, 1, 2)
+	if budget.Used() != 50 {
+		t.Errorf("budget used %d rather than 50", budget.Used())
+	}
+	// the budget is exceeded, so adding drops the oldest segments
+	r1 = addTestSegments(r1, 3, 10)
+	checkRingSeqs(t, "r1 over budget", r1, 1, 2, 3)
+	if budget.Used() != 50 {
+		t.Errorf("budget used %d rather than 50", budget.Used())
+	}
+
+	r2.Release()
+	checkRingSeqs(t, "released", r2)
+	if budget.Used() != 30 {
+		t.Errorf("budget used %d rather than 30 after release", budget.Used())
+	}
+	r1 = addTestSegments(r1, 4, 10, 10)
+	checkRingSeqs(t, "r1 within budget", r1, 1, 2, 3, 4, 5)
+}
+
+func TestRingBudgetFairShare(t *testing.T) {
+	budget := NewRingBudget(50)
+	busy := NewBoundedRing(RingLimits{Budget: budget})
+	quiet := NewBoundedRing(RingLimits{Budget: budget})
+
+	busy = addTestSegments(busy, 0, 10, 10, 10, 10)
+	quiet = addTestSegments(quiet, 0, 10, 10)
+	// the budget is exceeded, but the quiet ring is within its share
+	checkRingSeqs(t, "quiet", quiet, 0, 1)
+	if budget.Used() != 60 {
+		t.Errorf("budget used %d rather than 60", budget.Used())
+	}
+	// the busy ring is above its share, so adding drops its oldest segments
+	busy = addTestSegments(busy, 4, 10)
+	checkRingSeqs(t, "busy", busy, 2, 3, 4)
+	checkRingSeqs(t, "quiet after busy", quiet, 0, 1)
+	if budget.Used() != 50 {
+		t.Errorf("budget used %d rather than 50", budget.Used())
+	}
+
+	busy.Release()
+	quiet.Release()
+	if budget.Used() != 0 {
+		t.Errorf("budget used %d rather than 0 after release", budget.Used())
+	}
+}
+
+func TestFixedRingAdd(t *testing.T) {
+	r := NewRing(3)
+	r = addTestSegments(r, 0, 1, 1, 1, 1)
+	if r.Reassembly.Seq != 1 || r.Prev().Reassembly.Seq != 3 {
+		t.Error("Add does not overwrite the oldest element of a NewRing ring")
+	}
+}
@@ -0,0 +1,51 @@
+/*
+ *    HoneyBadger core library for detecting TCP injection attacks
+ *
+ *    Copyright (C) 2014, 2015  David Stainton
+ *
+ *    This program is free software: you can redistribute it and/or modify
+ *    it under the terms of the GNU General Public License as published by
+ *    the Free Software Foundation, either version 3 of the License, or
+ *    (at your option) any later version.
+ *
+ *    This program is distributed in the hope that it will be useful,
+ *    but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *    MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *    GNU General Public License for more details.
+ *
+ *    You should have received a copy of the GNU General Public License
+ *    along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package types
+
+import (
+	"fmt"
+	"net"
+)
+
+// Tunnel describes the encapsulation a packet was received in.
+// Src and Dst are the outer endpoints of the tunnel and Key is the
+// GRE key or VXLAN network identifier, if the tunnel carries one.
+type Tunnel struct {
+	Type string
+	Src  net.IP
+	Dst  net.IP
+	Key  uint32
+}
+
+const (
+	TunnelTypeGRE   = "gre"
+	TunnelTypeVXLAN = "vxlan"
+	TunnelTypeIPIP  = "ipip"
+)
+
+// String returns a string representation of the tunnel,
+// for example "vxlan 10.0.0.1->10.0.0.2 key 42"
+func (t *Tunnel) String() string {
+	s := fmt.Sprintf("%s %s->%s", t.Type, t.Src, t.Dst)
+	if t.Key != 0 {
+		s += fmt.Sprintf(" key %d", t.Key)
+	}
+	return s
+}